@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+	"tcbroker/pkg/config"
+)
+
+// openAPISpec describes the daemon's HTTP API, served on GET /openapi.yaml.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// maxRuleSize bounds the body of POST /rules.
+const maxRuleSize = 1 << 20
+
+// requestError is an error answered with a status code other than 500.
+type requestError struct {
+	code int
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// ruleNotFound is the error of a request for a rule the configuration lacks.
+func ruleNotFound(name string) error {
+	return &requestError{http.StatusNotFound, fmt.Errorf("no rule named '%s'", name)}
+}
+
+// apiHandler serves only the rules API of registerRules, for clients on the
+// network: starting, stopping and reloading stay with the Unix socket.
+func (d *daemon) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	d.registerRules(mux)
+	return mux
+}
+
+// registerRules adds the rules API to mux:
+//
+//	GET    /health             whether the daemon is serving
+//	GET    /rules              the rules of the configuration
+//	GET    /rules/{name}       one rule
+//	GET    /rules/{name}/stats its state and counters
+//	POST   /rules              add a rule
+//	DELETE /rules/{name}       remove a rule, also as DELETE /rules?name=
+//	GET    /openapi.yaml       the OpenAPI description of the API
+//
+// Rules are the JSON form of the rules of the config file, which is also
+// accepted in YAML. Changes are saved to the config file, so a reload keeps
+// them.
+func (d *daemon) registerRules(mux *http.ServeMux) {
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.health())
+	})
+	mux.HandleFunc("GET /rules", func(w http.ResponseWriter, r *http.Request) {
+		rules, err := d.rules()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	})
+	mux.HandleFunc("GET /rules/{name}", func(w http.ResponseWriter, r *http.Request) {
+		rule, err := d.rule(r.PathValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	})
+	mux.HandleFunc("GET /rules/{name}/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := d.ruleStats(r.PathValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+	mux.HandleFunc("POST /rules", func(w http.ResponseWriter, r *http.Request) {
+		rule, err := decodeRule(http.MaxBytesReader(w, r.Body, maxRuleSize))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		result, err := d.addRule(rule)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/rules/"+rule.Name)
+		writeJSON(w, http.StatusCreated, result)
+	})
+	deleteRule := func(w http.ResponseWriter, name string) {
+		result, err := d.deleteRule(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+	mux.HandleFunc("DELETE /rules/{name}", func(w http.ResponseWriter, r *http.Request) {
+		deleteRule(w, r.PathValue("name"))
+	})
+	mux.HandleFunc("DELETE /rules", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, &requestError{http.StatusBadRequest, errors.New("missing the name of the rule to remove")})
+			return
+		}
+		deleteRule(w, name)
+	})
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+}
+
+// healthStatus is the answer to GET /health. It is cheap to compute, so it
+// queries neither tc nor the interfaces.
+type healthStatus struct {
+	Status  string `json:"status"`
+	Active  bool   `json:"active"`
+	Rules   int    `json:"rules"`
+	Pending int    `json:"pending"`
+}
+
+func (d *daemon) health() healthStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return healthStatus{Status: "ok", Active: d.active, Rules: len(d.cfg.Rules), Pending: len(d.pending)}
+}
+
+// rules returns every rule of the configuration in its JSON form.
+func (d *daemon) rules() ([]map[string]any, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rules := []map[string]any{}
+	for i, priority := range d.cfg.Priorities() {
+		doc, err := ruleDocument(d.cfg.Rules[i], priority)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, doc)
+	}
+	return rules, nil
+}
+
+// rule returns the named rule in its JSON form.
+func (d *daemon) rule(name string) (map[string]any, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.findRule(name)
+	if i < 0 {
+		return nil, ruleNotFound(name)
+	}
+	return ruleDocument(d.cfg.Rules[i], d.cfg.Priorities()[i])
+}
+
+// ruleDocument returns rule with the priority it is installed with as the
+// JSON object of its YAML form, which POST /rules accepts back.
+func ruleDocument(rule config.Rule, priority int) (map[string]any, error) {
+	rule.Priority = priority
+	data, err := yaml.Marshal(rule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode rule '%s': %w", rule.Name, err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to encode rule '%s': %w", rule.Name, err)
+	}
+	return doc, nil
+}
+
+// decodeRule reads a rule in JSON or YAML. Unknown fields are rejected, so
+// a misspelt match field is not silently dropped from the filter.
+func decodeRule(r io.Reader) (config.Rule, error) {
+	var rule config.Rule
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return rule, &requestError{http.StatusBadRequest, fmt.Errorf("failed to read the rule: %w", err)}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rule); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("empty body")
+		}
+		return rule, &requestError{http.StatusBadRequest, fmt.Errorf("invalid rule: %w", err)}
+	}
+	return rule, nil
+}
+
+// ruleStats is the answer to GET /rules/{name}/stats: the state of a rule
+// with its counters per destination interface, and per filter and
+// destination interface.
+type ruleStats struct {
+	Name         string            `json:"name"`
+	SrcIntf      string            `json:"src_intf"`
+	Priority     int               `json:"priority"`
+	State        string            `json:"state"`
+	Waiting      []string          `json:"waiting,omitempty"`
+	Destinations []destStats       `json:"destinations"`
+	Filters      []filterDestStats `json:"filters"`
+}
+
+func (d *daemon) ruleStats(name string) (ruleStats, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.findRule(name)
+	if i < 0 {
+		return ruleStats{}, ruleNotFound(name)
+	}
+	rule, priority := d.cfg.Rules[i], d.cfg.Priorities()[i]
+	rs := ruleStats{Name: rule.Name, SrcIntf: rule.SrcIntf, Priority: priority, Filters: []filterDestStats{}}
+	rs.State, rs.Waiting = d.ruleState(rule.Name)
+	if !d.linkExists(rule.SrcIntf) {
+		for _, dst := range rule.DstIntf {
+			rs.Destinations = append(rs.Destinations, destStats{Intf: dst})
+		}
+		return rs, nil
+	}
+	rs.Destinations = getRuleStats(d.backend, rule, priority)
+	filters, err := getFilterDestStats(d.backend, rule, priority)
+	if err != nil {
+		return ruleStats{}, err
+	}
+	if filters != nil {
+		rs.Filters = filters
+	}
+	return rs, nil
+}
+
+// addRule appends rule to the config file and the configuration and, while
+// it is applied, installs it.
+func (d *daemon) addRule(rule config.Rule) (planResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.findRule(rule.Name) >= 0 {
+		return planResult{}, &requestError{http.StatusConflict, fmt.Errorf("a rule named '%s' already exists", rule.Name)}
+	}
+	return d.editConfig(func(doc *config.Document) error {
+		return doc.AddRule(rule)
+	})
+}
+
+// deleteRule removes the named rule from the config file and the
+// configuration and, while it is applied, its filters. The rules after it
+// on its source interface are given the priorities they had, so their
+// filters are left alone.
+func (d *daemon) deleteRule(name string) (planResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.findRule(name)
+	if i < 0 {
+		return planResult{}, ruleNotFound(name)
+	}
+	if len(d.cfg.Rules) == 1 {
+		return planResult{}, &requestError{http.StatusConflict, fmt.Errorf("'%s' is the last rule; use stop to remove all filters", name)}
+	}
+	priorities := d.cfg.Priorities()
+	return d.editConfig(func(doc *config.Document) error {
+		doc.RemoveRule(name)
+		for j, rule := range d.cfg.Rules[i+1:] {
+			if rule.SrcIntf == d.cfg.Rules[i].SrcIntf && rule.Priority == 0 {
+				doc.SetPriority(rule.Name, priorities[i+1+j])
+			}
+		}
+		return nil
+	})
+}
+
+// editConfig changes the config file with edit and makes what it then says
+// the configuration, applying it if the current one is applied. The file is
+// written once the change is applied, so a failed change leaves both alone.
+// A config file that differs from the one the configuration was loaded
+// from, edited by hand but not reloaded, or invalid, is left alone too. The
+// caller holds d.mu.
+func (d *daemon) editConfig(edit func(*config.Document) error) (planResult, error) {
+	data, err := os.ReadFile(d.configFile)
+	if err != nil {
+		return planResult{}, fmt.Errorf("failed to read config file %s: %w", d.configFile, err)
+	}
+	if sha256.Sum256(data) != d.loadedSum {
+		return planResult{}, &requestError{http.StatusConflict, fmt.Errorf("%s changed since the configuration was loaded; reload it first", d.configFile)}
+	}
+	doc, err := config.ParseDocument(data)
+	if err != nil {
+		return planResult{}, err
+	}
+	if err := edit(doc); err != nil {
+		return planResult{}, err
+	}
+	if data, err = doc.Bytes(); err != nil {
+		return planResult{}, err
+	}
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return planResult{}, &requestError{http.StatusBadRequest, err}
+	}
+
+	previous := d.cfg
+	result, err := d.replaceConfig(cfg)
+	if err != nil {
+		return planResult{}, err
+	}
+	if err := config.WriteFile(d.configFile, data); err != nil {
+		// A reload would lose the change, so take it back
+		if _, undoErr := d.replaceConfig(previous); undoErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to restore the previous configuration: %w", undoErr))
+		}
+		return planResult{}, err
+	}
+	// The file watcher sees the same content and does not reload it
+	d.configSum = sha256.Sum256(data)
+	d.loadedSum = d.configSum
+	return result, nil
+}
+
+// replaceConfig makes cfg the configuration, applying it if the current one
+// is applied. The caller holds d.mu.
+func (d *daemon) replaceConfig(cfg *config.Config) (planResult, error) {
+	if !d.active {
+		d.cfg = cfg
+		return planResult{}, nil
+	}
+	plan, err := d.apply(cfg)
+	if err != nil {
+		return planResult{}, err
+	}
+	return newPlanResult(plan), nil
+}
+
+// findRule returns the index of the named rule, or -1. The caller holds
+// d.mu.
+func (d *daemon) findRule(name string) int {
+	return slices.IndexFunc(d.cfg.Rules, func(rule config.Rule) bool { return rule.Name == name })
+}
+
+// ruleState returns the state of the named rule and the interfaces it waits
+// for. The caller holds d.mu.
+func (d *daemon) ruleState(name string) (string, []string) {
+	if !d.active {
+		return ruleStopped, nil
+	}
+	if missing, ok := d.pending[name]; ok {
+		return rulePending, missing
+	}
+	return ruleActive, nil
+}
+
+// apiTLSConfig returns the TLS configuration of the HTTP API: the server
+// presents the certificate in certFile and keyFile, and clients must present
+// one signed by a CA in clientCAFile.
+func apiTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// listenAPI listens for TLS connections to the HTTP API on a TCP address.
+func listenAPI(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+// apiRequest sends a request to h and returns the recorded response.
+func apiRequest(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestAPIRules(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	h := d.handler()
+
+	rec := apiRequest(h, "GET", "/rules", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var rules []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0]["name"] != "web" || rules[0]["priority"] != 1.0 {
+		t.Errorf("Expected web and dns with their priorities, got %v", rules)
+	}
+
+	rec = apiRequest(h, "GET", "/rules/dns", "")
+	expected := `{"dst_intf":["eth1"],"filters":[{"dst_port":53,"ip_proto":"udp"}],"name":"dns","priority":1,"src_intf":"eth2"}`
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != expected {
+		t.Errorf("Expected %s, got %d: %s", expected, rec.Code, rec.Body)
+	}
+
+	if rec := apiRequest(h, "GET", "/rules/ssh", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown rule, got %d", rec.Code)
+	}
+}
+
+func TestAPIAddDeleteRule(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	if _, err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	h := d.handler()
+
+	ssh := `{"name": "ssh", "src_intf": "eth0", "dst_intf": "eth1", "filters": [{"ip_proto": "tcp", "dst_port": 22}]}`
+	rec := apiRequest(h, "POST", "/rules", ssh)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/rules/ssh" {
+		t.Fatalf("Expected 201 with a Location, got %d: %s", rec.Code, rec.Body)
+	}
+	if filters := backend.Filters[tc.FakeKey("eth0", "ingress")]; len(filters) != 2 {
+		t.Errorf("Expected web and ssh on eth0, got %d filter(s)", len(filters))
+	}
+
+	testCases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "duplicate", body: ssh, code: http.StatusConflict},
+		{name: "empty", body: "", code: http.StatusBadRequest},
+		{name: "unknown field", body: `{"name": "x", "src_intf": "eth0", "dst_intf": "eth1", "filters": [{"dport": 22}]}`, code: http.StatusBadRequest},
+		{name: "invalid", body: `{"name": "x", "src_intf": "eth0", "dst_intf": "eth1", "filters": []}`, code: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := apiRequest(h, "POST", "/rules", tc.body); rec.Code != tc.code {
+				t.Errorf("Expected %d, got %d: %s", tc.code, rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// YAML is accepted too
+	rec = apiRequest(h, "POST", "/rules", "name: ntp\nsrc_intf: eth2\ndst_intf: eth1\nfilters:\n  - ip_proto: udp\n    dst_port: 123\n")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for a YAML rule, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// The file is rewritten, so a reload keeps the rules
+	if _, err := d.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if rules, _ := d.rules(); len(rules) != 4 {
+		t.Errorf("Expected web, dns, ssh and ntp after a reload, got %v", rules)
+	}
+
+	rec = apiRequest(h, "DELETE", "/rules/web", "")
+	var result planResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	// ssh keeps its priority, so only web's filter goes away
+	if result.Removed != 1 || result.Added != 0 {
+		t.Errorf("Expected only web's filter removed, got %+v", result)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules/web", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed rule, got %d", rec.Code)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules?name=ntp", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected ntp to be removed by query, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a name, got %d", rec.Code)
+	}
+
+	data, err := os.ReadFile(d.configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Parse(data)
+	if err != nil {
+		t.Fatalf("Expected the saved config file to be valid: %v", err)
+	}
+	var names []string
+	for _, rule := range cfg.Rules {
+		names = append(names, rule.Name)
+	}
+	if got := strings.Join(names, ","); got != "dns,ssh" {
+		t.Errorf("Expected the config file to hold dns and ssh, got %s", got)
+	}
+	// ssh took web's place on eth0 only in name: it keeps its preferences
+	if cfg.Rules[1].Priority != 2 {
+		t.Errorf("Expected ssh to keep priority 2, got %d", cfg.Rules[1].Priority)
+	}
+}
+
+func TestAPIRefusesEditsOfChangedConfigFile(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	h := d.handler()
+
+	// Edited by hand but not reloaded yet
+	edited := strings.Replace(daemonConfig, "dst_port: 53", "dst_port: 5353", 1)
+	if err := os.WriteFile(d.configFile, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules/dns", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a changed config file, got %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := os.ReadFile(d.configFile); string(data) != edited {
+		t.Errorf("Expected the hand edit to be left alone, got:\n%s", data)
+	}
+
+	if _, err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules/dns", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected dns to be removed after the reload, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := apiRequest(h, "DELETE", "/rules/web", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for the last rule, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIKeepsConfigFileOnFailedApply(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	if _, err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	h := d.handler()
+	ssh := `{"name": "ssh", "src_intf": "eth0", "dst_intf": "eth1", "filters": [{"ip_proto": "tcp", "dst_port": 22}]}`
+
+	backend.Fail = func(op, iface string) error { return errors.New("tc failed") }
+	if rec := apiRequest(h, "POST", "/rules", ssh); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a failed apply, got %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := os.ReadFile(d.configFile); string(data) != daemonConfig {
+		t.Errorf("Expected the config file to be left alone, got:\n%s", data)
+	}
+	if rules, _ := d.rules(); len(rules) != 2 {
+		t.Errorf("Expected web and dns only, got %v", rules)
+	}
+
+	// The daemon is not stuck: the next request goes through
+	backend.Fail = nil
+	if rec := apiRequest(h, "POST", "/rules", ssh); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 once tc works again, got %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := os.ReadFile(d.configFile); !strings.Contains(string(data), "name: ssh") {
+		t.Errorf("Expected ssh in the config file, got:\n%s", data)
+	}
+}
+
+func TestAPIRuleStats(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	h := d.handler()
+
+	var stats ruleStats
+	rec := apiRequest(h, "GET", "/rules/web/stats", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.State != ruleStopped || len(stats.Filters) != 1 || stats.Filters[0].Packets != 0 {
+		t.Errorf("Expected a stopped rule without counters, got %+v", stats)
+	}
+
+	if _, err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	backend.Count("eth0", "ingress", 0, 5, 500)
+	rec = apiRequest(h, "GET", "/rules/web/stats", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.State != ruleActive || stats.Destinations[0].Packets != 5 {
+		t.Errorf("Expected an active rule with 5 packets, got %+v", stats)
+	}
+	if len(stats.Filters) != 1 || stats.Filters[0] != (filterDestStats{Filter: "1", Action: "mirred", Dst: "eth1", Packets: 5, Bytes: 500}) {
+		t.Errorf("Expected the counters of filter 1, got %+v", stats.Filters)
+	}
+
+	if rec := apiRequest(h, "GET", "/rules/ssh/stats", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown rule, got %d", rec.Code)
+	}
+}
+
+func TestAPIHealth(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	rec := apiRequest(d.handler(), "GET", "/health", "")
+	expected := `{"status":"ok","active":false,"rules":2,"pending":0}`
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != expected {
+		t.Errorf("Expected %s, got %d: %s", expected, rec.Code, rec.Body)
+	}
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	rec := apiRequest(d.handler(), "GET", "/openapi.yaml", "")
+	var spec struct {
+		Paths map[string]map[string]any `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Failed to parse the spec: %v", err)
+	}
+
+	routes := []string{
+		"GET /health", "GET /rules", "POST /rules", "GET /rules/{name}", "DELETE /rules", "DELETE /rules/{name}",
+		"GET /rules/{name}/stats", "GET /status", "POST /start", "POST /stop", "POST /reload", "GET /openapi.yaml",
+	}
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("Expected the spec to describe %s", route)
+		}
+	}
+}
+
+// writeCert writes a certificate for template, signed by parent and its key
+// or self-signed if parent is nil, and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestAPIRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "tcbroker test CA"}, NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "tcbroker"}, NotAfter: notAfter,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "operator"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "stranger", &x509.Certificate{
+		SerialNumber: big.NewInt(4), Subject: pkix.Name{CommonName: "stranger"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil, nil)
+
+	tlsConfig, err := apiTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("apiTLSConfig failed: %v", err)
+	}
+	listener, err := listenAPI("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("listenAPI failed: %v", err)
+	}
+	d, _, _ := serveDaemon(t, daemonConfig)
+	server := &http.Server{Handler: d.apiHandler(), ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certName string) (*http.Response, error) {
+		config := &tls.Config{RootCAs: roots}
+		if certName != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certName+".crt"), filepath.Join(dir, certName+".key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: config}}
+		return client.Get("https://" + listener.Addr().String() + "/health")
+	}
+
+	for _, certName := range []string{"", "stranger"} {
+		if resp, err := get(certName); err == nil {
+			resp.Body.Close()
+			t.Errorf("Expected a client with certificate %q to be refused, got %s", certName, resp.Status)
+		}
+	}
+	resp, err := get("client")
+	if err != nil {
+		t.Fatalf("Expected the client certificate to be accepted: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %s", resp.Status)
+	}
+}
+
+func TestAPIHandlerServesOnlyRules(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	if _, err := d.start(); err != nil {
+		t.Fatal(err)
+	}
+	h := d.apiHandler()
+	for _, path := range []string{"/start", "/stop", "/reload"} {
+		if rec := apiRequest(h, "POST", path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected POST %s not to be served on the network, got %d", path, rec.Code)
+		}
+	}
+	if rec := apiRequest(h, "GET", "/rules", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the rules to be served, got %d", rec.Code)
+	}
+	if !d.status().Active {
+		t.Error("Expected mirroring to stay active")
+	}
+}
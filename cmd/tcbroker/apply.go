@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply [config-file]",
+	Short: "Reconciles the installed tc rules with a config file.",
+	Long: `Reads the given YAML configuration file, compares it with the filters
+tcbroker has already installed, and adds only the missing filters and removes
+only the stale ones. Running apply again on an up-to-date host changes nothing.
+This command requires root privileges.`,
+	Args: cobra.ExactArgs(1),
+	Run:  apply,
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print tc commands")
+	applyCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry-run mode to print tc commands without executing them")
+	applyCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to program tc: exec (tc binary) or netlink")
+}
+
+func apply(cmd *cobra.Command, args []string) {
+	configFile := args[0]
+
+	// In dry-run mode, we don't need root privileges
+	if !dryRun && os.Geteuid() != 0 {
+		fmt.Println("Error: this command requires root privileges.")
+		os.Exit(1)
+	}
+
+	// Load and validate the configuration
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+	printWarnings(cfg)
+
+	// The live state is always read, even in dry-run mode, so the printed
+	// commands are the ones apply would really run
+	reader, err := tc.NewBackend(backendName, debug, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	runner, err := tc.NewBackend(backendName, debug, dryRun)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	plan, err := reconcile(reader, runner, cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !debug && !dryRun {
+		if !plan.HasChanges() {
+			fmt.Println("No changes")
+			return
+		}
+		fmt.Printf("Applied: %d added, %d removed, %d unchanged\n",
+			plan.Count(tc.PlanAdd), plan.Count(tc.PlanRemove), plan.Count(tc.PlanKeep))
+	}
+}
+
+// reconcile computes the plan from the live state seen by reader and applies
+// it through runner.
+func reconcile(reader, runner tc.Backend, cfg *config.Config) (*tc.Plan, error) {
+	plan, err := tc.ComputePlan(reader, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := tc.ApplyPlan(runner, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// configSettleTime is how long the config file must be left alone after a
+// change before it is read, so a file written in several steps is read once.
+const configSettleTime = 250 * time.Millisecond
+
+// watchConfigFile calls onChange after the file at path was written,
+// replaced or removed, until ctx is done. It watches the directory, which
+// also catches editors that rename a new file over the old one and the
+// symlink swaps of Kubernetes ConfigMaps ("..data").
+func watchConfigFile(ctx context.Context, path string, onChange func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	dir, base := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	// The non-blocking descriptor is read through the runtime poller, so
+	// closing the file ends a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		var timer *time.Timer
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if !configEventMatches(buf[:n], base) {
+				continue
+			}
+			if timer == nil {
+				timer = time.AfterFunc(configSettleTime, onChange)
+			} else {
+				timer.Reset(configSettleTime)
+			}
+		}
+	}()
+	return nil
+}
+
+// configEventMatches reports whether a buffer of inotify events names the
+// config file or a ConfigMap's hidden entries.
+func configEventMatches(buf []byte, base string) bool {
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		start := off + syscall.SizeofInotifyEvent
+		end := start + int(event.Len)
+		if end > len(buf) {
+			return false
+		}
+		name := strings.TrimRight(string(buf[start:end]), "\x00")
+		if name == base || strings.HasPrefix(name, "..") {
+			return true
+		}
+		off = end
+	}
+	return false
+}
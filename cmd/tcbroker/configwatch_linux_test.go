@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("rules: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	if err := watchConfigFile(ctx, path, func() { changed <- struct{}{} }); err != nil {
+		t.Fatalf("watchConfigFile failed: %v", err)
+	}
+	expect := func(what string, want bool) {
+		t.Helper()
+		select {
+		case <-changed:
+			if !want {
+				t.Errorf("Expected no change for %s", what)
+			}
+		case <-time.After(4 * configSettleTime):
+			if want {
+				t.Errorf("Expected a change for %s", what)
+			}
+		}
+	}
+
+	// Several writes in a row are reported once
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte("rules: [] # edited\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("a written file", true)
+	expect("the writes already reported", false)
+
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("another file", false)
+
+	// Editors save by renaming a new file over the old one
+	tmp := filepath.Join(dir, ".config.yaml.tmp")
+	if err := os.WriteFile(tmp, []byte("rules: [] # renamed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expect("a renamed file", true)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchConfigFile reports that watching the config file is unsupported on
+// this platform; SIGHUP still reloads it.
+func watchConfigFile(ctx context.Context, path string, onChange func()) error {
+	return errors.New("watching the config file is only supported on linux")
+}
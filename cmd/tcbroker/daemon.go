@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+// defaultSocketPath is where the daemon serves its control API.
+const defaultSocketPath = "/run/tcbroker.sock"
+
+var (
+	daemonSocket        string
+	daemonWatchInterval time.Duration
+	daemonWatchConfig   bool
+	daemonAPIListen     string
+	daemonTLSCert       string
+	daemonTLSKey        string
+	daemonTLSClientCA   string
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon [config-file]",
+	Short: "Runs tcbroker in the background with a local control API.",
+	Long: `Loads the given YAML configuration file, applies it, and keeps running with
+the configuration in memory. status, start, stop and reload talk to the
+daemon over a Unix socket when given --socket, so they neither re-read the
+file nor query tc themselves. Rules whose source or destination interfaces
+do not exist yet are pending and installed as soon as the interfaces appear;
+a rule whose interface goes away is pending again. SIGHUP, or with
+--watch-config any change of the file, reloads the configuration as reload
+does. Every --watch-interval the daemon checks the
+host for drift from the configuration, as watch does, and with --heal
+repairs it.
+
+The API also lists, adds and removes rules, saving the changes to the
+config file. With --api-listen these rules endpoints, without start, stop
+and reload, are also served over HTTPS on a TCP address; clients must
+present a certificate signed by --tls-client-ca. The OpenAPI description is
+served on /openapi.yaml.
+
+The filters stay installed when the daemon exits; use stop first to remove
+them. This command requires root privileges.`,
+	Args: cobra.ExactArgs(1),
+	Run:  daemonRun,
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print tc commands")
+	daemonCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to program tc: exec (tc binary) or netlink")
+	daemonCmd.Flags().StringVar(&daemonSocket, "socket", defaultSocketPath, "Unix socket to serve the control API on")
+	daemonCmd.Flags().DurationVar(&daemonWatchInterval, "watch-interval", 30*time.Second, "Time between drift checks (0 disables them)")
+	daemonCmd.Flags().BoolVar(&watchHeal, "heal", false, "Reinstall missing qdiscs and filters and remove stale ones on drift")
+	daemonCmd.Flags().BoolVar(&daemonWatchConfig, "watch-config", true, "Reload the config file when it changes")
+	daemonCmd.Flags().StringVar(&daemonAPIListen, "api-listen", "", "TCP address to serve the API on over HTTPS, e.g. :8443")
+	daemonCmd.Flags().StringVar(&daemonTLSCert, "tls-cert", "", "Server certificate of the HTTPS API (PEM)")
+	daemonCmd.Flags().StringVar(&daemonTLSKey, "tls-key", "", "Private key of the server certificate (PEM)")
+	daemonCmd.Flags().StringVar(&daemonTLSClientCA, "tls-client-ca", "", "CA certificates client certificates must be signed by (PEM)")
+}
+
+func daemonRun(cmd *cobra.Command, args []string) {
+	if os.Geteuid() != 0 {
+		fmt.Println("Error: this command requires root privileges.")
+		os.Exit(1)
+	}
+
+	var tlsConfig *tls.Config
+	if daemonAPIListen != "" {
+		if daemonTLSCert == "" || daemonTLSKey == "" || daemonTLSClientCA == "" {
+			fmt.Println("Error: --api-listen requires --tls-cert, --tls-key and --tls-client-ca.")
+			os.Exit(1)
+		}
+		var err error
+		if tlsConfig, err = apiTLSConfig(daemonTLSCert, daemonTLSKey, daemonTLSClientCA); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	backend, err := tc.NewBackend(backendName, debug, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	d, err := newDaemon(args[0], backend)
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+	d.heal = watchHeal
+	printWarnings(d.cfg)
+	if _, err := d.start(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := listenUnix(daemonSocket)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	server := &http.Server{Handler: d.handler(), ReadHeaderTimeout: 10 * time.Second}
+	apiServer := &http.Server{Handler: d.apiHandler(), ReadHeaderTimeout: 10 * time.Second}
+	var apiListener net.Listener
+	if tlsConfig != nil {
+		if apiListener, err = listenAPI(daemonAPIListen, tlsConfig); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		apiServer.Shutdown(shutdownCtx)
+		server.Shutdown(shutdownCtx)
+	}()
+	if daemonWatchInterval > 0 {
+		go d.watch(ctx, daemonWatchInterval)
+	}
+	if err := d.watchLinks(ctx); err != nil {
+		d.logger.Printf("Not watching interfaces: %v", err)
+	}
+	if daemonWatchConfig {
+		if err := watchConfigFile(ctx, d.configFile, d.configChanged); err != nil {
+			d.logger.Printf("Not watching %s: %v", d.configFile, err)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			d.logger.Printf("SIGHUP received, reloading %s", d.configFile)
+			d.logReload(d.reload())
+		}
+	}()
+
+	if apiListener != nil {
+		d.logger.Printf("Serving the API on https://%s", apiListener.Addr())
+		go func() {
+			if err := apiServer.Serve(apiListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	d.logger.Printf("Serving on %s", daemonSocket)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// listenUnix listens on a Unix socket only its owner can use. A socket file
+// left behind by a daemon that is no longer running is replaced. The socket
+// is created under a umask that leaves it 0600, so no other user can connect
+// before its mode could be changed.
+func listenUnix(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already serving on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// daemon owns the configuration and the tc state it describes. Its methods
+// are serialized, so API requests never interleave tc changes.
+type daemon struct {
+	mu         sync.Mutex
+	configFile string
+	cfg        *config.Config
+	backend    tc.Backend
+	active     bool // whether the configuration is applied
+	heal       bool // whether drift is repaired
+	drift      driftStats
+	logger     *log.Logger
+
+	// linkExists reports whether an interface exists; rules with a missing
+	// interface are pending, by name with the interfaces they wait for.
+	// subscribeLinks delivers the link events that may change this.
+	linkExists     func(string) bool
+	pending        map[string][]string
+	subscribeLinks func(context.Context) (<-chan tc.LinkEvent, error)
+
+	// configSum is the checksum of the config file as last read, valid or
+	// not, so only real changes of the file are reloaded. loadedSum is that
+	// of the file cfg was loaded from, which the rules API edits.
+	configSum [sha256.Size]byte
+	loadedSum [sha256.Size]byte
+}
+
+// newDaemon loads configFile for a daemon that programs tc through backend.
+func newDaemon(configFile string, backend tc.Backend) (*daemon, error) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileSum(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return &daemon{
+		configSum:      sum,
+		loadedSum:      sum,
+		configFile:     configFile,
+		cfg:            cfg,
+		backend:        backend,
+		logger:         log.New(os.Stdout, "", log.LstdFlags),
+		linkExists:     interfaceExists,
+		pending:        make(map[string][]string),
+		subscribeLinks: tc.WatchLinks,
+	}, nil
+}
+
+// planResult summarizes the changes a start or reload made.
+type planResult struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+}
+
+func newPlanResult(plan *tc.Plan) planResult {
+	return planResult{plan.Count(tc.PlanAdd), plan.Count(tc.PlanRemove), plan.Count(tc.PlanKeep)}
+}
+
+// start applies the configuration, changing only what differs from the
+// installed filters.
+func (d *daemon) start() (planResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	plan, err := d.apply(d.cfg)
+	if err != nil {
+		return planResult{}, err
+	}
+	d.active = true
+	return newPlanResult(plan), nil
+}
+
+// stop removes the filters of the configuration from the interfaces that
+// exist.
+func (d *daemon) stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := tc.Cleanup(d.backend, idleInterfaces(&config.Config{}, d.linkExists, d.cfg)); err != nil {
+		return fmt.Errorf("cleanup failed: %w", err)
+	}
+	d.active = false
+	return nil
+}
+
+// reload re-reads the configuration file and, while the configuration is
+// applied, applies the new one. An invalid file leaves the running
+// configuration in place.
+func (d *daemon) reload() (planResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(d.configFile)
+	if err != nil {
+		return planResult{}, &configError{fmt.Errorf("failed to read config file %s: %w", d.configFile, err)}
+	}
+	d.configSum = sha256.Sum256(data)
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return planResult{}, &configError{err}
+	}
+	result, err := d.replaceConfig(cfg)
+	if err != nil {
+		return planResult{}, err
+	}
+	d.loadedSum = d.configSum
+	return result, nil
+}
+
+// apply makes the host match cfg and makes it the daemon's configuration.
+// The rules whose interfaces all exist are reconciled and the others are
+// pending until their interfaces appear. Interfaces that no installed rule
+// uses any more, in cfg or the previous configuration, are cleaned up.
+// The caller holds d.mu.
+func (d *daemon) apply(cfg *config.Config) (*tc.Plan, error) {
+	ready, pending := readyRules(cfg, d.linkExists)
+	plan, err := reconcile(d.backend, d.backend, ready)
+	if err != nil {
+		return nil, err
+	}
+	if err := tc.Cleanup(d.backend, idleInterfaces(ready, d.linkExists, d.cfg, cfg)); err != nil {
+		return nil, fmt.Errorf("cleanup failed: %w", err)
+	}
+	d.cfg, d.pending = cfg, pending
+	return plan, nil
+}
+
+// configChanged reloads the configuration when the content of the config
+// file changed since it was last read.
+func (d *daemon) configChanged() {
+	sum, err := fileSum(d.configFile)
+	if err != nil {
+		// Removed, or not replaced yet; the next change will tell
+		return
+	}
+	d.mu.Lock()
+	unchanged := sum == d.configSum
+	d.mu.Unlock()
+	if unchanged {
+		return
+	}
+	d.logger.Printf("%s changed, reloading", d.configFile)
+	d.logReload(d.reload())
+}
+
+// logReload logs the outcome of a reload the daemon started on its own.
+func (d *daemon) logReload(result planResult, err error) {
+	if err != nil {
+		d.logger.Printf("Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+	d.logger.Printf("Reloaded: %d added, %d removed, %d unchanged", result.Added, result.Removed, result.Unchanged)
+}
+
+// fileSum returns the SHA-256 checksum of the file at path.
+func fileSum(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// configError is returned by reload when the configuration file is invalid.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("invalid config file: %v", e.err)
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// daemonStatus is the state the daemon reports on GET /status.
+type daemonStatus struct {
+	ConfigFile string            `json:"config_file"`
+	Active     bool              `json:"active"`
+	Drift      driftStats        `json:"drift"`
+	Interfaces []interfaceStatus `json:"interfaces"`
+	Rules      []ruleStatus      `json:"rules"`
+}
+
+// interfaceStatus tells whether a source interface has a clsact qdisc.
+type interfaceStatus struct {
+	Name    string `json:"name"`
+	Missing bool   `json:"missing,omitempty"`
+	Clsact  bool   `json:"clsact"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ruleStatus holds the state of a rule and its counters per destination
+// interface. A pending rule lists the interfaces it waits for.
+type ruleStatus struct {
+	Name         string      `json:"name"`
+	SrcIntf      string      `json:"src_intf"`
+	Priority     int         `json:"priority"`
+	State        string      `json:"state"`
+	Waiting      []string    `json:"waiting,omitempty"`
+	Destinations []destStats `json:"destinations"`
+}
+
+// status reports the configuration and its counters.
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := daemonStatus{ConfigFile: d.configFile, Active: d.active, Drift: d.drift, Interfaces: []interfaceStatus{}, Rules: []ruleStatus{}}
+	seen := make(map[string]bool)
+	for _, rule := range d.cfg.Rules {
+		if seen[rule.SrcIntf] {
+			continue
+		}
+		seen[rule.SrcIntf] = true
+		is := interfaceStatus{Name: rule.SrcIntf}
+		if !d.linkExists(rule.SrcIntf) {
+			is.Missing = true
+		} else if hasClsact, err := d.backend.HasClsactQdisc(rule.SrcIntf); err != nil {
+			is.Error = err.Error()
+		} else {
+			is.Clsact = hasClsact
+		}
+		st.Interfaces = append(st.Interfaces, is)
+	}
+	priorities := d.cfg.Priorities()
+	for i, rule := range d.cfg.Rules {
+		rs := ruleStatus{Name: rule.Name, SrcIntf: rule.SrcIntf, Priority: priorities[i]}
+		rs.State, rs.Waiting = d.ruleState(rule.Name)
+		if d.linkExists(rule.SrcIntf) {
+			rs.Destinations = getRuleStats(d.backend, rule, priorities[i])
+		} else {
+			for _, dst := range rule.DstIntf {
+				rs.Destinations = append(rs.Destinations, destStats{Intf: dst})
+			}
+		}
+		st.Rules = append(st.Rules, rs)
+	}
+	return st
+}
+
+// handler serves the control API:
+//
+//	GET  /status  the configuration and its counters
+//	POST /start   apply the configuration
+//	POST /stop    remove its filters
+//	POST /reload  re-read the configuration file and apply it
+//
+// and the rules API of registerRules. Failures are answered with
+// {"error": "..."}.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.HandleFunc("POST /start", func(w http.ResponseWriter, r *http.Request) {
+		result, err := d.start()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	mux.HandleFunc("POST /stop", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.stop(); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		result, err := d.reload()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+	d.registerRules(mux)
+	return mux
+}
+
+// apiError is the body of a failed request.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with err: the code of a requestError, 400 for an
+// invalid configuration, 500 for anything else.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var reqErr *requestError
+	var cfgErr *configError
+	switch {
+	case errors.As(err, &reqErr):
+		code = reqErr.code
+	case errors.As(err, &cfgErr):
+		code = http.StatusBadRequest
+	}
+	writeJSON(w, code, apiError{Error: err.Error()})
+}
+
+// callDaemon sends a request to the daemon listening on socket and decodes
+// the response into out, unless out is nil.
+func callDaemon(socket, method, path string, out any) error {
+	client := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://tcbroker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the daemon's response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("daemon answered %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// printDaemonStatus writes the status reported by the daemon, with one line
+// of counters per rule and destination interface as status --summary does.
+func printDaemonStatus(w io.Writer, st daemonStatus) {
+	state := "stopped"
+	if st.Active {
+		state = "active"
+	}
+	fmt.Fprintf(w, "Config: %s (%s)\n", st.ConfigFile, state)
+	fmt.Fprintf(w, "Drift: %d event(s) in %d check(s), %d healed\n", st.Drift.Events, st.Drift.Checks, st.Drift.Healed)
+	if !st.Drift.LastDrift.IsZero() {
+		fmt.Fprintf(w, "Last drift: %s\n", st.Drift.LastDrift.Format(time.RFC3339))
+	}
+	if st.Drift.LastError != "" {
+		fmt.Fprintf(w, "Last error: %s\n", st.Drift.LastError)
+	}
+	fmt.Fprintln(w)
+	for _, is := range st.Interfaces {
+		switch {
+		case is.Missing:
+			fmt.Fprintf(w, "  %-20s  Not present (rules wait for it to appear)\n", is.Name)
+		case is.Error != "":
+			fmt.Fprintf(w, "  %-20s  Error checking qdisc: %s\n", is.Name, is.Error)
+		case is.Clsact:
+			fmt.Fprintf(w, "  %-20s  Active (clsact qdisc present)\n", is.Name)
+		default:
+			fmt.Fprintf(w, "  %-20s  No clsact qdisc found (mirroring not active)\n", is.Name)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-30s  %-8s  %-20s  %-20s  %10s  %s\n", "Name", "State", "SrcIntf", "DstIntf", "Packets", "Bytes")
+	for _, rule := range st.Rules {
+		for _, dst := range rule.Destinations {
+			fmt.Fprintf(w, "%-30s  %-8s  %-20s  %-20s  %10d  %s\n", rule.Name, rule.State, rule.SrcIntf, dst.Intf, dst.Packets, tc.FormatBytes(dst.Bytes))
+		}
+	}
+	for _, rule := range st.Rules {
+		if len(rule.Waiting) > 0 {
+			fmt.Fprintf(w, "\nRule '%s' is waiting for %s\n", rule.Name, strings.Join(rule.Waiting, ", "))
+		}
+	}
+}
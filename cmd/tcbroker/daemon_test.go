@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/tc"
+)
+
+const daemonConfig = `rules:
+  - name: web
+    src_intf: eth0
+    dst_intf: eth1
+    filters:
+      - ip_proto: tcp
+        dst_port: 80
+  - name: dns
+    src_intf: eth2
+    dst_intf: eth1
+    filters:
+      - ip_proto: udp
+        dst_port: 53
+`
+
+// serveDaemon starts a daemon for the config on a Unix socket and returns
+// the daemon, its fake backend and the socket path.
+func serveDaemon(t *testing.T, config string) (*daemon, *tc.FakeBackend, string) {
+	t.Helper()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := tc.NewFakeBackend()
+	d, err := newDaemon(configFile, backend)
+	if err != nil {
+		t.Fatalf("newDaemon failed: %v", err)
+	}
+	d.linkExists = func(string) bool { return true }
+
+	socket := filepath.Join(dir, "tcbroker.sock")
+	listener, err := listenUnix(socket)
+	if err != nil {
+		t.Fatalf("listenUnix failed: %v", err)
+	}
+	server := &http.Server{Handler: d.handler()}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return d, backend, socket
+}
+
+func TestDaemonStartStatusStop(t *testing.T) {
+	_, backend, socket := serveDaemon(t, daemonConfig)
+
+	var result planResult
+	if err := callDaemon(socket, "POST", "/start", &result); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if result.Added != 2 {
+		t.Errorf("Expected 2 filters added, got %+v", result)
+	}
+	backend.Count("eth0", "ingress", 0, 5, 500)
+
+	var st daemonStatus
+	if err := callDaemon(socket, "GET", "/status", &st); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if !st.Active || len(st.Interfaces) != 2 || !st.Interfaces[0].Clsact {
+		t.Errorf("Expected an active config on two interfaces, got %+v", st)
+	}
+	if len(st.Rules) != 2 || st.Rules[0].Destinations[0].Packets != 5 {
+		t.Errorf("Expected web to have counted 5 packets, got %+v", st.Rules)
+	}
+
+	var out strings.Builder
+	printDaemonStatus(&out, st)
+	if want := "web                             active    eth0                  eth1                           5  500 B"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected status to contain %q, got:\n%s", want, out.String())
+	}
+
+	// A second start changes nothing
+	if err := callDaemon(socket, "POST", "/start", &result); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if result.Added != 0 || result.Unchanged != 2 {
+		t.Errorf("Expected an idempotent start, got %+v", result)
+	}
+
+	if err := callDaemon(socket, "POST", "/stop", nil); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if len(backend.Qdiscs) != 0 {
+		t.Errorf("Expected stop to remove the qdiscs, got %v", backend.Qdiscs)
+	}
+	if err := callDaemon(socket, "GET", "/status", &st); err != nil || st.Active {
+		t.Errorf("Expected a stopped daemon, got %+v, %v", st, err)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	d, backend, socket := serveDaemon(t, daemonConfig)
+	if _, err := d.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	// An invalid file is rejected and the running config kept
+	if err := os.WriteFile(d.configFile, []byte("rules: [{name: broken}]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := callDaemon(socket, "POST", "/reload", nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid config file") {
+		t.Errorf("Expected the invalid config to be reported, got %v", err)
+	}
+	if len(d.cfg.Rules) != 2 {
+		t.Errorf("Expected the running config to be kept, got %d rules", len(d.cfg.Rules))
+	}
+
+	// Dropping dns removes its filters and eth2's qdisc; web is kept
+	web := daemonConfig[:strings.Index(daemonConfig, "  - name: dns")]
+	if err := os.WriteFile(d.configFile, []byte(web), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var result planResult
+	if err := callDaemon(socket, "POST", "/reload", &result); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if result.Added != 0 || result.Unchanged != 1 {
+		t.Errorf("Expected web to be kept, got %+v", result)
+	}
+	if len(backend.Filters[tc.FakeKey("eth2", "ingress")]) != 0 || backend.Qdiscs["eth2"] {
+		t.Errorf("Expected dns to be removed from eth2, got %v", backend.Filters)
+	}
+}
+
+func TestListenUnixRestrictsSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tcbroker.sock")
+	listener, err := listenUnix(socket)
+	if err != nil {
+		t.Fatalf("listenUnix failed: %v", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected the socket to be created with mode 0600, got %o", mode)
+	}
+}
+
+func TestListenUnixRefusesRunningDaemon(t *testing.T) {
+	_, _, socket := serveDaemon(t, daemonConfig)
+	if _, err := listenUnix(socket); err == nil || !strings.Contains(err.Error(), "already serving") {
+		t.Errorf("Expected a second daemon to be refused, got %v", err)
+	}
+}
+
+func TestDaemonReloadsChangedConfig(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	var logs bytes.Buffer
+	d.logger = log.New(&logs, "", 0)
+	if _, err := d.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	// Touching the file without changing it does nothing
+	d.configChanged()
+	if logs.Len() != 0 {
+		t.Errorf("Expected an unchanged file to be ignored, got:\n%s", logs.String())
+	}
+
+	// An invalid file is logged once and the rules stay installed
+	if err := os.WriteFile(d.configFile, []byte("rules: [{name: broken}]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.configChanged()
+	d.configChanged()
+	if got := strings.Count(logs.String(), "Reload failed, keeping the running configuration"); got != 1 {
+		t.Errorf("Expected the invalid file to be reported once, got:\n%s", logs.String())
+	}
+	if len(backend.Filters[tc.FakeKey("eth2", "ingress")]) != 1 {
+		t.Errorf("Expected dns to stay installed, got %v", backend.Filters)
+	}
+
+	// Changing dns's port replaces only its filter
+	fixed := strings.Replace(daemonConfig, "dst_port: 53", "dst_port: 5353", 1)
+	if err := os.WriteFile(d.configFile, []byte(fixed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs.Reset()
+	d.configChanged()
+	if !strings.Contains(logs.String(), "Reloaded: 1 added, 1 removed, 1 unchanged") {
+		t.Errorf("Expected only dns to change, got:\n%s", logs.String())
+	}
+}
+
+func TestReloadDefaultsToDaemonSocket(t *testing.T) {
+	// start, stop and status register --socket with an empty default; it
+	// must not replace the default of reload
+	var socket string
+	run := reloadCmd.Run
+	reloadCmd.Run = func(cmd *cobra.Command, args []string) { socket = reloadSocket }
+	t.Cleanup(func() {
+		reloadCmd.Run = run
+		rootCmd.SetArgs(nil)
+	})
+
+	rootCmd.SetArgs([]string{"reload"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if socket != defaultSocketPath {
+		t.Errorf("Expected reload to use %s, got %q", defaultSocketPath, socket)
+	}
+}
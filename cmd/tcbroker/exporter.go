@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+var exporterListen string
+
+var exporterCmd = &cobra.Command{
+	Use:   "exporter [config-file]",
+	Short: "Serves mirroring counters as Prometheus metrics.",
+	Long: `Serves /metrics in the Prometheus text format with the packet, byte, drop
+and overlimit counters of every filter of the rules in the given YAML
+configuration file, labelled by rule, source and destination interface,
+filter and action, and whether each source interface has a clsact qdisc.
+Drops and overlimits of the other actions of a filter, such as police or
+pedit, are reported without a destination interface.
+
+tc is queried on every scrape.`,
+	Args: cobra.ExactArgs(1),
+	Run:  exporter,
+}
+
+func init() {
+	rootCmd.AddCommand(exporterCmd)
+	exporterCmd.Flags().StringVar(&exporterListen, "listen", ":9469", "Address to serve metrics on")
+	exporterCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to query tc: exec (tc binary) or netlink")
+}
+
+func exporter(cmd *cobra.Command, args []string) {
+	cfg, err := config.Load(args[0])
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+
+	backend, err := tc.NewBackend(backendName, false, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(backend, cfg, interfaceExists))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `<html><body><a href="/metrics">Metrics</a></body></html>`)
+	})
+	server := &http.Server{Addr: exporterListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving metrics on %s/metrics\n", exporterListen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// metricsHandler serves the metrics of cfg, querying backend on every
+// request.
+func metricsHandler(backend tc.Backend, cfg *config.Config, linkExists func(string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		writeMetrics(&buf, backend, cfg, linkExists)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// filterDestStats holds the counters of the mirred actions of one filter of
+// a rule towards one destination interface, or of its other actions of one
+// type, which have no destination.
+type filterDestStats struct {
+	Filter     string `json:"filter"` // number of the filter in the rule, from 1
+	Action     string `json:"action"` // mirred, police, pedit, ...
+	Dst        string `json:"dst_intf,omitempty"`
+	Packets    int64  `json:"packets"`
+	Bytes      int64  `json:"bytes"`
+	Dropped    int64  `json:"dropped"`
+	Overlimits int64  `json:"overlimits"`
+}
+
+// getFilterDestStats retrieves the counters of a rule per filter and
+// destination interface, in config order, followed by those of the other
+// actions of its filters as they are found. Filters installed without
+// cookies are attributed by the rule's block of preferences to a filter
+// "unknown". The gact actions of exclusions only pass and are left out.
+func getFilterDestStats(backend tc.Backend, rule config.Rule, priority int) ([]filterDestStats, error) {
+	var stats []filterDestStats
+	index := make(map[string]int)
+	filters := map[string]string{"": "unknown"}
+	for i := range rule.Filters {
+		cookie := tc.FilterCookie(rule.Name, i)
+		filters[cookie] = strconv.Itoa(i + 1)
+		for _, dst := range rule.DstIntf {
+			index[cookie+"/"+dst] = len(stats)
+			stats = append(stats, filterDestStats{Filter: filters[cookie], Action: "mirred", Dst: dst})
+		}
+	}
+
+	for _, hook := range rule.Hooks() {
+		tcFilters, err := backend.ListFilterStats(rule.SrcIntf, hook)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s filters of %s: %w", hook, rule.SrcIntf, err)
+		}
+		for _, tcFilter := range tcFilters {
+			cookie := tcFilter.Cookie()
+			if cookie == "" {
+				if tc.RulePriority(tcFilter.Priority) != priority {
+					continue
+				}
+			} else if _, ok := filters[cookie]; !ok {
+				continue
+			}
+			for _, action := range tcFilter.Actions {
+				var key string
+				switch action.Type {
+				case "gact":
+					continue
+				case "mirred":
+					key = cookie + "/" + action.TargetDev
+				default:
+					key = cookie + "/" + action.Type + "/"
+				}
+				i, ok := index[key]
+				if !ok {
+					if cookie != "" && action.Type == "mirred" {
+						continue
+					}
+					i = len(stats)
+					index[key] = i
+					s := filterDestStats{Filter: filters[cookie], Action: action.Type}
+					if action.Type == "mirred" {
+						s.Dst = action.TargetDev
+					}
+					stats = append(stats, s)
+				}
+				stats[i].Packets += action.Packets
+				stats[i].Bytes += action.Bytes
+				stats[i].Dropped += action.Dropped
+				stats[i].Overlimits += action.Overlimits
+			}
+		}
+	}
+	return stats, nil
+}
+
+// metricFamily is a metric in the Prometheus text format with its samples.
+type metricFamily struct {
+	name, help, kind string
+	samples          []string
+}
+
+// add appends a sample with labels given as name and value pairs.
+func (m *metricFamily) add(value int64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) == 0 {
+		m.samples = append(m.samples, fmt.Sprintf("%s %d", m.name, value))
+		return
+	}
+	m.samples = append(m.samples, fmt.Sprintf("%s{%s} %d", m.name, strings.Join(pairs, ","), value))
+}
+
+// labelEscaper escapes label values the way the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the counters of every rule of cfg, and whether each
+// source interface has a clsact qdisc, in the Prometheus text format. A
+// source interface linkExists does not know has none, and its rules have no
+// counters.
+func writeMetrics(w io.Writer, backend tc.Backend, cfg *config.Config, linkExists func(string) bool) {
+	packets := &metricFamily{name: "tcbroker_packets_total", kind: "counter", help: "Packets mirrored by a filter of a rule to a destination interface."}
+	byteCount := &metricFamily{name: "tcbroker_bytes_total", kind: "counter", help: "Bytes mirrored by a filter of a rule to a destination interface."}
+	drops := &metricFamily{name: "tcbroker_drops_total", kind: "counter", help: "Packets dropped by an action of a filter of a rule."}
+	overlimits := &metricFamily{name: "tcbroker_overlimits_total", kind: "counter", help: "Overlimits of an action of a filter of a rule."}
+	clsact := &metricFamily{name: "tcbroker_clsact_qdisc_present", kind: "gauge", help: "Whether the interface has a clsact qdisc (1) or not (0)."}
+	errs := &metricFamily{name: "tcbroker_scrape_errors", kind: "gauge", help: "Number of tc queries that failed during this scrape."}
+
+	failed := 0
+	seen := make(map[string]bool)
+	for _, rule := range cfg.Rules {
+		if seen[rule.SrcIntf] {
+			continue
+		}
+		seen[rule.SrcIntf] = true
+		if !linkExists(rule.SrcIntf) {
+			clsact.add(0, "intf", rule.SrcIntf)
+			continue
+		}
+		present, err := backend.HasClsactQdisc(rule.SrcIntf)
+		if err != nil {
+			failed++
+			continue
+		}
+		value := int64(0)
+		if present {
+			value = 1
+		}
+		clsact.add(value, "intf", rule.SrcIntf)
+	}
+
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		if !linkExists(rule.SrcIntf) {
+			continue
+		}
+		stats, err := getFilterDestStats(backend, rule, priorities[i])
+		if err != nil {
+			failed++
+			continue
+		}
+		for _, s := range stats {
+			labels := []string{"rule", rule.Name, "src_intf", rule.SrcIntf, "dst_intf", s.Dst, "filter", s.Filter, "action", s.Action}
+			// The other actions see the packets the mirred actions count
+			if s.Action == "mirred" {
+				packets.add(s.Packets, labels...)
+				byteCount.add(s.Bytes, labels...)
+			}
+			drops.add(s.Dropped, labels...)
+			overlimits.add(s.Overlimits, labels...)
+		}
+	}
+	errs.add(int64(failed))
+
+	for _, m := range []*metricFamily{packets, byteCount, drops, overlimits, clsact, errs} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range m.samples {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
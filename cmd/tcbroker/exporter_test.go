@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+	"tcbroker/pkg/tc"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "web", SrcIntf: "eth0", DstIntf: config.Interfaces{"ids0", "rec0"}, Filters: []filter.Filter{
+				{IPProto: "tcp", DstPort: filter.Port(80)},
+				{IPProto: "tcp", DstPort: filter.Port(443)},
+			}},
+			{Name: "dns", SrcIntf: "eth1", DstIntf: config.Interfaces{"rec0"}, Filters: []filter.Filter{
+				{IPProto: "udp", DstPort: filter.Port(53)},
+			}},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	backend.Count("eth0", "ingress", 1, 7, 700)
+	filters := backend.Filters[tc.FakeKey("eth0", "ingress")]
+	filters[1].Actions[1].Dropped, filters[1].Actions[1].Overlimits = 2, 3
+	filters[1].Actions = append(filters[1].Actions, tc.ActionStats{Type: "police", Packets: 7, Dropped: 4, Overlimits: 4})
+	if err := backend.DeleteClsactQdisc("eth1"); err != nil {
+		t.Fatalf("DeleteClsactQdisc failed: %v", err)
+	}
+
+	server := httptest.NewServer(metricsHandler(backend, cfg, func(string) bool { return true }))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %s", ct)
+	}
+
+	for _, want := range []string{
+		"# TYPE tcbroker_packets_total counter\n",
+		`tcbroker_packets_total{rule="web",src_intf="eth0",dst_intf="ids0",filter="1",action="mirred"} 0` + "\n",
+		`tcbroker_packets_total{rule="web",src_intf="eth0",dst_intf="ids0",filter="2",action="mirred"} 7` + "\n",
+		`tcbroker_bytes_total{rule="web",src_intf="eth0",dst_intf="rec0",filter="2",action="mirred"} 700` + "\n",
+		`tcbroker_drops_total{rule="web",src_intf="eth0",dst_intf="rec0",filter="2",action="mirred"} 2` + "\n",
+		`tcbroker_overlimits_total{rule="web",src_intf="eth0",dst_intf="rec0",filter="2",action="mirred"} 3` + "\n",
+		`tcbroker_drops_total{rule="web",src_intf="eth0",dst_intf="",filter="2",action="police"} 4` + "\n",
+		`tcbroker_overlimits_total{rule="web",src_intf="eth0",dst_intf="",filter="2",action="police"} 4` + "\n",
+		`tcbroker_packets_total{rule="dns",src_intf="eth1",dst_intf="rec0",filter="1",action="mirred"} 0` + "\n",
+		`tcbroker_clsact_qdisc_present{intf="eth0"} 1` + "\n",
+		`tcbroker_clsact_qdisc_present{intf="eth1"} 0` + "\n",
+		"tcbroker_scrape_errors 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), `tcbroker_packets_total{rule="web",src_intf="eth0",dst_intf="",filter="2",action="police"}`) {
+		t.Errorf("Expected the packets of the police action not to be counted twice, got:\n%s", body)
+	}
+}
+
+func TestMetricsCountScrapeErrors(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "web", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp"}}},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	backend.Fail = func(op, iface string) error { return errors.New("tc failed") }
+
+	var out strings.Builder
+	writeMetrics(&out, backend, cfg, func(string) bool { return true })
+	if !strings.Contains(out.String(), "tcbroker_scrape_errors 2\n") {
+		t.Errorf("Expected both failed queries to be counted, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "tcbroker_packets_total{") {
+		t.Errorf("Expected no counters for a rule that could not be queried, got:\n%s", out.String())
+	}
+}
+
+func TestMetricsOfMissingInterface(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "web", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp"}}},
+			{Name: "dns", SrcIntf: "eth2", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "udp"}}},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+
+	var out strings.Builder
+	writeMetrics(&out, backend, cfg, func(name string) bool { return name != "eth2" })
+	for _, want := range []string{
+		`tcbroker_clsact_qdisc_present{intf="eth0"} 1` + "\n",
+		`tcbroker_clsact_qdisc_present{intf="eth2"} 0` + "\n",
+		"tcbroker_scrape_errors 0\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `rule="dns"`) {
+		t.Errorf("Expected no counters for a rule on a missing interface, got:\n%s", out.String())
+	}
+}
+
+func TestMetricLabelsAreEscaped(t *testing.T) {
+	m := &metricFamily{name: "m"}
+	m.add(1, "rule", "a\"b\\c\nd")
+	if want := `m{rule="a\"b\\c\nd"} 1`; m.samples[0] != want {
+		t.Errorf("Expected %s, got %s", want, m.samples[0])
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+// Rule states the daemon reports
+const (
+	ruleActive  = "active"  // installed
+	rulePending = "pending" // waiting for an interface to appear
+	ruleStopped = "stopped" // the configuration is not applied
+)
+
+// interfaceExists reports whether the named network interface exists.
+func interfaceExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// readyRules returns the rules of cfg whose source and destination
+// interfaces all exist, and the missing interfaces of every other rule by
+// name. The ready rules keep the priorities they have in cfg, so they keep
+// their preferences while the rules before them are pending.
+func readyRules(cfg *config.Config, exists func(string) bool) (*config.Config, map[string][]string) {
+	ready := &config.Config{}
+	pending := make(map[string][]string)
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		var missing []string
+		for _, name := range append([]string{rule.SrcIntf}, rule.DstIntf...) {
+			if !exists(name) && !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			pending[rule.Name] = missing
+			continue
+		}
+		rule.Priority = priorities[i]
+		ready.Rules = append(ready.Rules, rule)
+	}
+	return ready, pending
+}
+
+// idleInterfaces returns a configuration with the rules of cfgs whose source
+// interface exists but is used by no rule of ready, for Cleanup to remove
+// what tcbroker left on them.
+func idleInterfaces(ready *config.Config, exists func(string) bool, cfgs ...*config.Config) *config.Config {
+	used := make(map[string]bool)
+	for _, rule := range ready.Rules {
+		used[rule.SrcIntf] = true
+	}
+	idle := &config.Config{}
+	for _, cfg := range cfgs {
+		for _, rule := range cfg.Rules {
+			if !used[rule.SrcIntf] && exists(rule.SrcIntf) {
+				used[rule.SrcIntf] = true
+				idle.Rules = append(idle.Rules, rule)
+			}
+		}
+	}
+	return idle
+}
+
+// linkRetryInterval is the time between attempts to subscribe to link
+// notifications again after the subscription failed.
+var linkRetryInterval = 5 * time.Second
+
+// watchLinks applies the configuration again whenever an interface one of
+// its rules uses appears or goes away, until ctx is done. A subscription
+// that fails is logged and renewed, and every interface is checked again.
+func (d *daemon) watchLinks(ctx context.Context) error {
+	events, err := d.subscribeLinks(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			for ev := range events {
+				if ev.Err != nil {
+					d.logger.Printf("Link notifications stopped: %v", ev.Err)
+					continue
+				}
+				d.linkChanged(ev)
+			}
+			if events = d.resubscribeLinks(ctx); events == nil {
+				return
+			}
+			// Interfaces may have come and gone in between
+			d.linkChanged(tc.LinkEvent{})
+		}
+	}()
+	return nil
+}
+
+// resubscribeLinks subscribes to link notifications again, retrying every
+// linkRetryInterval. It returns nil once ctx is done.
+func (d *daemon) resubscribeLinks(ctx context.Context) <-chan tc.LinkEvent {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(linkRetryInterval):
+		}
+		events, err := d.subscribeLinks(ctx)
+		if err == nil {
+			d.logger.Printf("Resubscribed to link notifications")
+			return events
+		}
+		d.logger.Printf("Failed to resubscribe to link notifications: %v", err)
+	}
+}
+
+// linkChanged applies the configuration after a link event for one of its
+// interfaces, installing the rules that became ready and removing those
+// that became pending.
+func (d *daemon) linkChanged(ev tc.LinkEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active || !d.usesInterface(ev.Name) {
+		return
+	}
+
+	switch {
+	case ev.Name == "":
+		d.logger.Printf("Link notifications were lost; checking every interface")
+	case ev.Deleted:
+		d.logger.Printf("Interface %s went away", ev.Name)
+	default:
+		// RTM_NEWLINK is also sent for changes of a link that is known,
+		// which only matter if a rule is waiting for it
+		if !d.waitingFor(ev.Name) {
+			return
+		}
+		d.logger.Printf("Interface %s appeared", ev.Name)
+	}
+
+	plan, err := d.apply(d.cfg)
+	if err != nil {
+		d.logger.Printf("Failed to apply the configuration: %v", err)
+		return
+	}
+	if len(d.pending) > 0 {
+		var waiting []string
+		for _, rule := range d.cfg.Rules {
+			if missing, ok := d.pending[rule.Name]; ok {
+				waiting = append(waiting, rule.Name+" ("+strings.Join(missing, ", ")+")")
+			}
+		}
+		d.logger.Printf("Pending rules: %s", strings.Join(waiting, ", "))
+	}
+	if plan.HasChanges() {
+		d.logger.Printf("Applied: %d added, %d removed, %d unchanged", plan.Count(tc.PlanAdd), plan.Count(tc.PlanRemove), plan.Count(tc.PlanKeep))
+	}
+}
+
+// usesInterface reports whether a rule uses the named interface. Every
+// configuration uses the interface of an event without a name.
+func (d *daemon) usesInterface(name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, rule := range d.cfg.Rules {
+		if rule.SrcIntf == name || slices.Contains(rule.DstIntf, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitingFor reports whether a pending rule waits for the named interface.
+func (d *daemon) waitingFor(name string) bool {
+	for _, missing := range d.pending {
+		if slices.Contains(missing, name) {
+			return true
+		}
+	}
+	return false
+}
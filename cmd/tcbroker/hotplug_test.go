@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+	"tcbroker/pkg/tc"
+)
+
+func TestReadyRulesKeepPriorities(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "first", SrcIntf: "eth0", DstIntf: config.Interfaces{"vf0"}, Filters: []filter.Filter{{IPProto: "tcp"}}},
+			{Name: "second", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "udp"}}},
+			{Name: "third", SrcIntf: "veth0", DstIntf: config.Interfaces{"vf0", "veth0"}, Filters: []filter.Filter{{IPProto: "udp"}}},
+		},
+	}
+	exists := func(name string) bool { return name == "eth0" || name == "eth1" }
+
+	ready, pending := readyRules(cfg, exists)
+	if len(ready.Rules) != 1 || ready.Rules[0].Name != "second" || ready.Rules[0].Priority != 2 {
+		t.Errorf("Expected only second to be ready at priority 2, got %+v", ready.Rules)
+	}
+	if got := strings.Join(pending["first"], ","); got != "vf0" {
+		t.Errorf("Expected first to wait for vf0, got %s", got)
+	}
+	if got := strings.Join(pending["third"], ","); got != "veth0,vf0" {
+		t.Errorf("Expected third to wait for veth0 and vf0, got %s", got)
+	}
+}
+
+func TestDaemonInstallsRulesWhenInterfacesAppear(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	var logs bytes.Buffer
+	d.logger = log.New(&logs, "", 0)
+	links := map[string]bool{"eth0": true, "eth1": true}
+	d.linkExists = func(name string) bool { return links[name] }
+
+	// dns waits for eth2 instead of failing the start
+	result, err := d.start()
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if result.Added != 1 {
+		t.Errorf("Expected only web to be installed, got %+v", result)
+	}
+	st := d.status()
+	if st.Rules[0].State != ruleActive || st.Rules[1].State != rulePending || st.Rules[1].Waiting[0] != "eth2" {
+		t.Errorf("Expected web active and dns waiting for eth2, got %+v", st.Rules)
+	}
+	if !st.Interfaces[1].Missing {
+		t.Errorf("Expected eth2 to be reported missing, got %+v", st.Interfaces[1])
+	}
+
+	// Events for interfaces no rule uses and for links that are known
+	// change nothing
+	d.linkChanged(tc.LinkEvent{Name: "docker0"})
+	d.linkChanged(tc.LinkEvent{Name: "eth0", Up: true})
+	if logs.Len() != 0 {
+		t.Errorf("Expected unrelated events to be ignored, got:\n%s", logs.String())
+	}
+
+	links["eth2"] = true
+	d.linkChanged(tc.LinkEvent{Name: "eth2", Index: 5})
+	if len(backend.Filters[tc.FakeKey("eth2", "ingress")]) != 1 {
+		t.Errorf("Expected dns to be installed on eth2, got %v", backend.Filters)
+	}
+	if st := d.status(); st.Rules[1].State != ruleActive {
+		t.Errorf("Expected dns to be active, got %+v", st.Rules[1])
+	}
+	if !strings.Contains(logs.String(), "Interface eth2 appeared") {
+		t.Errorf("Expected the new interface to be logged, got:\n%s", logs.String())
+	}
+
+	// The destination of both rules goes away and comes back, as with a
+	// container restart
+	links["eth1"] = false
+	d.linkChanged(tc.LinkEvent{Name: "eth1", Deleted: true})
+	if len(backend.Filters[tc.FakeKey("eth0", "ingress")]) != 0 || backend.Qdiscs["eth0"] {
+		t.Errorf("Expected the filters mirroring to eth1 to be removed, got %v", backend.Filters)
+	}
+	var out strings.Builder
+	printDaemonStatus(&out, d.status())
+	if !strings.Contains(out.String(), "Rule 'web' is waiting for eth1") {
+		t.Errorf("Expected status to show web waiting, got:\n%s", out.String())
+	}
+
+	links["eth1"] = true
+	d.linkChanged(tc.LinkEvent{Name: "eth1"})
+	if len(backend.Filters[tc.FakeKey("eth0", "ingress")]) != 1 || len(backend.Filters[tc.FakeKey("eth2", "ingress")]) != 1 {
+		t.Errorf("Expected both rules to be reinstalled, got %v", backend.Filters)
+	}
+}
+
+func TestDaemonIgnoresLinksWhileStopped(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	d.linkChanged(tc.LinkEvent{Name: "eth2"})
+	if len(backend.Qdiscs) != 0 {
+		t.Errorf("Expected nothing to be installed while stopped, got %v", backend.Qdiscs)
+	}
+	if st := d.status(); st.Rules[0].State != ruleStopped {
+		t.Errorf("Expected a stopped rule, got %+v", st.Rules[0])
+	}
+}
+
+func TestDaemonResubscribesToLinks(t *testing.T) {
+	d, _, _ := serveDaemon(t, daemonConfig)
+	var logs syncBuffer
+	d.logger = log.New(&logs, "", 0)
+	links := map[string]bool{"eth0": true, "eth1": true}
+	d.linkExists = func(name string) bool { return links[name] }
+	subscriptions := make(chan chan tc.LinkEvent, 2)
+	d.subscribeLinks = func(context.Context) (<-chan tc.LinkEvent, error) {
+		events := make(chan tc.LinkEvent, 1)
+		subscriptions <- events
+		return events, nil
+	}
+	retry := linkRetryInterval
+	linkRetryInterval = time.Millisecond
+	t.Cleanup(func() { linkRetryInterval = retry })
+
+	if _, err := d.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := d.watchLinks(ctx); err != nil {
+		t.Fatalf("watchLinks failed: %v", err)
+	}
+
+	// eth2 appears while the subscription is broken
+	d.mu.Lock()
+	links["eth2"] = true
+	d.mu.Unlock()
+	first := <-subscriptions
+	first <- tc.LinkEvent{Err: errors.New("recvfrom: bad file descriptor")}
+	close(first)
+
+	select {
+	case <-subscriptions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the daemon to subscribe again")
+	}
+	for deadline := time.Now().Add(5 * time.Second); d.status().Rules[1].State != ruleActive; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected dns to be installed after resubscribing, got %+v", d.status().Rules[1])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "Link notifications stopped: recvfrom: bad file descriptor") {
+		t.Errorf("Expected the failure to be logged, got:\n%s", logs.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the daemon's goroutines to log to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+// Exit codes of the plan command
+const (
+	planExitNoChanges = 0
+	planExitError     = 1
+	planExitChanges   = 2
+)
+
+var planOutput string
+
+var planCmd = &cobra.Command{
+	Use:     "plan [config-file]",
+	Aliases: []string{"diff"},
+	Short:   "Shows what apply would change without changing anything.",
+	Long: `Compares the given YAML configuration file with the filters tcbroker has
+installed and lists, per interface and hook, which filters apply would add,
+remove or leave alone.
+
+Exit codes: 0 when the host is up to date, 2 when changes are pending,
+1 on error.`,
+	Args: cobra.ExactArgs(1),
+	Run:  planRun,
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", "text", "Output format: text or json")
+	planCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to query tc: exec (tc binary) or netlink")
+}
+
+func planRun(cmd *cobra.Command, args []string) {
+	configFile := args[0]
+
+	if planOutput != "text" && planOutput != "json" {
+		fmt.Printf("Error: invalid output format '%s' (expected text or json)\n", planOutput)
+		os.Exit(planExitError)
+	}
+
+	// Load and validate the configuration
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(planExitError)
+	}
+
+	backend, err := tc.NewBackend(backendName, false, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(planExitError)
+	}
+
+	plan, err := tc.ComputePlan(backend, cfg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(planExitError)
+	}
+
+	if planOutput == "json" {
+		if err := printPlanJSON(os.Stdout, plan); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(planExitError)
+		}
+	} else {
+		printPlan(os.Stdout, plan)
+	}
+
+	if plan.HasChanges() {
+		os.Exit(planExitChanges)
+	}
+	os.Exit(planExitNoChanges)
+}
+
+// planChangeJSON is the JSON form of a single plan entry.
+type planChangeJSON struct {
+	Action   string `json:"action"`
+	Rule     string `json:"rule,omitempty"`
+	Iface    string `json:"iface"`
+	Hook     string `json:"hook"`
+	Priority int    `json:"priority,omitempty"`
+	Match    string `json:"match"`
+	Target   string `json:"target,omitempty"`
+	Mirred   string `json:"mirred,omitempty"`
+	Command  string `json:"command,omitempty"`
+}
+
+// planJSON is the document printed by `plan -o json`.
+type planJSON struct {
+	ChangesPending bool             `json:"changes_pending"`
+	Qdiscs         []string         `json:"qdiscs"`
+	Changes        []planChangeJSON `json:"changes"`
+	Summary        map[string]int   `json:"summary"`
+}
+
+// printPlanJSON writes the plan as an indented JSON document.
+func printPlanJSON(w io.Writer, plan *tc.Plan) error {
+	doc := planJSON{
+		ChangesPending: plan.HasChanges(),
+		Qdiscs:         append([]string{}, plan.Qdiscs...),
+		Changes:        []planChangeJSON{},
+		Summary: map[string]int{
+			tc.PlanAdd:    plan.Count(tc.PlanAdd),
+			tc.PlanRemove: plan.Count(tc.PlanRemove),
+			tc.PlanKeep:   plan.Count(tc.PlanKeep),
+		},
+	}
+
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		entry := planChangeJSON{
+			Action: c.Action,
+			Iface:  c.Iface,
+			Hook:   c.Hook,
+			Match:  c.Match(),
+			Target: c.Target(),
+			Mirred: c.Operation(),
+		}
+		if c.Desired != nil {
+			entry.Rule = c.Desired.Rule
+		}
+		entry.Priority = c.Pref()
+		if args := c.Args(); args != nil {
+			entry.Command = "tc " + strings.Join(args, " ")
+		}
+		doc.Changes = append(doc.Changes, entry)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// printPlan writes the plan in a Terraform-like text form: "+" for filters
+// to add, "-" for filters to remove and "=" for filters left alone.
+func printPlan(w io.Writer, plan *tc.Plan) {
+	for _, iface := range plan.Qdiscs {
+		fmt.Fprintf(w, "+ clsact qdisc on %s\n", iface)
+		fmt.Fprintf(w, "      tc qdisc add dev %s clsact\n", iface)
+	}
+	if len(plan.Qdiscs) > 0 {
+		fmt.Fprintln(w)
+	}
+
+	current := ""
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		if header := fmt.Sprintf("%s (%s)", c.Iface, c.Hook); header != current {
+			if current != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", header)
+			current = header
+		}
+
+		rule := "(not in config)"
+		if c.Desired != nil {
+			rule = c.Desired.Rule
+		}
+
+		// Only the uncommon mirred operations are spelled out; exclusions
+		// have no target at all
+		target := c.Target()
+		if op := c.Operation(); target == "" {
+			target = strings.ToLower(op)
+		} else if op != "" && op != "Egress Mirror" {
+			target += " (" + strings.ToLower(op) + ")"
+		}
+
+		symbol := map[string]string{tc.PlanAdd: "+", tc.PlanRemove: "-", tc.PlanKeep: "="}[c.Action]
+		fmt.Fprintf(w, "  %s %-20s  pref %-6d  %-30s → %s\n", symbol, rule, c.Pref(), c.Match(), target)
+		if args := c.Args(); args != nil {
+			fmt.Fprintf(w, "      tc %s\n", strings.Join(args, " "))
+		}
+	}
+	if current != "" {
+		fmt.Fprintln(w)
+	}
+
+	if !plan.HasChanges() {
+		fmt.Fprintf(w, "No changes. %d filter(s) up to date.\n", plan.Count(tc.PlanKeep))
+		return
+	}
+	fmt.Fprintf(w, "Plan: %d to add, %d to remove, %d unchanged.\n",
+		plan.Count(tc.PlanAdd), plan.Count(tc.PlanRemove), plan.Count(tc.PlanKeep))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"tcbroker/pkg/filter"
+	"tcbroker/pkg/tc"
+)
+
+func TestPlanOutput(t *testing.T) {
+	backend := tc.NewFakeBackend()
+	cfg := testConfig()
+
+	// Install the config, then drop the DNS rule so it becomes stale and
+	// add a new HTTP filter
+	if _, err := reconcile(backend, backend, cfg); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	cfg.Rules = cfg.Rules[:1]
+	cfg.Rules[0].Filters = append(cfg.Rules[0].Filters, cfg.Rules[0].Filters[0])
+	cfg.Rules[0].Filters[2].DstPort = filter.Port(8443)
+
+	plan, err := tc.ComputePlan(backend, cfg)
+	if err != nil {
+		t.Fatalf("ComputePlan failed: %v", err)
+	}
+
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	for _, want := range []string{
+		"eth0 (ingress):",
+		"= http-mirror",
+		"+ http-mirror",
+		"+ http-mirror           pref 30102",
+		"tc filter add dev eth0 ingress pref 30102 protocol ip handle 0x3 flower ip_proto tcp dst_port 8443 action mirred egress mirror dev eth1 continue",
+		"- (not in config)",
+		"tc filter del dev eth0 ingress pref 30200",
+		"Plan: 1 to add, 1 to remove, 2 unchanged.",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Expected text plan to contain %q, got:\n%s", want, text.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printPlanJSON(&out, plan); err != nil {
+		t.Fatalf("printPlanJSON failed: %v", err)
+	}
+	var doc planJSON
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid JSON output: %v\n%s", err, out.String())
+	}
+	if !doc.ChangesPending {
+		t.Error("Expected changes_pending to be true")
+	}
+	if doc.Summary["add"] != 1 || doc.Summary["remove"] != 1 || doc.Summary["keep"] != 2 {
+		t.Errorf("Unexpected summary: %v", doc.Summary)
+	}
+	if len(doc.Changes) != 4 {
+		t.Fatalf("Expected 4 changes, got %d", len(doc.Changes))
+	}
+	removed := doc.Changes[3]
+	if removed.Action != "remove" || removed.Priority != 30200 || removed.Target != "eth2" {
+		t.Errorf("Unexpected remove entry: %+v", removed)
+	}
+
+	// Once applied, the plan is empty
+	if err := tc.ApplyPlan(backend, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	plan, err = tc.ComputePlan(backend, cfg)
+	if err != nil {
+		t.Fatalf("ComputePlan failed: %v", err)
+	}
+	text.Reset()
+	printPlan(&text, plan)
+	if plan.HasChanges() || !strings.Contains(text.String(), "No changes. 3 filter(s) up to date.") {
+		t.Errorf("Expected an empty plan, got:\n%s", text.String())
+	}
+}
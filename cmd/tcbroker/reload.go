@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// reloadSocket is reload's own, as the default of the socketPath that
+// start, stop and status share is empty
+var reloadSocket string
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Makes the daemon re-read and apply its config file.",
+	Long: `Asks the running daemon to re-read its YAML configuration file and, while
+mirroring is active, apply only what changed. An invalid file is reported
+and the daemon keeps its current configuration.`,
+	Args: cobra.NoArgs,
+	Run:  reload,
+}
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+	reloadCmd.Flags().StringVar(&reloadSocket, "socket", defaultSocketPath, "Unix socket the daemon listens on")
+}
+
+func reload(cmd *cobra.Command, args []string) {
+	var result planResult
+	if err := callDaemon(reloadSocket, "POST", "/reload", &result); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Reloaded: %d added, %d removed, %d unchanged\n", result.Added, result.Removed, result.Unchanged)
+}
+
+// requireConfig returns the config file argument of a command that runs
+// without the daemon.
+func requireConfig(args []string) string {
+	if len(args) == 0 {
+		fmt.Println("Error: please provide a config file or use --socket to ask the daemon.")
+		os.Exit(1)
+	}
+	return args[0]
+}
+
+// requireNoConfig rejects a config file argument when the daemon, which
+// owns the configuration, serves the command.
+func requireNoConfig(args []string) {
+	if len(args) > 0 {
+		fmt.Println("Error: the daemon uses its own config file; omit it with --socket.")
+		os.Exit(1)
+	}
+}
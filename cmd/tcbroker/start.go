@@ -7,13 +7,16 @@ import (
 
 	"github.com/spf13/cobra"
 	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
 	"tcbroker/pkg/tc"
 )
 
 var (
-	debug  bool
-	dryRun bool
-	force  bool
+	debug       bool
+	dryRun      bool
+	force       bool
+	backendName string
+	socketPath  string
 )
 
 var startCmd = &cobra.Command{
@@ -21,7 +24,7 @@ var startCmd = &cobra.Command{
 	Short: "Starts the packet mirroring based on a config file.",
 	Long: `Reads the given YAML configuration file, validates it, and applies the
 	tc rules to start mirroring packets. This command requires root privileges.`,
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MaximumNArgs(1),
 	Run:  start,
 }
 
@@ -30,10 +33,23 @@ func init() {
 	startCmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print tc commands")
 	startCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry-run mode to print tc commands without executing them")
 	startCmd.Flags().BoolVar(&force, "force", false, "Force overwrite by cleaning up existing tc rules before applying new ones")
+	startCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to program tc: exec (tc binary) or netlink")
+	startCmd.Flags().StringVar(&socketPath, "socket", "", "Ask the daemon listening on this Unix socket instead (--socket alone uses "+defaultSocketPath+")")
+	startCmd.Flags().Lookup("socket").NoOptDefVal = defaultSocketPath
 }
 
 func start(cmd *cobra.Command, args []string) {
-	configFile := args[0]
+	if socketPath != "" {
+		requireNoConfig(args)
+		var result planResult
+		if err := callDaemon(socketPath, "POST", "/start", &result); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Started: %d added, %d removed, %d unchanged\n", result.Added, result.Removed, result.Unchanged)
+		return
+	}
+	configFile := requireConfig(args)
 
 	// In dry-run mode, we don't need root privileges
 	if !dryRun && os.Geteuid() != 0 {
@@ -47,13 +63,18 @@ func start(cmd *cobra.Command, args []string) {
 		fmt.Printf("Error loading config file: %v\n", err)
 		os.Exit(1)
 	}
+	printWarnings(cfg)
 
-	// Initialize the tc runner
-	runner := tc.NewRunner(debug, dryRun)
+	// Initialize the tc backend
+	runner, err := tc.NewBackend(backendName, debug, dryRun)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// If --force is used, cleanup existing rules first
 	if force {
-		if errCleanup := runner.Cleanup(cfg); errCleanup != nil {
+		if errCleanup := tc.Cleanup(runner, cfg); errCleanup != nil {
 			fmt.Printf("Error during cleanup: %v\n", errCleanup)
 			os.Exit(1)
 		}
@@ -66,7 +87,9 @@ func start(cmd *cobra.Command, args []string) {
 		interfaceSet := make(map[string]bool)
 		for _, rule := range cfg.Rules {
 			interfaceSet[rule.SrcIntf] = true
-			interfaceSet[rule.DstIntf] = true
+			for _, dst := range rule.DstIntf {
+				interfaceSet[dst] = true
+			}
 		}
 
 		// Verify all interfaces exist
@@ -78,36 +101,62 @@ func start(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	if errApply := applyConfig(runner, cfg); errApply != nil {
+		fmt.Printf("Error: %v\n", errApply)
+		os.Exit(1)
+	}
+
+	if !debug && !dryRun {
+		fmt.Println("Started")
+	}
+}
+
+// applyConfig installs the clsact qdiscs and mirror filters for every rule in
+// cfg. It is all-or-nothing: when a step fails, every qdisc and filter created
+// so far is removed again and a *tc.RollbackError describes the outcome.
+func applyConfig(backend tc.Backend, cfg *config.Config) error {
+	tx := tc.NewTransaction(backend)
+
 	// Collect unique source interfaces that need clsact qdisc
 	srcInterfaceSet := make(map[string]bool)
+	var srcInterfaces []string
 	for _, rule := range cfg.Rules {
-		srcInterfaceSet[rule.SrcIntf] = true
+		if !srcInterfaceSet[rule.SrcIntf] {
+			srcInterfaceSet[rule.SrcIntf] = true
+			srcInterfaces = append(srcInterfaces, rule.SrcIntf)
+		}
 	}
 
-	// Apply the configuration
 	// Step 1: Add clsact qdisc to all source interfaces
-	for srcIntf := range srcInterfaceSet {
-		if errQdisc := runner.EnsureClsactQdisc(srcIntf); errQdisc != nil {
-			fmt.Printf("Error: failed to add clsact qdisc to %s: %v\n", srcIntf, errQdisc)
-			os.Exit(1)
+	for _, srcIntf := range srcInterfaces {
+		if err := tx.EnsureClsactQdisc(srcIntf); err != nil {
+			return tx.Rollback(fmt.Errorf("failed to add clsact qdisc to %s: %w", srcIntf, err))
 		}
 	}
 
-	// Step 2: Apply filters for each rule
-	for _, rule := range cfg.Rules {
-		// Direction is always ingress for rules-based config
-		direction := "ingress"
-
-		// Apply each filter in the rule
-		for _, filter := range rule.Filters {
-			if errFilter := runner.AddMirrorFilter(rule.SrcIntf, direction, rule.DstIntf, filter, rule.Rewrite); errFilter != nil {
-				fmt.Printf("Error: failed to add filter rule: %v\n", errFilter)
-				os.Exit(1)
+	// Step 2: Apply filters for each rule, numbered from its priority
+	priorities := cfg.Priorities()
+	for r, rule := range cfg.Rules {
+		direction := rule.GetDirection()
+
+		// Apply each filter in the rule, one tc filter per entry of a port list,
+		// each behind the pass filters of its exclusions
+		n := 0
+		for i, f := range rule.Filters {
+			for _, expanded := range filter.Expand(f) {
+				for _, x := range rule.Exclusions(expanded) {
+					if err := tx.AddPassFilter(rule.SrcIntf, direction, tc.NewFilterID(rule.Name, priorities[r], i, n), x); err != nil {
+						return tx.Rollback(fmt.Errorf("failed to add exclude for filter #%d of rule '%s': %w", i+1, rule.Name, err))
+					}
+					n++
+				}
+				if err := tx.AddMirrorFilter(rule.SrcIntf, direction, tc.NewFilterID(rule.Name, priorities[r], i, n), rule.Mirred(), expanded, rule.Rewrite); err != nil {
+					return tx.Rollback(fmt.Errorf("failed to add filter #%d of rule '%s': %w", i+1, rule.Name, err))
+				}
+				n++
 			}
 		}
 	}
 
-	if !debug && !dryRun {
-		fmt.Println("Started")
-	}
+	return nil
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+	"tcbroker/pkg/tc"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Rules: []config.Rule{
+			{
+				Name:    "http-mirror",
+				SrcIntf: "eth0",
+				DstIntf: config.Interfaces{"eth1"},
+				Filters: []filter.Filter{
+					{IPProto: "tcp", DstPort: filter.Port(80)},
+					{IPProto: "tcp", DstPort: filter.Port(8080)},
+				},
+			},
+			{
+				Name:    "dns-mirror",
+				SrcIntf: "eth0",
+				DstIntf: config.Interfaces{"eth2"},
+				Rewrite: &config.RewriteOptions{DstMAC: "52:54:00:12:34:56"},
+				Filters: []filter.Filter{
+					{IPProto: "udp", DstPort: filter.Port(53)},
+				},
+			},
+		},
+	}
+}
+
+// failNth fails the n-th call of op with err and every DeleteFilter call
+// with deleteErr.
+func failNth(op string, n int, err, deleteErr error) func(string, string) error {
+	calls := 0
+	return func(o, iface string) error {
+		if o == "DeleteFilter" {
+			return deleteErr
+		}
+		if o != op {
+			return nil
+		}
+		calls++
+		if calls == n {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestStartStatusStopFlow(t *testing.T) {
+	errInjected := errors.New("injected failure")
+
+	testCases := []struct {
+		name         string
+		foreign      bool
+		fail         func(op, iface string) error
+		wantStartErr bool
+		wantUndone   int
+		wantFailed   int
+		wantFilters  int
+		wantSummary  []string
+		wantStopErr  bool
+	}{
+		{
+			name:        "success",
+			wantFilters: 3,
+			wantSummary: []string{
+				"http-mirror                     eth0                  eth1                          30  3.0 KB",
+				"dns-mirror                      eth0                  eth2                           5  400 B",
+			},
+		},
+		{
+			name: "qdisc failure",
+			fail: func(op, iface string) error {
+				if op == "EnsureClsactQdisc" {
+					return errInjected
+				}
+				return nil
+			},
+			wantStartErr: true,
+		},
+		{
+			name: "third filter failure rolls back",
+			fail: failNth("AddMirrorFilter", 3, errInjected, nil),
+			// two filters and the qdisc
+			wantStartErr: true,
+			wantUndone:   3,
+		},
+		{
+			name: "rollback failure is reported",
+			fail: failNth("AddMirrorFilter", 3, errInjected, errors.New("device busy")),
+			// both filter deletes fail, the qdisc delete succeeds
+			wantStartErr: true,
+			wantUndone:   1,
+			wantFailed:   2,
+		},
+		{
+			name: "filter failure",
+			fail: func(op, iface string) error {
+				if op == "AddMirrorFilter" {
+					return errInjected
+				}
+				return nil
+			},
+			// only the qdisc
+			wantStartErr: true,
+			wantUndone:   1,
+		},
+		{
+			name: "stats failure",
+			fail: func(op, iface string) error {
+				if op == "ListFilterStats" {
+					return errInjected
+				}
+				return nil
+			},
+			wantFilters: 3,
+			wantSummary: []string{
+				"http-mirror                     eth0                  eth1                           0  0 B",
+				"dns-mirror                      eth0                  eth2                           0  0 B",
+			},
+			wantStopErr: true,
+		},
+		{
+			name:        "foreign filter is kept",
+			foreign:     true,
+			wantFilters: 4,
+			wantSummary: []string{
+				"http-mirror                     eth0                  eth1                          30  3.0 KB",
+			},
+		},
+		{
+			name: "stop failure",
+			fail: func(op, iface string) error {
+				if op == "DeleteClsactQdisc" {
+					return errInjected
+				}
+				return nil
+			},
+			wantFilters: 3,
+			wantSummary: []string{"http-mirror", "dns-mirror"},
+			wantStopErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			backend := tc.NewFakeBackend()
+			backend.Fail = tt.fail
+			if tt.foreign {
+				// Another tool's filter with an identical match, outside tcbroker's range
+				backend.Qdiscs["eth0"] = true
+				backend.Filters[tc.FakeKey("eth0", "ingress")] = []tc.FilterStats{{
+					Priority: 1,
+					Matches:  map[string]string{"ip_proto": "tcp", "dst_port": "80"},
+					Actions:  []tc.ActionStats{{Type: "mirred", TargetDev: "eth1"}},
+				}}
+			}
+
+			// start
+			err := applyConfig(backend, cfg)
+			if (err != nil) != tt.wantStartErr {
+				t.Fatalf("applyConfig() error = %v, wantErr %v", err, tt.wantStartErr)
+			}
+			if err != nil {
+				if !errors.Is(err, errInjected) {
+					t.Errorf("Expected injected error, got: %v", err)
+				}
+				var rbErr *tc.RollbackError
+				if !errors.As(err, &rbErr) {
+					t.Fatalf("Expected a RollbackError, got: %v", err)
+				}
+				if len(rbErr.Undone) != tt.wantUndone || len(rbErr.Failed) != tt.wantFailed {
+					t.Errorf("Expected %d undone and %d failed, got:\n%v", tt.wantUndone, tt.wantFailed, err)
+				}
+				if rbErr.Succeeded() && (backend.Qdiscs["eth0"] || len(backend.Filters[tc.FakeKey("eth0", "ingress")]) != 0) {
+					t.Errorf("Expected no qdisc or filters after rollback, got qdisc=%v filters=%d",
+						backend.Qdiscs["eth0"], len(backend.Filters[tc.FakeKey("eth0", "ingress")]))
+				}
+				return
+			}
+			if got := len(backend.Filters[tc.FakeKey("eth0", "ingress")]); got != tt.wantFilters {
+				t.Fatalf("Expected %d filters on eth0 ingress, got %d", tt.wantFilters, got)
+			}
+
+			// Simulate traffic: both HTTP filters and the DNS filter match.
+			offset := tt.wantFilters - 3
+			backend.Count("eth0", "ingress", offset, 10, 1024)
+			backend.Count("eth0", "ingress", offset+1, 20, 2048)
+			backend.Count("eth0", "ingress", offset+2, 5, 400)
+			if tt.foreign {
+				backend.Count("eth0", "ingress", 0, 1000, 100000)
+			}
+
+			// status --summary
+			var out bytes.Buffer
+			printSummary(&out, backend, cfg)
+			for _, want := range tt.wantSummary {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Expected summary to contain %q, got:\n%s", want, out.String())
+				}
+			}
+
+			// stop
+			err = tc.Cleanup(backend, cfg)
+			if (err != nil) != tt.wantStopErr {
+				t.Fatalf("Cleanup() error = %v, wantErr %v", err, tt.wantStopErr)
+			}
+			if err != nil {
+				return
+			}
+			remaining := backend.Filters[tc.FakeKey("eth0", "ingress")]
+			if tt.foreign {
+				if !backend.Qdiscs["eth0"] {
+					t.Error("Expected clsact qdisc on eth0 to be kept for the foreign filter")
+				}
+				if len(remaining) != 1 || remaining[0].Priority != 1 {
+					t.Errorf("Expected only the foreign filter to remain, got %+v", remaining)
+				}
+				return
+			}
+			if backend.Qdiscs["eth0"] {
+				t.Error("Expected clsact qdisc on eth0 to be removed")
+			}
+			if len(remaining) != 0 {
+				t.Errorf("Expected no filters after stop, got %d", len(remaining))
+			}
+		})
+	}
+}
+
+func TestSummaryPerDestination(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{{
+			Name:    "fan-out",
+			SrcIntf: "eth0",
+			DstIntf: config.Interfaces{"ids0", "rec0"},
+			Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(443)}},
+		}},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+
+	filters := backend.Filters[tc.FakeKey("eth0", "ingress")]
+	if len(filters) != 1 {
+		t.Fatalf("Expected a single filter for both destinations, got %d", len(filters))
+	}
+	if got := len(filters[0].Actions); got != 2 {
+		t.Fatalf("Expected 2 chained mirred actions, got %d", got)
+	}
+
+	// The recorder's mirred action saw fewer packets
+	backend.Count("eth0", "ingress", 0, 10, 1024)
+	filters[0].Actions[1].Packets, filters[0].Actions[1].Bytes = 4, 512
+
+	var out bytes.Buffer
+	printSummary(&out, backend, cfg)
+	for _, want := range []string{
+		"fan-out                         eth0                  ids0                          10  1.0 KB",
+		"fan-out                         eth0                  rec0                           4  512 B",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected summary to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSummaryAttributesByCookie(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "web", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(80)}}},
+			{Name: "dns", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "udp", DstPort: filter.Port(53)}}},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	backend.Count("eth0", "ingress", 0, 10, 1000)
+	backend.Count("eth0", "ingress", 1, 3, 300)
+
+	// Swapping the priorities moves the preference blocks, but until the
+	// config is applied the installed filters still carry the old cookies
+	cfg.Rules[0].Priority, cfg.Rules[1].Priority = 2, 1
+
+	var out bytes.Buffer
+	printSummary(&out, backend, cfg)
+	for _, want := range []string{
+		"web                             eth0                  eth1                          10  1000 B",
+		"dns                             eth0                  eth1                           3  300 B",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected summary to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPrintFilterActionsShowsRewrites(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{
+				Name:    "rewrite",
+				SrcIntf: "eth0",
+				DstIntf: config.Interfaces{"eth1"},
+				Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(80)}},
+				Rewrite: &config.RewriteOptions{DstMAC: "52:54:00:12:34:56", DstIP: "10.0.0.100"},
+			},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	filters, err := backend.ListFilterStats("eth0", "ingress")
+	if err != nil {
+		t.Fatalf("ListFilterStats failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	printFilterActions(&out, filters)
+	for _, want := range []string{
+		"skbmod set dmac 52:54:00:12:34:56",
+		"pedit ip dst set 10.0.0.100",
+		"csum iph, tcp",
+		"mirred (Egress Mirror to device eth1)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected actions to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	printFilterActions(&out, nil)
+	if !strings.Contains(out.String(), "(no filters)") {
+		t.Errorf("Expected '(no filters)', got:\n%s", out.String())
+	}
+}
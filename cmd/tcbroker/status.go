@@ -2,13 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"tcbroker/pkg/config"
-	"tcbroker/pkg/filter"
 	"tcbroker/pkg/tc"
 )
 
@@ -16,6 +15,7 @@ var (
 	showAll     bool
 	showStats   bool
 	showSummary bool
+	showActions bool
 )
 
 var statusCmd = &cobra.Command{
@@ -33,9 +33,24 @@ func init() {
 	statusCmd.Flags().BoolVar(&showAll, "all", false, "Show all tc rules on the system (ignores config file)")
 	statusCmd.Flags().BoolVar(&showStats, "stats", false, "Show statistics (packet counts, byte counts)")
 	statusCmd.Flags().BoolVar(&showSummary, "summary", false, "Show summarized statistics (parsed and formatted)")
+	statusCmd.Flags().BoolVar(&showActions, "actions", false, "Show each filter's parsed actions, including rewrite details")
+	statusCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to query tc: exec (tc binary) or netlink")
+	statusCmd.Flags().StringVar(&socketPath, "socket", "", "Ask the daemon listening on this Unix socket instead (--socket alone uses "+defaultSocketPath+")")
+	statusCmd.Flags().Lookup("socket").NoOptDefVal = defaultSocketPath
 }
 
 func status(cmd *cobra.Command, args []string) {
+	if socketPath != "" {
+		requireNoConfig(args)
+		var st daemonStatus
+		if err := callDaemon(socketPath, "GET", "/status", &st); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		printDaemonStatus(os.Stdout, st)
+		return
+	}
+
 	runner := tc.NewRunner(false, false)
 
 	// If --all flag is set, show all tc rules on the system
@@ -65,31 +80,48 @@ func status(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	// Parsed state comes from the selected backend; raw listings always use tc
+	backend, err := tc.NewBackend(backendName, false, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// If --summary flag is set, show simple per-rule statistics
 	if showSummary {
-		fmt.Printf("%-30s  %-20s  %-20s  %10s  %s\n", "Name", "SrcIntf", "DstIntf", "Packets", "Bytes")
-		for _, rule := range cfg.Rules {
-			totalPackets, totalBytes := getRuleStats(runner, rule)
-			fmt.Printf("%-30s  %-20s  %-20s  %10d  %s\n", rule.Name, rule.SrcIntf, rule.DstIntf, totalPackets, tc.FormatBytes(totalBytes))
-		}
+		printSummary(os.Stdout, backend, cfg)
 		return
 	}
 
 	fmt.Printf("=== TC Status for Configuration: %s ===\n\n", configFile)
 
-	// Collect unique source interfaces from rules
-	srcInterfaceSet := make(map[string]bool)
+	// Collect unique source interfaces from rules and the hooks their rules use
+	var srcInterfaces []string
+	srcInterfaceHooks := make(map[string]map[string]bool)
 	for _, rule := range cfg.Rules {
-		srcInterfaceSet[rule.SrcIntf] = true
+		if srcInterfaceHooks[rule.SrcIntf] == nil {
+			srcInterfaceHooks[rule.SrcIntf] = make(map[string]bool)
+			srcInterfaces = append(srcInterfaces, rule.SrcIntf)
+		}
+		for _, hook := range rule.Hooks() {
+			srcInterfaceHooks[rule.SrcIntf][hook] = true
+		}
 	}
 
 	// Show status for each source interface
-	for srcIntf := range srcInterfaceSet {
-		fmt.Printf("Interface: %s (direction: ingress)\n", srcIntf)
+	for _, srcIntf := range srcInterfaces {
+		var hooks []string
+		for _, hook := range []string{"ingress", "egress"} {
+			if srcInterfaceHooks[srcIntf][hook] {
+				hooks = append(hooks, hook)
+			}
+		}
+
+		fmt.Printf("Interface: %s (direction: %s)\n", srcIntf, strings.Join(hooks, ", "))
 		fmt.Println(strings.Repeat("-", 60))
 
 		// Check if interface has clsact qdisc
-		hasClsact, err := runner.HasClsactQdisc(srcIntf)
+		hasClsact, err := backend.HasClsactQdisc(srcIntf)
 		if err != nil {
 			fmt.Printf("  Error checking qdisc: %v\n\n", err)
 			continue
@@ -121,166 +153,133 @@ func status(cmd *cobra.Command, args []string) {
 		}
 		fmt.Println()
 
-		// Show filters for ingress direction
-		hook := "ingress"
-		fmt.Printf("  Filters (%s):\n", hook)
-
-		if showSummary {
-			// Parse and show summarized statistics
-			output, err := runner.ListFiltersWithStats(srcIntf, hook)
-			if err != nil {
-				fmt.Printf("    Error: %v\n", err)
-				fmt.Println()
-				continue
-			}
+		// Show filters for each hook used by the rules
+		for _, hook := range hooks {
+			fmt.Printf("  Filters (%s):\n", hook)
 
-			filters, parseErr := tc.ParseFilterStats(output)
-			if parseErr != nil {
-				fmt.Printf("    Error parsing filter stats: %v\n", parseErr)
+			if showActions {
+				filters, err := backend.ListFilterStats(srcIntf, hook)
+				if err != nil {
+					fmt.Printf("    Error: %v\n", err)
+				} else {
+					printFilterActions(os.Stdout, filters)
+				}
 				fmt.Println()
-				continue
-			}
-
-			if len(filters) == 0 {
-				fmt.Printf("    (no filters)\n")
 			} else {
-				var totalPackets, totalBytes int64
-				for _, filter := range filters {
-					desc := filter.GetMatchDescription()
-					fmt.Printf("    %-20s", desc)
-
-					if len(filter.Actions) > 0 {
-						action := filter.Actions[0]
-						fmt.Printf("→ %-8s  ", action.TargetDev)
-						fmt.Printf("Packets: %-8d  Bytes: %-12s", action.Packets, tc.FormatBytes(action.Bytes))
-						if action.Dropped > 0 {
-							fmt.Printf("  Dropped: %d", action.Dropped)
-						}
-						totalPackets += action.Packets
-						totalBytes += action.Bytes
-					}
-					fmt.Println()
-				}
-
-				if len(filters) > 1 {
-					fmt.Printf("\n    %-20s  %-8s  Packets: %-8d  Bytes: %-12s\n",
-						"TOTAL", "", totalPackets, tc.FormatBytes(totalBytes))
+				// Show raw tc output
+				var filters string
+				if showStats {
+					filters, err = runner.ListFiltersWithStats(srcIntf, hook)
+				} else {
+					filters, err = runner.ListFilters(srcIntf, hook)
 				}
-			}
-			fmt.Println()
-		} else {
-			// Show raw tc output
-			var filters string
-			if showStats {
-				filters, err = runner.ListFiltersWithStats(srcIntf, hook)
-			} else {
-				filters, err = runner.ListFilters(srcIntf, hook)
-			}
 
-			if err != nil {
-				fmt.Printf("    Error: %v\n", err)
-			} else if strings.TrimSpace(filters) == "" {
-				fmt.Printf("    (no filters)\n")
-			} else {
-				for _, line := range strings.Split(strings.TrimSpace(filters), "\n") {
-					if line != "" {
-						fmt.Printf("    %s\n", line)
+				if err != nil {
+					fmt.Printf("    Error: %v\n", err)
+				} else if strings.TrimSpace(filters) == "" {
+					fmt.Printf("    (no filters)\n")
+				} else {
+					for _, line := range strings.Split(strings.TrimSpace(filters), "\n") {
+						if line != "" {
+							fmt.Printf("    %s\n", line)
+						}
 					}
 				}
+				fmt.Println()
 			}
-			fmt.Println()
+
 		}
 
 		fmt.Println()
 	}
 }
 
-// getRuleStats retrieves statistics for a specific rule by matching tc filters
-func getRuleStats(runner *tc.Runner, rule config.Rule) (int64, int64) {
-	var totalPackets, totalBytes int64
-
-	// Query filters for this rule's source interface
-	output, err := runner.ListFiltersWithStats(rule.SrcIntf, "ingress")
-	if err != nil {
-		return 0, 0
+// printSummary writes one line of packet and byte counters per rule and
+// destination interface.
+func printSummary(w io.Writer, backend tc.Backend, cfg *config.Config) {
+	fmt.Fprintf(w, "%-30s  %-20s  %-20s  %10s  %s\n", "Name", "SrcIntf", "DstIntf", "Packets", "Bytes")
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		for _, dst := range getRuleStats(backend, rule, priorities[i]) {
+			fmt.Fprintf(w, "%-30s  %-20s  %-20s  %10d  %s\n", rule.Name, rule.SrcIntf, dst.Intf, dst.Packets, tc.FormatBytes(dst.Bytes))
+		}
 	}
+}
 
-	tcFilters, parseErr := tc.ParseFilterStats(output)
-	if parseErr != nil {
-		return 0, 0
+// printFilterActions writes each filter's match followed by one line per
+// action, describing what it does and its counters.
+func printFilterActions(w io.Writer, filters []tc.FilterStats) {
+	if len(filters) == 0 {
+		fmt.Fprintf(w, "    (no filters)\n")
+		return
 	}
-
-	// For each filter in the rule's config
-	for _, ruleFilter := range rule.Filters {
-		// Try to match with tc filters
-		for _, tcFilter := range tcFilters {
-			if matchesFilter(tcFilter, ruleFilter, rule.DstIntf) {
-				// Sum up the action statistics for the matching target device only
-				// to avoid double counting when there are multiple actions (e.g., skbmod + mirred)
-				for _, action := range tcFilter.Actions {
-					if action.TargetDev == rule.DstIntf {
-						totalPackets += action.Packets
-						totalBytes += action.Bytes
-					}
-				}
+	for _, f := range filters {
+		fmt.Fprintf(w, "    pref %-6d %s\n", f.Priority, f.GetMatchDescription())
+		for _, action := range f.Actions {
+			fmt.Fprintf(w, "      %-50s  Packets: %-8d  Bytes: %s", action.Describe(), action.Packets, tc.FormatBytes(action.Bytes))
+			if action.Dropped > 0 {
+				fmt.Fprintf(w, "  Dropped: %d", action.Dropped)
 			}
+			fmt.Fprintln(w)
 		}
 	}
-
-	return totalPackets, totalBytes
 }
 
-// matchesFilter checks if a tc filter matches a rule filter configuration
-func matchesFilter(tcFilter tc.FilterStats, ruleFilter filter.Filter, dstIntf string) bool {
-	// Check ip_proto
-	if ruleFilter.IPProto != "" {
-		if proto, ok := tcFilter.Matches["ip_proto"]; !ok || proto != ruleFilter.IPProto {
-			return false
-		}
-	}
-
-	// Check src_ip
-	if ruleFilter.SrcIP != "" {
-		if srcIP, ok := tcFilter.Matches["src_ip"]; !ok || srcIP != ruleFilter.SrcIP {
-			return false
-		}
-	}
+// destStats holds the counters of a rule's mirred actions towards one
+// destination interface.
+type destStats struct {
+	Intf    string `json:"intf"`
+	Packets int64  `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+	Dropped int64  `json:"dropped"`
+}
 
-	// Check dst_ip
-	if ruleFilter.DstIP != "" {
-		if dstIP, ok := tcFilter.Matches["dst_ip"]; !ok || dstIP != ruleFilter.DstIP {
-			return false
-		}
+// getRuleStats retrieves statistics for a rule from the tc filters whose
+// action cookies name one of its filters, with one entry per destination
+// interface in config order. Filters installed without cookies are
+// attributed by the block of preferences the rule's priority owns.
+func getRuleStats(backend tc.Backend, rule config.Rule, priority int) []destStats {
+	stats := make([]destStats, len(rule.DstIntf))
+	index := make(map[string]int)
+	for i, dst := range rule.DstIntf {
+		stats[i].Intf = dst
+		index[dst] = i
 	}
-
-	// Check src_port
-	if ruleFilter.SrcPort != 0 {
-		if srcPort, ok := tcFilter.Matches["src_port"]; !ok || srcPort != strconv.Itoa(ruleFilter.SrcPort) {
-			return false
-		}
+	cookies := make(map[string]bool)
+	for i := range rule.Filters {
+		cookies[tc.FilterCookie(rule.Name, i)] = true
 	}
 
-	// Check dst_port
-	if ruleFilter.DstPort != 0 {
-		if dstPort, ok := tcFilter.Matches["dst_port"]; !ok || dstPort != strconv.Itoa(ruleFilter.DstPort) {
-			return false
+	// Query filters on every hook of this rule's source interface
+	for _, hook := range rule.Hooks() {
+		tcFilters, err := backend.ListFilterStats(rule.SrcIntf, hook)
+		if err != nil {
+			for i := range stats {
+				stats[i].Packets, stats[i].Bytes, stats[i].Dropped = 0, 0, 0
+			}
+			return stats
 		}
-	}
 
-	// Check destination interface (target device)
-	// Need to check all actions since there might be multiple actions (e.g., skbmod + mirred)
-	if dstIntf != "" {
-		found := false
-		for _, action := range tcFilter.Actions {
-			if action.TargetDev == dstIntf {
-				found = true
-				break
+		for _, tcFilter := range tcFilters {
+			if cookie := tcFilter.Cookie(); cookie != "" {
+				if !cookies[cookie] {
+					continue
+				}
+			} else if tc.RulePriority(tcFilter.Priority) != priority {
+				continue
+			}
+			// Sum up the action statistics per target device, which
+			// also skips rewrite actions (e.g., skbmod + mirred) and
+			// the pass actions of exclusions
+			for _, action := range tcFilter.Actions {
+				if i, ok := index[action.TargetDev]; ok && action.Type == "mirred" {
+					stats[i].Packets += action.Packets
+					stats[i].Bytes += action.Bytes
+					stats[i].Dropped += action.Dropped
+				}
 			}
-		}
-		if !found {
-			return false
 		}
 	}
 
-	return true
+	return stats
 }
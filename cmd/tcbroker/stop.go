@@ -9,12 +9,15 @@ import (
 	"tcbroker/pkg/tc"
 )
 
+var stopRule string
+
 var stopCmd = &cobra.Command{
 	Use:   "stop [config-file]",
 	Short: "Stops packet mirroring and cleans up tc rules.",
 	Long: `Reads the given YAML configuration file and removes all tc rules
-(qdiscs and filters) from the specified interfaces. This command requires root privileges.`,
-	Args: cobra.ExactArgs(1),
+(qdiscs and filters) from the specified interfaces. With --rule, only the
+filters of that rule are removed. This command requires root privileges.`,
+	Args: cobra.MaximumNArgs(1),
 	Run:  stop,
 }
 
@@ -22,10 +25,27 @@ func init() {
 	rootCmd.AddCommand(stopCmd)
 	stopCmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print tc commands")
 	stopCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry-run mode to print tc commands without executing them")
+	stopCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to program tc: exec (tc binary) or netlink")
+	stopCmd.Flags().StringVar(&stopRule, "rule", "", "Only remove the filters of the rule with this name")
+	stopCmd.Flags().StringVar(&socketPath, "socket", "", "Ask the daemon listening on this Unix socket instead (--socket alone uses "+defaultSocketPath+")")
+	stopCmd.Flags().Lookup("socket").NoOptDefVal = defaultSocketPath
 }
 
 func stop(cmd *cobra.Command, args []string) {
-	configFile := args[0]
+	if socketPath != "" {
+		requireNoConfig(args)
+		if stopRule != "" {
+			fmt.Println("Error: --rule is not supported with --socket")
+			os.Exit(1)
+		}
+		if err := callDaemon(socketPath, "POST", "/stop", nil); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Stopped")
+		return
+	}
+	configFile := requireConfig(args)
 
 	// In dry-run mode, we don't need root privileges
 	if !dryRun && os.Geteuid() != 0 {
@@ -40,11 +60,27 @@ func stop(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	// Initialize the tc runner
-	runner := tc.NewRunner(debug, dryRun)
+	// Initialize the tc backend
+	runner, err := tc.NewBackend(backendName, debug, dryRun)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Remove a single rule's filters if asked to
+	if stopRule != "" {
+		if err := tc.CleanupRule(runner, cfg, stopRule); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !debug && !dryRun {
+			fmt.Printf("Stopped rule '%s'\n", stopRule)
+		}
+		return
+	}
 
 	// Cleanup all tc rules for the interfaces in the config
-	if err := runner.Cleanup(cfg); err != nil {
+	if err := tc.Cleanup(runner, cfg); err != nil {
 		fmt.Printf("Error: cleanup failed: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/tc"
+)
+
+// Sort orders of the top command
+var topSortKeys = []string{"pps", "bps", "drops", "name"}
+
+var (
+	topInterval   time.Duration
+	topSort       string
+	topIterations int
+)
+
+var topCmd = &cobra.Command{
+	Use:   "top [config-file]",
+	Short: "Shows live packet and byte rates per rule.",
+	Long: `Polls the filters of the rules in the given YAML configuration file and
+shows the packets and bits per second since the previous poll, per rule and
+destination interface and per filter. Rows whose actions dropped packets
+during the interval are highlighted.`,
+	Args: cobra.ExactArgs(1),
+	Run:  top,
+}
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+	topCmd.Flags().DurationVarP(&topInterval, "interval", "i", 2*time.Second, "Time between polls")
+	topCmd.Flags().StringVarP(&topSort, "sort", "s", "pps", "Sort rules and filters by pps, bps, drops or name")
+	topCmd.Flags().IntVarP(&topIterations, "iterations", "n", 0, "Number of updates before exiting (0 = until interrupted)")
+	topCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to query tc: exec (tc binary) or netlink")
+}
+
+func top(cmd *cobra.Command, args []string) {
+	if !slices.Contains(topSortKeys, topSort) {
+		fmt.Printf("Error: invalid sort order '%s' (expected pps, bps, drops or name)\n", topSort)
+		os.Exit(1)
+	}
+	if topInterval <= 0 {
+		fmt.Printf("Error: invalid interval %s\n", topInterval)
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(args[0])
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+
+	backend, err := tc.NewBackend(backendName, false, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Clear the screen between updates only when a person is watching
+	color := isTerminal(os.Stdout)
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+
+	prev := takeTopSample(backend, cfg, time.Now())
+	for n := 0; topIterations == 0 || n < topIterations; n++ {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+
+		cur := takeTopSample(backend, cfg, now)
+		rules := topRates(prev, cur)
+		sortTopRules(rules, topSort)
+		if color {
+			fmt.Print("\033[H\033[2J")
+		} else if n > 0 {
+			fmt.Println()
+		}
+		printTop(os.Stdout, rules, cur.Time.Sub(prev.Time), topSort, color)
+		prev = cur
+	}
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// filterStats holds the counters of the tc filters installed for one filter
+// of a rule, leaving out its exclusions.
+type filterStats struct {
+	Match   string // match of the first tc filter, e.g. "TCP dport=80"
+	Packets int64
+	Bytes   int64
+	Dropped int64
+}
+
+// getFilterStats retrieves statistics for each filter of a rule from the tc
+// filters whose action cookies name it, in config order. The first action
+// of a tc filter counts its hits; drops are summed over all its actions.
+func getFilterStats(backend tc.Backend, rule config.Rule) []filterStats {
+	stats := make([]filterStats, len(rule.Filters))
+	index := make(map[string]int)
+	for i := range rule.Filters {
+		index[tc.FilterCookie(rule.Name, i)] = i
+	}
+
+	for _, hook := range rule.Hooks() {
+		tcFilters, err := backend.ListFilterStats(rule.SrcIntf, hook)
+		if err != nil {
+			continue
+		}
+		for _, tcFilter := range tcFilters {
+			i, ok := index[tcFilter.Cookie()]
+			// Exclusions share the cookie of their filter but only pass
+			if !ok || len(tcFilter.Actions) == 0 || tcFilter.Actions[0].Type == "gact" {
+				continue
+			}
+			if stats[i].Match == "" {
+				stats[i].Match = tcFilter.GetMatchDescription()
+			}
+			stats[i].Packets += tcFilter.Actions[0].Packets
+			stats[i].Bytes += tcFilter.Actions[0].Bytes
+			for _, action := range tcFilter.Actions {
+				stats[i].Dropped += action.Dropped
+			}
+		}
+	}
+	return stats
+}
+
+// pollBackend lists the filters of each hook once per poll, however many
+// rules share it.
+type pollBackend struct {
+	tc.Backend
+	filters map[string][]tc.FilterStats
+	errs    map[string]error
+}
+
+// ListFilterStats returns the filters of the hook as first listed.
+func (b *pollBackend) ListFilterStats(iface, hook string) ([]tc.FilterStats, error) {
+	key := iface + "/" + hook
+	if filters, ok := b.filters[key]; ok {
+		return filters, b.errs[key]
+	}
+	filters, err := b.Backend.ListFilterStats(iface, hook)
+	b.filters[key], b.errs[key] = filters, err
+	return filters, err
+}
+
+// topSample is one poll of the counters of every rule, in config order.
+type topSample struct {
+	Time  time.Time
+	Rules []topRuleSample
+}
+
+// topRuleSample holds the counters of a rule per destination and per filter.
+type topRuleSample struct {
+	Name    string
+	Dests   []destStats
+	Filters []filterStats
+}
+
+// takeTopSample polls the counters of every rule of cfg.
+func takeTopSample(backend tc.Backend, cfg *config.Config, now time.Time) topSample {
+	poll := &pollBackend{Backend: backend, filters: make(map[string][]tc.FilterStats), errs: make(map[string]error)}
+	sample := topSample{Time: now}
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		sample.Rules = append(sample.Rules, topRuleSample{
+			Name:    rule.Name,
+			Dests:   getRuleStats(poll, rule, priorities[i]),
+			Filters: getFilterStats(poll, rule),
+		})
+	}
+	return sample
+}
+
+// topRate is the traffic of a destination or filter during one interval.
+type topRate struct {
+	Label   string  // destination interface or filter match
+	PPS     float64 // packets per second
+	BPS     float64 // bits per second
+	Drops   float64 // drops per second
+	Packets int64   // packets since the filter was installed
+}
+
+// topRule holds the rates of a rule per destination and per filter.
+type topRule struct {
+	Name    string
+	Dests   []topRate
+	Filters []topRate
+}
+
+// Peak returns the rate of the rule's busiest destination, which sorts it.
+func (r *topRule) Peak() topRate {
+	var peak topRate
+	for _, d := range r.Dests {
+		peak.PPS = max(peak.PPS, d.PPS)
+		peak.BPS = max(peak.BPS, d.BPS)
+		peak.Drops = max(peak.Drops, d.Drops)
+	}
+	return peak
+}
+
+// topRates computes the rates between two samples of the same config.
+func topRates(prev, cur topSample) []topRule {
+	seconds := cur.Time.Sub(prev.Time).Seconds()
+	rules := make([]topRule, len(cur.Rules))
+	for i, rule := range cur.Rules {
+		rules[i].Name = rule.Name
+		for j, d := range rule.Dests {
+			var before destStats
+			if i < len(prev.Rules) && j < len(prev.Rules[i].Dests) {
+				before = prev.Rules[i].Dests[j]
+			}
+			rate := newTopRate(before.Packets, d.Packets, before.Bytes, d.Bytes, before.Dropped, d.Dropped, seconds)
+			rate.Label = d.Intf
+			rules[i].Dests = append(rules[i].Dests, rate)
+		}
+		for j, f := range rule.Filters {
+			var before filterStats
+			if i < len(prev.Rules) && j < len(prev.Rules[i].Filters) {
+				before = prev.Rules[i].Filters[j]
+			}
+			rate := newTopRate(before.Packets, f.Packets, before.Bytes, f.Bytes, before.Dropped, f.Dropped, seconds)
+			rate.Label = f.Match
+			if rate.Label == "" {
+				rate.Label = fmt.Sprintf("filter #%d (not installed)", j+1)
+			}
+			rules[i].Filters = append(rules[i].Filters, rate)
+		}
+	}
+	return rules
+}
+
+// newTopRate computes per-second rates from counters before and after an
+// interval. A counter that went down belongs to a reinstalled filter and
+// counts from zero.
+func newTopRate(packets0, packets, bytes0, bytes, dropped0, dropped int64, seconds float64) topRate {
+	rate := topRate{Packets: packets}
+	if seconds <= 0 {
+		return rate
+	}
+	delta := func(before, after int64) float64 {
+		if after < before {
+			return float64(after)
+		}
+		return float64(after - before)
+	}
+	rate.PPS = delta(packets0, packets) / seconds
+	rate.BPS = delta(bytes0, bytes) * 8 / seconds
+	rate.Drops = delta(dropped0, dropped) / seconds
+	return rate
+}
+
+// sortTopRules orders the rules, and the filters of each rule, by key:
+// busiest first for rates and drops, alphabetically for name.
+func sortTopRules(rules []topRule, key string) {
+	less := func(a, b topRate) bool {
+		switch key {
+		case "bps":
+			return a.BPS > b.BPS
+		case "drops":
+			return a.Drops > b.Drops
+		case "name":
+			return a.Label < b.Label
+		}
+		return a.PPS > b.PPS
+	}
+	for i := range rules {
+		filters := rules[i].Filters
+		sort.SliceStable(filters, func(a, b int) bool { return less(filters[a], filters[b]) })
+	}
+	sort.SliceStable(rules, func(a, b int) bool {
+		if key == "name" {
+			return rules[a].Name < rules[b].Name
+		}
+		return less(rules[a].Peak(), rules[b].Peak())
+	})
+}
+
+// printTop writes one frame of the top view. Rows that dropped packets are
+// shown in red when color is set and marked with a trailing "!" otherwise.
+func printTop(w io.Writer, rules []topRule, interval time.Duration, key string, color bool) {
+	fmt.Fprintf(w, "tcbroker top - %s interval, sorted by %s\n\n", interval.Round(time.Millisecond), key)
+	fmt.Fprintf(w, "%-40s  %-12s  %10s  %12s  %8s  %12s\n", "Rule / Filter", "DstIntf", "Pkts/s", "Bits/s", "Drops/s", "Packets")
+
+	row := func(name, dst string, rate topRate) {
+		line := fmt.Sprintf("%-40s  %-12s  %10.1f  %12s  %8.1f  %12d", name, dst, rate.PPS, formatBitRate(rate.BPS), rate.Drops, rate.Packets)
+		switch {
+		case rate.Drops > 0 && color:
+			line = "\033[1;31m" + line + "\033[0m"
+		case rate.Drops > 0:
+			line += "  !"
+		}
+		fmt.Fprintln(w, line)
+	}
+	for _, rule := range rules {
+		for i, dst := range rule.Dests {
+			name := ""
+			if i == 0 {
+				name = rule.Name
+			}
+			row(name, dst.Label, dst)
+		}
+		for _, f := range rule.Filters {
+			row("  "+f.Label, "", f)
+		}
+	}
+}
+
+// formatBitRate renders bits per second with a decimal prefix, e.g.
+// "1.5 Mbit".
+func formatBitRate(bps float64) string {
+	units := []string{"bit", "Kbit", "Mbit", "Gbit", "Tbit"}
+	i := 0
+	for ; bps >= 1000 && i < len(units)-1; i++ {
+		bps /= 1000
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", bps, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", bps, units[i])
+}
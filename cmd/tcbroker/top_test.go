@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+	"tcbroker/pkg/tc"
+)
+
+func TestTopRates(t *testing.T) {
+	cfg := &config.Config{
+		Rules: []config.Rule{
+			{Name: "web", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1"}, Filters: []filter.Filter{
+				{IPProto: "tcp", DstPort: filter.Port(80)},
+				{IPProto: "tcp", DstPort: filter.Port(443)},
+			}},
+			{Name: "dns", SrcIntf: "eth0", DstIntf: config.Interfaces{"eth1", "eth2"}, Filters: []filter.Filter{
+				{IPProto: "udp", DstPort: filter.Port(53)},
+			}},
+		},
+	}
+	backend := tc.NewFakeBackend()
+	if err := applyConfig(backend, cfg); err != nil {
+		t.Fatalf("applyConfig failed: %v", err)
+	}
+	start := time.Unix(1000, 0)
+	backend.Count("eth0", "ingress", 0, 100, 10000)
+	prev := takeTopSample(backend, cfg, start)
+
+	// Over two seconds web's first filter sees 20 more packets and dns
+	// 400, of which eth2's mirred action drops 10
+	backend.Count("eth0", "ingress", 0, 20, 2000)
+	backend.Count("eth0", "ingress", 2, 400, 40000)
+	backend.Filters[tc.FakeKey("eth0", "ingress")][2].Actions[1].Dropped = 10
+	cur := takeTopSample(backend, cfg, start.Add(2*time.Second))
+
+	rules := topRates(prev, cur)
+	sortTopRules(rules, "pps")
+	if rules[0].Name != "dns" || rules[1].Name != "web" {
+		t.Fatalf("Expected dns to sort before web, got %s, %s", rules[0].Name, rules[1].Name)
+	}
+	web := rules[1]
+	if got := web.Dests[0]; got.PPS != 10 || got.BPS != 8000 || got.Packets != 120 {
+		t.Errorf("Expected web to eth1 at 10 pps and 8000 bps, got %+v", got)
+	}
+	if got := web.Filters[0]; got.Label != "TCP dport=80" || got.PPS != 10 {
+		t.Errorf("Expected the port 80 filter first at 10 pps, got %+v", got)
+	}
+	if got := web.Filters[1]; got.PPS != 0 {
+		t.Errorf("Expected the idle port 443 filter last, got %+v", got)
+	}
+	dns := rules[0]
+	if dns.Dests[1].Drops != 5 || dns.Filters[0].Drops != 5 {
+		t.Errorf("Expected 5 drops/s on eth2 and the filter, got %+v and %+v", dns.Dests[1], dns.Filters[0])
+	}
+
+	var out bytes.Buffer
+	printTop(&out, rules, 2*time.Second, "pps", false)
+	for _, want := range []string{
+		"tcbroker top - 2s interval, sorted by pps",
+		"dns                                       eth1               200.0    160.0 Kbit       0.0           400\n",
+		"                                          eth2               200.0    160.0 Kbit       5.0           400  !\n",
+		"  TCP dport=80                                                10.0      8.0 Kbit       0.0           120\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected top to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	sortTopRules(rules, "name")
+	if rules[0].Name != "dns" || rules[1].Filters[0].Label != "TCP dport=443" {
+		t.Errorf("Expected rules and filters in name order, got %+v", rules)
+	}
+}
+
+func TestTopRatesCounterReset(t *testing.T) {
+	rate := newTopRate(500, 30, 50000, 3000, 0, 0, 3)
+	if rate.PPS != 10 || rate.BPS != 8000 {
+		t.Errorf("Expected a reinstalled filter to count from zero, got %+v", rate)
+	}
+}
+
+func TestFormatBitRate(t *testing.T) {
+	for bps, want := range map[float64]string{
+		0:       "0 bit",
+		999:     "999 bit",
+		1500:    "1.5 Kbit",
+		2.5e9:   "2.5 Gbit",
+		1234567: "1.2 Mbit",
+	} {
+		if got := formatBitRate(bps); got != want {
+			t.Errorf("formatBitRate(%v) = %s, want %s", bps, got, want)
+		}
+	}
+}
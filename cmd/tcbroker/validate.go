@@ -48,7 +48,8 @@ func validate(cmd *cobra.Command, args []string) {
 		fmt.Printf("\n  Rule #%d (%s):\n", i+1, rule.Name)
 		fmt.Printf("    Source Interface: %s\n", rule.SrcIntf)
 		fmt.Printf("    Destination Interface: %s\n", rule.DstIntf)
-		fmt.Printf("    Action: mirror\n")
+		fmt.Printf("    Direction: %s\n", rule.GetDirection())
+		fmt.Printf("    Action: %s (%s of %s)\n", rule.GetAction(), rule.Mirred().GetHook(), rule.DstIntf)
 		if rule.Rewrite != nil {
 			fmt.Printf("    Rewrite:\n")
 			if rule.Rewrite.DstMAC != "" {
@@ -65,8 +66,13 @@ func validate(cmd *cobra.Command, args []string) {
 			}
 		}
 		fmt.Printf("    Filters: %d\n", len(rule.Filters))
+		if len(rule.Exclude) > 0 {
+			fmt.Printf("    Excludes: %d\n", len(rule.Exclude))
+		}
 	}
 
+	printWarnings(cfg)
+
 	// Optionally check if interfaces exist on the system
 	if checkInterfaces {
 		fmt.Printf("\nChecking network interfaces...\n")
@@ -76,7 +82,9 @@ func validate(cmd *cobra.Command, args []string) {
 		interfaceSet := make(map[string]bool)
 		for _, rule := range cfg.Rules {
 			interfaceSet[rule.SrcIntf] = true
-			interfaceSet[rule.DstIntf] = true
+			for _, dst := range rule.DstIntf {
+				interfaceSet[dst] = true
+			}
 		}
 
 		// Check each unique interface
@@ -97,3 +105,15 @@ func validate(cmd *cobra.Command, args []string) {
 
 	fmt.Printf("\n✓ Configuration is valid and ready to use!\n")
 }
+
+// printWarnings prints the configuration's warnings, if any.
+func printWarnings(cfg *config.Config) {
+	warnings := cfg.Warnings()
+	if len(warnings) == 0 {
+		return
+	}
+	fmt.Println()
+	for _, w := range warnings {
+		fmt.Printf("⚠ Warning: %s\n", w)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"tcbroker/pkg/tc"
+)
+
+var (
+	watchInterval time.Duration
+	watchHeal     bool
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [config-file]",
+	Short: "Watches the installed tc rules for drift from a config file.",
+	Long: `Periodically compares the qdiscs and filters installed on the host with the
+given YAML configuration file and logs every difference, such as filters
+flushed by a driver reload or a CNI restart. With --heal, missing qdiscs and
+filters are reinstalled and stale ones removed. The daemon runs the same
+check with --watch-interval.`,
+	Args: cobra.ExactArgs(1),
+	Run:  watch,
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 30*time.Second, "Time between checks")
+	watchCmd.Flags().BoolVar(&watchHeal, "heal", false, "Reinstall missing qdiscs and filters and remove stale ones")
+	watchCmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print tc commands")
+	watchCmd.Flags().StringVar(&backendName, "backend", tc.BackendExec, "Backend used to program tc: exec (tc binary) or netlink")
+}
+
+func watch(cmd *cobra.Command, args []string) {
+	if watchHeal && os.Geteuid() != 0 {
+		fmt.Println("Error: --heal requires root privileges.")
+		os.Exit(1)
+	}
+	if watchInterval <= 0 {
+		fmt.Printf("Error: invalid interval %s\n", watchInterval)
+		os.Exit(1)
+	}
+
+	backend, err := tc.NewBackend(backendName, debug, false)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	d, err := newDaemon(args[0], backend)
+	if err != nil {
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+	// The config is expected to be installed already, e.g. by start
+	d.active = true
+	d.heal = watchHeal
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.logger.Printf("Watching %s every %s", args[0], watchInterval)
+	d.watch(ctx, watchInterval)
+}
+
+// driftStats counts the differences the drift check found between the
+// configuration and the host, and how many of them it repaired.
+type driftStats struct {
+	Checks    int64     `json:"checks"`
+	Events    int64     `json:"events"`
+	Healed    int64     `json:"healed"`
+	LastDrift time.Time `json:"last_drift,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// watch checks for drift every interval until ctx is done.
+func (d *daemon) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.checkDrift()
+		}
+	}
+}
+
+// checkDrift compares the host with the configuration while it is applied,
+// logs and counts every difference and, with heal set, repairs them.
+func (d *daemon) checkDrift() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active {
+		return
+	}
+
+	d.drift.Checks++
+	ready, pending := readyRules(d.cfg, d.linkExists)
+	d.pending = pending
+	plan, err := tc.ComputePlan(d.backend, ready)
+	if err != nil {
+		d.drift.LastError = err.Error()
+		d.logger.Printf("Drift check failed: %v", err)
+		return
+	}
+	d.drift.LastError = ""
+	if !plan.HasChanges() {
+		return
+	}
+
+	events := int64(len(plan.Qdiscs) + plan.Count(tc.PlanAdd) + plan.Count(tc.PlanRemove))
+	d.drift.Events += events
+	d.drift.LastDrift = time.Now()
+	for _, iface := range plan.Qdiscs {
+		d.logger.Printf("Drift: clsact qdisc missing on %s", iface)
+	}
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		switch c.Action {
+		case tc.PlanAdd:
+			d.logger.Printf("Drift: filter of rule '%s' missing on %s (%s): pref %d %s", c.Desired.Rule, c.Iface, c.Hook, c.Pref(), c.Match())
+		case tc.PlanRemove:
+			d.logger.Printf("Drift: unexpected filter on %s (%s): pref %d %s", c.Iface, c.Hook, c.Pref(), c.Match())
+		}
+	}
+
+	if !d.heal {
+		return
+	}
+	if err := tc.ApplyPlan(d.backend, plan); err != nil {
+		d.drift.LastError = err.Error()
+		d.logger.Printf("Failed to heal drift: %v", err)
+		return
+	}
+	d.drift.Healed += events
+	d.logger.Printf("Healed: %d added, %d removed", plan.Count(tc.PlanAdd), plan.Count(tc.PlanRemove))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"tcbroker/pkg/tc"
+)
+
+func TestCheckDrift(t *testing.T) {
+	d, backend, _ := serveDaemon(t, daemonConfig)
+	var logs bytes.Buffer
+	d.logger = log.New(&logs, "", 0)
+
+	// Nothing is checked before the config is applied
+	d.checkDrift()
+	if d.drift.Checks != 0 {
+		t.Errorf("Expected no check while stopped, got %+v", d.drift)
+	}
+	if _, err := d.start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	d.checkDrift()
+	if d.drift.Checks != 1 || d.drift.Events != 0 {
+		t.Errorf("Expected a clean check, got %+v", d.drift)
+	}
+
+	// Something flushes eth2
+	delete(backend.Qdiscs, "eth2")
+	delete(backend.Filters, tc.FakeKey("eth2", "ingress"))
+	d.checkDrift()
+	if d.drift.Events != 2 || d.drift.Healed != 0 || d.drift.LastDrift.IsZero() {
+		t.Errorf("Expected 2 drift events, got %+v", d.drift)
+	}
+	for _, want := range []string{
+		"Drift: clsact qdisc missing on eth2",
+		"Drift: filter of rule 'dns' missing on eth2 (ingress): pref 30100 UDP dport=53",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected log to contain %q, got:\n%s", want, logs.String())
+		}
+	}
+	if backend.Qdiscs["eth2"] {
+		t.Error("Expected drift to be left alone without heal")
+	}
+
+	d.heal = true
+	d.checkDrift()
+	if d.drift.Events != 4 || d.drift.Healed != 2 {
+		t.Errorf("Expected the drift to be healed, got %+v", d.drift)
+	}
+	if !backend.Qdiscs["eth2"] || len(backend.Filters[tc.FakeKey("eth2", "ingress")]) != 1 {
+		t.Errorf("Expected dns to be reinstalled on eth2, got %v", backend.Filters)
+	}
+	d.checkDrift()
+	if d.drift.Events != 4 {
+		t.Errorf("Expected no drift after healing, got %+v", d.drift)
+	}
+
+	var out strings.Builder
+	printDaemonStatus(&out, d.status())
+	if !strings.Contains(out.String(), "Drift: 4 event(s) in 4 check(s), 2 healed") {
+		t.Errorf("Expected status to report drift, got:\n%s", out.String())
+	}
+}
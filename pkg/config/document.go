@@ -0,0 +1,149 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Document is a configuration file as its YAML node tree, so rules can be
+// added and removed while the comments of the file are kept.
+type Document struct {
+	root  yaml.Node
+	rules *yaml.Node // the sequence of rules
+}
+
+// ParseDocument parses the YAML of a configuration file.
+func ParseDocument(data []byte) (*Document, error) {
+	d := &Document{}
+	if err := yaml.Unmarshal(data, &d.root); err != nil {
+		return nil, fmt.Errorf("failed to parse config data: %w", err)
+	}
+	if len(d.root.Content) == 0 || d.root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config data is not a mapping")
+	}
+	top := d.root.Content[0]
+	if d.rules = mappingValue(top, "rules"); d.rules == nil {
+		d.rules = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		top.Style &^= yaml.FlowStyle
+		top.Content = append(top.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rules"}, d.rules)
+	}
+	if d.rules.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: rules must be a list", d.rules.Line)
+	}
+	return d, nil
+}
+
+// AddRule appends rule to the rules of the document.
+func (d *Document) AddRule(rule Rule) error {
+	var node yaml.Node
+	if err := node.Encode(rule); err != nil {
+		return fmt.Errorf("failed to encode rule '%s': %w", rule.Name, err)
+	}
+	d.rules.Content = append(d.rules.Content, &node)
+	d.rules.Style &^= yaml.FlowStyle
+	return nil
+}
+
+// RemoveRule removes the named rule from the document. It reports whether
+// the document had one.
+func (d *Document) RemoveRule(name string) bool {
+	for i, node := range d.rules.Content {
+		if ruleName(node) == name {
+			d.rules.Content = append(d.rules.Content[:i], d.rules.Content[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetPriority sets the priority of the named rule. It reports whether the
+// document has the rule.
+func (d *Document) SetPriority(name string, priority int) bool {
+	for _, node := range d.rules.Content {
+		if ruleName(node) != name {
+			continue
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(priority)}
+		if old := mappingValue(node, "priority"); old != nil {
+			*old = *value
+			return true
+		}
+		// Right after the name, where it is easy to spot
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "priority"}
+		node.Content = append(node.Content[:2], append([]*yaml.Node{key, value}, node.Content[2:]...)...)
+		return true
+	}
+	return false
+}
+
+// Bytes returns the YAML of the document, indented like the examples.
+func (d *Document) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&d.root); err != nil {
+		return nil, fmt.Errorf("failed to encode config data: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode config data: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile replaces the file at path with data, keeping its mode. The data
+// is written to a temporary file that is renamed over path, so readers never
+// see a partial file.
+func WriteFile(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// ruleName returns the name of a rule node, or "" if it has none.
+func ruleName(node *yaml.Node) string {
+	if name := mappingValue(node, "name"); name != nil && name.Kind == yaml.ScalarNode {
+		return name.Value
+	}
+	return ""
+}
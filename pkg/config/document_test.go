@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tcbroker/pkg/filter"
+)
+
+func TestDocumentEditsKeepComments(t *testing.T) {
+	doc, err := ParseDocument([]byte(`# Mirrors for the IDS
+rules:
+  # Web traffic
+  - name: web
+    src_intf: eth0
+    dst_intf: [ids0]
+    filters:
+      - ip_proto: tcp # plain HTTP only
+        dst_port: 80
+  - name: dns
+    src_intf: eth0
+    dst_intf: ids0
+    filters:
+      - ip_proto: udp
+        dst_port: 53
+`))
+	if err != nil {
+		t.Fatalf("ParseDocument() error = %v", err)
+	}
+	if !doc.RemoveRule("web") || doc.RemoveRule("web") {
+		t.Error("Expected web to be removed once")
+	}
+	if !doc.SetPriority("dns", 2) || doc.SetPriority("web", 1) {
+		t.Error("Expected the priority of dns only to be set")
+	}
+	if err := doc.AddRule(Rule{Name: "ssh", SrcIntf: "eth1", DstIntf: Interfaces{"ids0"}, Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(22)}}}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+
+	data, err := doc.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() error = %v", err)
+	}
+	expected := `# Mirrors for the IDS
+rules:
+  - name: dns
+    priority: 2
+    src_intf: eth0
+    dst_intf: ids0
+    filters:
+      - ip_proto: udp
+        dst_port: 53
+  - name: ssh
+    src_intf: eth1
+    dst_intf:
+      - ids0
+    filters:
+      - ip_proto: tcp
+        dst_port: 22
+`
+	if string(data) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, data)
+	}
+	if _, err := Parse(data); err != nil {
+		t.Errorf("Expected the edited document to be a valid config, got %v", err)
+	}
+}
+
+func TestParseDocumentRejectsBadRules(t *testing.T) {
+	for _, input := range []string{"- a\n- b\n", "rules: web\n"} {
+		if _, err := ParseDocument([]byte(input)); err == nil {
+			t.Errorf("Expected %q to be rejected", input)
+		}
+	}
+	doc, err := ParseDocument([]byte("# nothing yet\n{}\n"))
+	if err != nil {
+		t.Fatalf("ParseDocument() error = %v", err)
+	}
+	if err := doc.AddRule(Rule{Name: "web"}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if data, _ := doc.Bytes(); string(data) == "" {
+		t.Error("Expected the rule to be written")
+	}
+}
+
+func TestWriteFileKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("old"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("new")); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	info, _ := os.Stat(path)
+	if string(data) != "new" || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected new content with mode 0640, got %q with %o", data, info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected no temporary file left behind, got %d entries", len(entries))
+	}
+}
@@ -13,9 +13,13 @@ func Load(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
 	}
+	return Parse(data)
+}
 
+// Parse unmarshals and validates the YAML of a configuration file.
+func Parse(data []byte) (*Config, error) {
 	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
+	err := yaml.Unmarshal(data, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config data: %w", err)
 	}
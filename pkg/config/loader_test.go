@@ -22,7 +22,7 @@ func TestLoad(t *testing.T) {
 
   - name: dns-mirror
     src_intf: eth0
-    dst_intf: eth1
+    dst_intf: [eth1, eth2]
     filters:
       - ip_proto: udp
         dst_port: 53
@@ -35,6 +35,9 @@ func TestLoad(t *testing.T) {
     filters:
       - ip_proto: tcp
         dst_port: 443
+      - ip_proto: tcp
+        src_port: 32768-60999
+        dst_port: [80, 443, "8000-8100"]
 `
 
 	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
@@ -59,8 +62,8 @@ func TestLoad(t *testing.T) {
 	if rule1.SrcIntf != "eth0" {
 		t.Errorf("Expected rule1 src_intf 'eth0', got '%s'", rule1.SrcIntf)
 	}
-	if rule1.DstIntf != "eth1" {
-		t.Errorf("Expected rule1 dst_intf 'eth1', got '%s'", rule1.DstIntf)
+	if len(rule1.DstIntf) != 1 || rule1.DstIntf[0] != "eth1" {
+		t.Errorf("Expected rule1 dst_intf [eth1], got %v", rule1.DstIntf)
 	}
 	if len(rule1.Filters) != 1 {
 		t.Fatalf("Expected 1 filter in rule1, got %d", len(rule1.Filters))
@@ -73,8 +76,8 @@ func TestLoad(t *testing.T) {
 	if filter1.SrcIP != "192.168.1.0/24" {
 		t.Errorf("Expected filter1 src_ip '192.168.1.0/24', got '%s'", filter1.SrcIP)
 	}
-	if filter1.DstPort != 80 {
-		t.Errorf("Expected filter1 dst_port 80, got %d", filter1.DstPort)
+	if filter1.DstPort.String() != "80" {
+		t.Errorf("Expected filter1 dst_port 80, got %s", filter1.DstPort)
 	}
 
 	// Check second rule (DNS mirror)
@@ -82,13 +85,16 @@ func TestLoad(t *testing.T) {
 	if rule2.Name != "dns-mirror" {
 		t.Errorf("Expected rule2 name 'dns-mirror', got '%s'", rule2.Name)
 	}
+	if len(rule2.DstIntf) != 2 || rule2.DstIntf[0] != "eth1" || rule2.DstIntf[1] != "eth2" {
+		t.Errorf("Expected rule2 dst_intf [eth1 eth2], got %v", rule2.DstIntf)
+	}
 
 	filter2 := rule2.Filters[0]
 	if filter2.IPProto != "udp" {
 		t.Errorf("Expected filter2 ip_proto 'udp', got '%s'", filter2.IPProto)
 	}
-	if filter2.DstPort != 53 {
-		t.Errorf("Expected filter2 dst_port 53, got %d", filter2.DstPort)
+	if filter2.DstPort.String() != "53" {
+		t.Errorf("Expected filter2 dst_port 53, got %s", filter2.DstPort)
 	}
 
 	// Check third rule with rewrite
@@ -104,4 +110,13 @@ func TestLoad(t *testing.T) {
 	if rule3.Rewrite.DstMAC != "52:54:00:12:34:56" {
 		t.Errorf("Expected rule3 rewrite dst_mac '52:54:00:12:34:56', got '%s'", rule3.Rewrite.DstMAC)
 	}
+
+	// Port ranges and lists
+	filter3 := rule3.Filters[1]
+	if got := filter3.SrcPort.String(); got != "32768-60999" {
+		t.Errorf("Expected filter3 src_port '32768-60999', got '%s'", got)
+	}
+	if got := filter3.DstPort.String(); got != "80,443,8000-8100" {
+		t.Errorf("Expected filter3 dst_port '80,443,8000-8100', got '%s'", got)
+	}
 }
@@ -1,6 +1,12 @@
 package config
 
-import "tcbroker/pkg/filter"
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"tcbroker/pkg/filter"
+)
 
 // Config is the top-level configuration structure.
 type Config struct {
@@ -9,11 +15,43 @@ type Config struct {
 
 // Rule represents a traffic mirroring rule.
 type Rule struct {
-	Name    string          `yaml:"name"`              // Rule name for identification (required)
-	SrcIntf string          `yaml:"src_intf"`          // Source interface name
-	DstIntf string          `yaml:"dst_intf"`          // Destination interface name
-	Rewrite *RewriteOptions `yaml:"rewrite,omitempty"` // Optional packet rewrite options
-	Filters []filter.Filter `yaml:"filters"`           // Filter conditions
+	Name         string          `yaml:"name"`                    // Rule name for identification (required)
+	Priority     int             `yaml:"priority,omitempty"`      // Place among the rules on src_intf (1-99), by default right after the previous one
+	SrcIntf      string          `yaml:"src_intf"`                // Source interface name
+	DstIntf      Interfaces      `yaml:"dst_intf"`                // Destination interface name or list of names
+	Direction    string          `yaml:"direction,omitempty"`     // Traffic to capture on src_intf: ingress (default), egress or both
+	Action       string          `yaml:"action,omitempty"`        // mirror (default) copies packets, redirect steers them to dst_intf
+	DstDirection string          `yaml:"dst_direction,omitempty"` // Where packets enter dst_intf: egress (default, transmitted) or ingress (received)
+	Rewrite      *RewriteOptions `yaml:"rewrite,omitempty"`       // Optional packet rewrite options
+	Filters      []filter.Filter `yaml:"filters"`                 // Filter conditions
+	Exclude      []filter.Filter `yaml:"exclude,omitempty"`       // Traffic of the filters to leave alone
+}
+
+// Interfaces is a list of interface names that can be written in YAML as a
+// single name or as a list.
+type Interfaces []string
+
+// UnmarshalYAML accepts a scalar interface name or a sequence of names.
+func (i *Interfaces) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*i = Interfaces{value.Value}
+		return nil
+	case yaml.SequenceNode:
+		var names []string
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+		*i = names
+		return nil
+	default:
+		return fmt.Errorf("line %d: expected an interface name or a list of interface names", value.Line)
+	}
+}
+
+// String returns the names separated by commas.
+func (i Interfaces) String() string {
+	return strings.Join(i, ",")
 }
 
 // RewriteOptions specifies packet rewrite parameters for redirect mode.
@@ -23,3 +61,127 @@ type RewriteOptions struct {
 	DstIP  string `yaml:"dst_ip,omitempty"`  // Destination IP address
 	SrcIP  string `yaml:"src_ip,omitempty"`  // Source IP address (for SNAT)
 }
+
+// Rule directions
+const (
+	DirectionIngress = "ingress"
+	DirectionEgress  = "egress"
+	DirectionBoth    = "both"
+)
+
+// Rule actions
+const (
+	ActionMirror   = filter.MirredMirror
+	ActionRedirect = filter.MirredRedirect
+)
+
+// The rules on an interface are installed in priority order, each with room
+// for MaxFiltersPerRule tc filters per hook.
+const (
+	MaxRulePriority   = 99
+	MaxFiltersPerRule = 100
+)
+
+// Priorities returns the priority of every rule, in config order. A rule
+// without an explicit priority gets the one after the previous rule on the
+// same source interface, or 1 if there is none.
+func (c *Config) Priorities() []int {
+	priorities := make([]int, len(c.Rules))
+	last := make(map[string]int)
+	for i, rule := range c.Rules {
+		priorities[i] = rule.Priority
+		if priorities[i] == 0 {
+			priorities[i] = last[rule.SrcIntf] + 1
+		}
+		last[rule.SrcIntf] = priorities[i]
+	}
+	return priorities
+}
+
+// FilterCount returns the number of tc filters the rule installs on each of
+// its hooks: one per filter and exclusion, with port lists expanded.
+func (r *Rule) FilterCount() int {
+	n := 0
+	for _, f := range r.Filters {
+		for _, expanded := range filter.Expand(f) {
+			n += len(r.Exclusions(expanded)) + 1
+		}
+	}
+	return n
+}
+
+// GetAction returns the rule action, defaulting to mirror.
+func (r *Rule) GetAction() string {
+	if r.Action == "" {
+		return ActionMirror
+	}
+	return r.Action
+}
+
+// Mirred returns the mirred action that ends each of the rule's filters.
+func (r *Rule) Mirred() filter.Mirred {
+	return filter.Mirred{Devs: r.DstIntf, Action: r.GetAction(), Hook: r.DstDirection}
+}
+
+// Protocol returns the tc protocol (ip, ipv6, 802.1Q, ...) of one of the
+// rule's filters.
+func (r *Rule) Protocol(f filter.Filter) string {
+	return filter.Protocol(f, r.rewriteAddrs())
+}
+
+// rewriteAddrs returns the rewrite addresses, which decide the protocol of
+// filters without addresses of their own.
+func (r *Rule) rewriteAddrs() *filter.RewriteOptions {
+	if r.Rewrite == nil {
+		return nil
+	}
+	return &filter.RewriteOptions{DstIP: r.Rewrite.DstIP, SrcIP: r.Rewrite.SrcIP}
+}
+
+// Exclusions returns the filters to install ahead of f, a filter of the rule
+// expanded with filter.Expand, so the packets it shares with the rule's
+// exclude entries are let through unmirrored. Each is the intersection of f
+// with an expanded exclude entry; entries that share no packets with f are
+// left out. An exclusion keeps the address family of f even when its own
+// fields don't imply one.
+func (r *Rule) Exclusions(f filter.Filter) []filter.Filter {
+	var exclusions []filter.Filter
+	for _, ex := range r.Exclude {
+		for _, expanded := range filter.Expand(ex) {
+			x, ok := filter.Intersect(f, expanded)
+			if !ok {
+				continue
+			}
+			if x.EthType == "" {
+				switch filter.NetworkProtocol(f, r.rewriteAddrs()) {
+				case filter.ProtocolIPv4:
+					x.EthType = filter.EthTypeIPv4
+				case filter.ProtocolIPv6:
+					x.EthType = filter.EthTypeIPv6
+				}
+			}
+			exclusions = append(exclusions, x)
+		}
+	}
+	return exclusions
+}
+
+// GetDirection returns the rule direction, defaulting to ingress.
+func (r *Rule) GetDirection() string {
+	if r.Direction == "" {
+		return DirectionIngress
+	}
+	return r.Direction
+}
+
+// Hooks returns the clsact hooks the rule's filters are attached to.
+func (r *Rule) Hooks() []string {
+	switch r.GetDirection() {
+	case DirectionEgress:
+		return []string{"egress"}
+	case DirectionBoth:
+		return []string{"ingress", "egress"}
+	default:
+		return []string{"ingress"}
+	}
+}
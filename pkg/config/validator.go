@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
+	"strings"
+
+	"tcbroker/pkg/filter"
 )
 
 // Validate checks if the configuration is valid.
@@ -18,6 +22,26 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	// Names identify rules in status and stop, priorities their filters in tc
+	names := make(map[string]int)
+	owners := make(map[string]int)
+	for i, priority := range c.Priorities() {
+		rule := &c.Rules[i]
+		if j, ok := names[rule.Name]; ok {
+			return fmt.Errorf("invalid rule #%d: name '%s' is already used by rule #%d", i+1, rule.Name, j+1)
+		}
+		names[rule.Name] = i
+
+		if priority > MaxRulePriority {
+			return fmt.Errorf("invalid rule #%d: priority %d after the previous rule on %s exceeds %d, set priority explicitly", i+1, priority, rule.SrcIntf, MaxRulePriority)
+		}
+		key := fmt.Sprintf("%s/%d", rule.SrcIntf, priority)
+		if j, ok := owners[key]; ok {
+			return fmt.Errorf("invalid rule #%d: priority %d on %s is already used by rule '%s'", i+1, priority, rule.SrcIntf, c.Rules[j].Name)
+		}
+		owners[key] = i
+	}
+
 	return nil
 }
 
@@ -28,15 +52,48 @@ func (r *Rule) Validate() error {
 		return fmt.Errorf("name is required")
 	}
 
+	if r.Priority < 0 || r.Priority > MaxRulePriority {
+		return fmt.Errorf("invalid priority %d: must be between 1 and %d", r.Priority, MaxRulePriority)
+	}
+
 	// Validate source interface
 	if r.SrcIntf == "" {
 		return fmt.Errorf("src_intf is required")
 	}
 
 	// Validate destination interface
-	if r.DstIntf == "" {
+	if len(r.DstIntf) == 0 {
 		return fmt.Errorf("dst_intf is required")
 	}
+	seen := make(map[string]bool)
+	for _, dst := range r.DstIntf {
+		if dst == "" {
+			return fmt.Errorf("dst_intf must not contain empty interface names")
+		}
+		if seen[dst] {
+			return fmt.Errorf("dst_intf lists '%s' more than once", dst)
+		}
+		seen[dst] = true
+	}
+
+	// Validate direction
+	switch r.Direction {
+	case "", DirectionIngress, DirectionEgress, DirectionBoth:
+	default:
+		return fmt.Errorf("invalid direction '%s': must be ingress, egress or both", r.Direction)
+	}
+
+	// Validate action
+	switch r.Action {
+	case "", ActionMirror, ActionRedirect:
+	default:
+		return fmt.Errorf("invalid action '%s': must be mirror or redirect", r.Action)
+	}
+	switch r.DstDirection {
+	case "", DirectionIngress, DirectionEgress:
+	default:
+		return fmt.Errorf("invalid dst_direction '%s': must be egress or ingress", r.DstDirection)
+	}
 
 	// Validate rewrite options if specified
 	if r.Rewrite != nil {
@@ -49,10 +106,292 @@ func (r *Rule) Validate() error {
 	if len(r.Filters) == 0 {
 		return fmt.Errorf("at least one filter is required")
 	}
+	for i, f := range r.Filters {
+		if err := validateFilter(f, r.Rewrite); err != nil {
+			return fmt.Errorf("invalid filter #%d: %w", i+1, err)
+		}
+	}
+	for i, ex := range r.Exclude {
+		if err := validateFilter(ex, nil); err != nil {
+			return fmt.Errorf("invalid exclude #%d: %w", i+1, err)
+		}
+	}
+	if n := r.FilterCount(); n > MaxFiltersPerRule {
+		return fmt.Errorf("the filters expand to %d tc filters, more than the %d a rule can hold", n, MaxFiltersPerRule)
+	}
 
 	return nil
 }
 
+// validateFilter checks the Ethernet fields, addresses and eth_type of a
+// filter and that the addresses use the same address family as each other
+// and as the rewrite addresses.
+func validateFilter(f filter.Filter, rewrite *RewriteOptions) error {
+	// Validate Ethernet and VLAN header fields
+	if f.SrcMAC != "" && !isValidMAC(f.SrcMAC) {
+		return fmt.Errorf("invalid src_mac '%s': must be a valid MAC address", f.SrcMAC)
+	}
+	if f.DstMAC != "" && !isValidMAC(f.DstMAC) {
+		return fmt.Errorf("invalid dst_mac '%s': must be a valid MAC address", f.DstMAC)
+	}
+	if f.VlanID < 0 || f.VlanID > 4094 {
+		return fmt.Errorf("invalid vlan_id %d: must be between 1 and 4094", f.VlanID)
+	}
+	if f.VlanPrio != nil && (*f.VlanPrio < 0 || *f.VlanPrio > 7) {
+		return fmt.Errorf("invalid vlan_prio %d: must be between 0 and 7", *f.VlanPrio)
+	}
+
+	// family is the address family the filter has committed to so far
+	// and source names the field that decided it
+	var family, source string
+	use := func(field, fam string) error {
+		if family == "" {
+			family, source = fam, field
+			return nil
+		}
+		if fam != family {
+			return fmt.Errorf("%s is %s but %s is %s: addresses must use the same address family", field, fam, source, family)
+		}
+		return nil
+	}
+
+	switch f.EthType {
+	case "", filter.EthType8021Q:
+	case filter.EthTypeIPv4, filter.EthTypeIPv6:
+		if err := use("eth_type", f.EthType); err != nil {
+			return err
+		}
+	case filter.EthTypeARP, filter.EthTypeLLDP:
+		// Neither carries an IP header to match on or rewrite
+		if f.HasL3() {
+			return fmt.Errorf("eth_type %s cannot be combined with IP or transport header fields", f.EthType)
+		}
+		if rewrite != nil && (rewrite.DstIP != "" || rewrite.SrcIP != "") {
+			return fmt.Errorf("eth_type %s cannot be combined with an IP rewrite", f.EthType)
+		}
+	default:
+		return fmt.Errorf("invalid eth_type '%s': must be ipv4, ipv6, arp, lldp or 802.1Q", f.EthType)
+	}
+
+	type addr struct{ field, value string }
+	addrs := []addr{{"src_ip", f.SrcIP}, {"dst_ip", f.DstIP}}
+	if rewrite != nil {
+		addrs = append(addrs, addr{"rewrite dst_ip", rewrite.DstIP}, addr{"rewrite src_ip", rewrite.SrcIP})
+	}
+	for _, a := range addrs {
+		if a.value == "" {
+			continue
+		}
+		fam, err := ipFamily(a.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s': %w", a.field, a.value, err)
+		}
+		if err := use(a.field, fam); err != nil {
+			return err
+		}
+	}
+
+	// Validate ports, which flower only matches for TCP, UDP and SCTP
+	if err := f.SrcPort.Validate(); err != nil {
+		return fmt.Errorf("invalid src_port: %w", err)
+	}
+	if err := f.DstPort.Validate(); err != nil {
+		return fmt.Errorf("invalid dst_port: %w", err)
+	}
+	if len(f.SrcPort) > 0 || len(f.DstPort) > 0 {
+		switch f.IPProto {
+		case "tcp", "udp", "sctp":
+		default:
+			return fmt.Errorf("src_port and dst_port require ip_proto tcp, udp or sctp")
+		}
+	}
+
+	// Validate masked header fields and the protocols that carry them
+	type maskedField struct {
+		name  string
+		value *filter.Masked
+		full  uint32
+	}
+	masked := []maskedField{
+		{"ip_tos", f.IPTOS, filter.MaxU8},
+		{"ip_ttl", f.IPTTL, filter.MaxU8},
+		{"icmp_type", f.ICMPType, filter.MaxU8},
+		{"icmp_code", f.ICMPCode, filter.MaxU8},
+	}
+	if f.TCPFlags != nil {
+		masked = append(masked, maskedField{"tcp_flags", &f.TCPFlags.Masked, filter.MaxTCPFlags})
+	}
+	for _, m := range masked {
+		if m.value == nil {
+			continue
+		}
+		if err := m.value.Validate(m.full); err != nil {
+			return fmt.Errorf("invalid %s: %w", m.name, err)
+		}
+	}
+	if f.TCPFlags != nil && f.IPProto != "tcp" {
+		return fmt.Errorf("tcp_flags requires ip_proto tcp")
+	}
+	if (f.ICMPType != nil || f.ICMPCode != nil) && f.IPProto != "icmp" && f.IPProto != "icmpv6" {
+		return fmt.Errorf("icmp_type and icmp_code require ip_proto icmp or icmpv6")
+	}
+
+	// ICMP and ICMPv6 are different IP protocols
+	switch {
+	case f.IPProto == "icmp" && family == "ipv6":
+		return fmt.Errorf("ip_proto icmp does not match IPv6 traffic, use icmpv6")
+	case f.IPProto == "icmpv6" && family == "ipv4":
+		return fmt.Errorf("ip_proto icmpv6 does not match IPv4 traffic, use icmp")
+	}
+
+	return nil
+}
+
+// Warnings returns the problems of a valid configuration that are worth
+// pointing out. Filters are installed in priority order, so a redirect
+// filter steals the packets it shares with a mirror filter of a rule after
+// it on the same interface and hook, and so does the pass filter of an
+// exclusion with every rule after it.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	order := c.installOrder()
+	for k, i := range order {
+		warnings = append(warnings, c.exclusionWarnings(&c.Rules[i], order[k+1:])...)
+	}
+	for k, i := range order {
+		redirect := c.Rules[i]
+		if redirect.GetAction() != ActionRedirect {
+			continue
+		}
+		for _, j := range order[k+1:] {
+			mirror := c.Rules[j]
+			if mirror.GetAction() != ActionMirror || mirror.SrcIntf != redirect.SrcIntf || !sharesHook(&redirect, &mirror) {
+				continue
+			}
+			for ri, rf := range redirect.Filters {
+				for mi, mf := range mirror.Filters {
+					if !protocolsOverlap(redirect.Protocol(rf), mirror.Protocol(mf)) || !filtersOverlap(rf, mf) {
+						continue
+					}
+					warnings = append(warnings, fmt.Sprintf(
+						"filter #%d of redirect rule '%s' overlaps filter #%d of mirror rule '%s' on %s: the shared packets are redirected and never mirrored",
+						ri+1, redirect.Name, mi+1, mirror.Name, redirect.SrcIntf))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// installOrder returns the indices of the rules in the order their filters
+// are installed on their source interfaces: by priority, whatever their
+// place in the file.
+func (c *Config) installOrder() []int {
+	priorities := c.Priorities()
+	order := make([]int, len(c.Rules))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return priorities[order[a]] < priorities[order[b]]
+	})
+	return order
+}
+
+// exclusionWarnings reports the exclude entries of rule that match none of
+// its filters, and the exclusions that hide packets from the rules installed
+// after it, given by their indices.
+func (c *Config) exclusionWarnings(rule *Rule, after []int) []string {
+	var warnings []string
+	used := make([]bool, len(rule.Exclude))
+	var exclusions []filter.Filter
+	for _, f := range rule.Filters {
+		for _, expanded := range filter.Expand(f) {
+			for ei, ex := range rule.Exclude {
+				for _, x := range filter.Expand(ex) {
+					if _, ok := filter.Intersect(expanded, x); ok {
+						used[ei] = true
+					}
+				}
+			}
+			exclusions = append(exclusions, rule.Exclusions(expanded)...)
+		}
+	}
+	for ei := range rule.Exclude {
+		if !used[ei] {
+			warnings = append(warnings, fmt.Sprintf("exclude #%d of rule '%s' matches none of its filters", ei+1, rule.Name))
+		}
+	}
+
+	for _, j := range after {
+		later := c.Rules[j]
+		if later.SrcIntf != rule.SrcIntf || !sharesHook(rule, &later) {
+			continue
+		}
+	filters:
+		for fi, f := range later.Filters {
+			for _, x := range exclusions {
+				if protocolsOverlap(rule.Protocol(x), later.Protocol(f)) && filtersOverlap(x, f) {
+					warnings = append(warnings, fmt.Sprintf(
+						"an exclusion of rule '%s' overlaps filter #%d of rule '%s' on %s: the shared packets are let through before rule '%s' sees them",
+						rule.Name, fi+1, later.Name, rule.SrcIntf, later.Name))
+					continue filters
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// sharesHook reports whether two rules attach filters to a common hook.
+func sharesHook(a, b *Rule) bool {
+	for _, ha := range a.Hooks() {
+		for _, hb := range b.Hooks() {
+			if ha == hb {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protocolsOverlap reports whether two tc protocols share packets.
+func protocolsOverlap(a, b string) bool {
+	return a == b || a == filter.ProtocolAll || b == filter.ProtocolAll
+}
+
+// filtersOverlap reports whether some packet can match both filters of
+// overlapping protocols, whatever their port lists.
+func filtersOverlap(a, b filter.Filter) bool {
+	for _, ea := range filter.Expand(a) {
+		for _, eb := range filter.Expand(b) {
+			if _, ok := filter.Intersect(ea, eb); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ipFamily returns "ipv4" or "ipv6" for an IP address or CIDR.
+func ipFamily(s string) (string, error) {
+	var ip net.IP
+	if strings.Contains(s, "/") {
+		addr, _, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", fmt.Errorf("must be a valid IP address or CIDR")
+		}
+		ip = addr
+	} else if ip = net.ParseIP(s); ip == nil {
+		return "", fmt.Errorf("must be a valid IP address or CIDR")
+	}
+
+	if ip.To4() != nil {
+		return "ipv4", nil
+	}
+	return "ipv6", nil
+}
+
 // Validate checks if the rewrite options are valid.
 func (r *RewriteOptions) Validate() error {
 	if r == nil {
@@ -87,6 +426,11 @@ func (r *RewriteOptions) Validate() error {
 			return fmt.Errorf("invalid src_ip '%s': must be a valid IP address", r.SrcIP)
 		}
 	}
+	if r.DstIP != "" && r.SrcIP != "" {
+		if (net.ParseIP(r.DstIP).To4() == nil) != (net.ParseIP(r.SrcIP).To4() == nil) {
+			return fmt.Errorf("dst_ip '%s' and src_ip '%s' must use the same address family", r.DstIP, r.SrcIP)
+		}
+	}
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 )
 
 func TestConfig_Validate(t *testing.T) {
+	vlanPrio8 := 8
 	testCases := []struct {
 		name    string
 		config  *Config
@@ -18,7 +19,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Filters: []filter.Filter{
 							{IPProto: "tcp"},
 						},
@@ -34,7 +35,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule-rewrite",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Rewrite: &RewriteOptions{
 							DstMAC: "52:54:00:12:34:56",
 						},
@@ -57,7 +58,7 @@ func TestConfig_Validate(t *testing.T) {
 				Rules: []Rule{
 					{
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Filters: []filter.Filter{{IPProto: "tcp"}},
 					},
 				},
@@ -70,7 +71,7 @@ func TestConfig_Validate(t *testing.T) {
 				Rules: []Rule{
 					{
 						Name:    "test-rule",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Filters: []filter.Filter{{IPProto: "tcp"}},
 					},
 				},
@@ -97,7 +98,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 					},
 				},
 			},
@@ -110,7 +111,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Rewrite: &RewriteOptions{
 							DstMAC: "invalid-mac",
 						},
@@ -127,7 +128,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Rewrite: &RewriteOptions{
 							DstIP: "invalid-ip",
 						},
@@ -144,7 +145,7 @@ func TestConfig_Validate(t *testing.T) {
 					{
 						Name:    "test-rule",
 						SrcIntf: "eth0",
-						DstIntf: "eth1",
+						DstIntf: Interfaces{"eth1"},
 						Rewrite: &RewriteOptions{},
 						Filters: []filter.Filter{{IPProto: "tcp"}},
 					},
@@ -152,6 +153,433 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "valid config with direction both",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:      "test-rule",
+						SrcIntf:   "eth0",
+						DstIntf:   Interfaces{"eth1"},
+						Direction: "both",
+						Filters:   []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid direction",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:      "test-rule",
+						SrcIntf:   "eth0",
+						DstIntf:   Interfaces{"eth1"},
+						Direction: "inbound",
+						Filters:   []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid IPv6 config with rewrite",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Rewrite: &RewriteOptions{DstIP: "2001:db8::100"},
+						Filters: []filter.Filter{{IPProto: "icmpv6", DstIP: "2001:db8::/64"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "IPv4 filter with IPv6 rewrite",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Rewrite: &RewriteOptions{DstIP: "2001:db8::100"},
+						Filters: []filter.Filter{{IPProto: "tcp", DstIP: "10.0.0.1"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "eth_type conflicts with address",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{EthType: "ipv4", SrcIP: "2001:db8::1"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid eth_type",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{EthType: "mpls"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid L2 filters",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{
+							{EthType: "arp", SrcMAC: "52:54:00:12:34:56"},
+							{EthType: "lldp"},
+							{VlanID: 100, VlanPrio: new(int), IPProto: "tcp", DstPort: filter.Port(80)},
+							{EthType: "802.1Q"},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid masked header fields",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{
+							{IPProto: "tcp", DstPort: filter.Port(22), TCPFlags: &filter.TCPFlags{Masked: filter.Masked{Value: 0x02, Mask: 0x12}}},
+							{IPProto: "icmpv6", ICMPType: filter.Exact(128), ICMPCode: filter.Exact(0)},
+							{IPTOS: &filter.Masked{Value: 0xb8, Mask: 0xfc}, IPTTL: filter.Exact(1)},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "tcp_flags without tcp",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPProto: "udp", TCPFlags: &filter.TCPFlags{Masked: filter.Masked{Value: 0x02}}}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "icmp_type without icmp",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{ICMPType: filter.Exact(8)}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ip_ttl out of range",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPTTL: filter.Exact(256)}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ip_tos outside mask",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPTOS: &filter.Masked{Value: 0xb9, Mask: 0xfc}}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "arp with ip_proto",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{EthType: "arp", IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "lldp with IP rewrite",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Rewrite: &RewriteOptions{DstIP: "10.0.0.100"},
+						Filters: []filter.Filter{{EthType: "lldp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid filter MAC",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{DstMAC: "52:54:00:12:34"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "vlan_id out of range",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{VlanID: 4095}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "vlan_prio out of range",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{VlanID: 10, VlanPrio: &vlanPrio8}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "icmp on IPv6",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{EthType: "ipv6", IPProto: "icmp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid filter address",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{DstIP: "10.0.0.300/24"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "mixed rewrite families",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Rewrite: &RewriteOptions{DstIP: "2001:db8::100", SrcIP: "10.0.0.1"},
+						Filters: []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid redirect to ingress",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:         "test-rule",
+						SrcIntf:      "eth0",
+						DstIntf:      Interfaces{"ids0"},
+						Action:       "redirect",
+						DstDirection: "ingress",
+						Filters:      []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate dst_intf",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1", "eth2", "eth1"},
+						Filters: []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "reversed port range",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Ports{{Min: 8100, Max: 8000}}}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "port out of range",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPProto: "udp", SrcPort: filter.Port(70000)}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "port without ip_proto",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{DstPort: filter.Port(80)}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid action",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Action:  "drop",
+						Filters: []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid dst_direction",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:         "test-rule",
+						SrcIntf:      "eth0",
+						DstIntf:      Interfaces{"eth1"},
+						DstDirection: "both",
+						Filters:      []filter.Filter{{IPProto: "tcp"}},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid exclude",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPProto: "tcp", DstIP: "10.0.0.0/8"}},
+						Exclude: []filter.Filter{{DstIP: "10.0.0.1"}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid exclude",
+			config: &Config{
+				Rules: []Rule{
+					{
+						Name:    "test-rule",
+						SrcIntf: "eth0",
+						DstIntf: Interfaces{"eth1"},
+						Filters: []filter.Filter{{IPProto: "tcp"}},
+						Exclude: []filter.Filter{{DstPort: filter.Port(22)}},
+					},
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -163,3 +591,276 @@ func TestConfig_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Warnings(t *testing.T) {
+	redirect := Rule{
+		Name:    "ids",
+		SrcIntf: "eth0",
+		DstIntf: Interfaces{"ids0"},
+		Action:  "redirect",
+		Filters: []filter.Filter{{IPProto: "tcp", DstIP: "10.0.0.0/8"}},
+	}
+
+	testCases := []struct {
+		name     string
+		mirror   Rule
+		first    bool // the mirror rule comes before the redirect rule
+		priority int  // of the redirect rule
+		want     int
+	}{
+		{
+			name:   "mirror inside redirect",
+			mirror: Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", DstIP: "10.1.2.3", DstPort: filter.Port(80)}}},
+			want:   1,
+		},
+		{
+			name:   "mirror before redirect",
+			mirror: Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(80)}}},
+			first:  true,
+			want:   0,
+		},
+		{
+			name:     "mirror before redirect of lower priority",
+			mirror:   Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Priority: 20, Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(80)}}},
+			first:    true,
+			priority: 10,
+			want:     1,
+		},
+		{
+			name:     "redirect before mirror of lower priority",
+			mirror:   Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Priority: 10, Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(80)}}},
+			priority: 20,
+			want:     0,
+		},
+		{
+			name:   "different protocol",
+			mirror: Rule{Name: "dns", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "udp", DstPort: filter.Port(53)}}},
+			want:   0,
+		},
+		{
+			name:   "disjoint prefixes",
+			mirror: Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", DstIP: "192.168.0.0/16"}}},
+			want:   0,
+		},
+		{
+			name:   "other interface",
+			mirror: Rule{Name: "http", SrcIntf: "eth1", DstIntf: Interfaces{"eth2"}, Filters: []filter.Filter{{IPProto: "tcp"}}},
+			want:   0,
+		},
+		{
+			name:   "other hook",
+			mirror: Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Direction: "egress", Filters: []filter.Filter{{IPProto: "tcp"}}},
+			want:   0,
+		},
+		{
+			name:   "TCP flags inside redirect",
+			mirror: Rule{Name: "syn-ack", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", TCPFlags: &filter.TCPFlags{Masked: filter.Masked{Value: 0x12}}}}},
+			want:   1,
+		},
+		{
+			name:   "MAC mirror of every protocol",
+			mirror: Rule{Name: "host", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{SrcMAC: "52:54:00:12:34:56"}}},
+			want:   1,
+		},
+		{
+			name:   "ARP mirror",
+			mirror: Rule{Name: "arp", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{EthType: "arp"}}},
+			want:   0,
+		},
+		{
+			name:   "other address family",
+			mirror: Rule{Name: "http", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"}, Filters: []filter.Filter{{IPProto: "tcp", EthType: "ipv6"}}},
+			want:   0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redirect := redirect
+			redirect.Priority = tc.priority
+			cfg := &Config{Rules: []Rule{redirect, tc.mirror}}
+			if tc.first {
+				cfg.Rules = []Rule{tc.mirror, redirect}
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate() failed: %v", err)
+			}
+			if got := cfg.Warnings(); len(got) != tc.want {
+				t.Errorf("Expected %d warnings, got %d: %v", tc.want, len(got), got)
+			}
+		})
+	}
+}
+
+func TestConfig_ExclusionWarnings(t *testing.T) {
+	mgmt := Rule{
+		Name:    "all-but-ssh",
+		SrcIntf: "eth0",
+		DstIntf: Interfaces{"eth1"},
+		Filters: []filter.Filter{{IPProto: "tcp"}},
+		Exclude: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(22)}},
+	}
+	urgentMgmt := mgmt
+	urgentMgmt.Priority = 10
+
+	testCases := []struct {
+		name  string
+		rules []Rule
+		want  int
+	}{
+		{name: "exclusion only", rules: []Rule{mgmt}, want: 0},
+		{
+			name: "exclude matching no filter",
+			rules: []Rule{{
+				Name: "dns", SrcIntf: "eth0", DstIntf: Interfaces{"eth1"},
+				Filters: []filter.Filter{{IPProto: "udp", DstPort: filter.Port(53)}},
+				Exclude: []filter.Filter{{IPProto: "tcp"}},
+			}},
+			want: 1,
+		},
+		{
+			name: "later rule sees excluded packets",
+			rules: []Rule{mgmt, {
+				Name: "ssh", SrcIntf: "eth0", DstIntf: Interfaces{"eth2"},
+				Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(22)}},
+			}},
+			want: 1,
+		},
+		{
+			name: "earlier rule",
+			rules: []Rule{{
+				Name: "ssh", SrcIntf: "eth0", DstIntf: Interfaces{"eth2"},
+				Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(22)}},
+			}, mgmt},
+			want: 0,
+		},
+		{
+			name: "earlier rule of higher priority",
+			rules: []Rule{{
+				Name: "ssh", SrcIntf: "eth0", DstIntf: Interfaces{"eth2"}, Priority: 20,
+				Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Port(22)}},
+			}, urgentMgmt},
+			want: 1,
+		},
+		{
+			name: "later rule with a port list",
+			rules: []Rule{mgmt, {
+				Name: "admin", SrcIntf: "eth0", DstIntf: Interfaces{"eth2"},
+				Filters: []filter.Filter{{IPProto: "tcp", DstPort: filter.Ports{{Min: 80, Max: 80}, {Min: 22, Max: 22}}}},
+			}},
+			want: 1,
+		},
+		{
+			name: "later rule on other traffic",
+			rules: []Rule{mgmt, {
+				Name: "dns", SrcIntf: "eth0", DstIntf: Interfaces{"eth2"},
+				Filters: []filter.Filter{{IPProto: "udp", DstPort: filter.Port(53)}},
+			}},
+			want: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Rules: tc.rules}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate() failed: %v", err)
+			}
+			if got := cfg.Warnings(); len(got) != tc.want {
+				t.Errorf("Expected %d warnings, got %d: %v", tc.want, len(got), got)
+			}
+		})
+	}
+}
+
+func TestRule_Exclusions(t *testing.T) {
+	rule := Rule{
+		Filters: []filter.Filter{{IPProto: "tcp", DstIP: "10.0.0.0/8"}},
+		Exclude: []filter.Filter{
+			{DstIP: "10.0.0.1"},
+			{DstIP: "192.168.0.0/16"},
+			{IPProto: "tcp", DstPort: filter.Ports{{Min: 22, Max: 22}, {Min: 80, Max: 80}}},
+		},
+	}
+
+	testCases := []struct {
+		dstIP, dstPort string
+	}{
+		{dstIP: "10.0.0.1"},
+		{dstIP: "10.0.0.0/8", dstPort: "22"},
+		{dstIP: "10.0.0.0/8", dstPort: "80"},
+	}
+	got := rule.Exclusions(rule.Filters[0])
+	if len(got) != len(testCases) {
+		t.Fatalf("Expected %d exclusions, got %d: %+v", len(testCases), len(got), got)
+	}
+	for i, tc := range testCases {
+		x := got[i]
+		if x.IPProto != "tcp" || x.EthType != filter.EthTypeIPv4 || x.DstIP != tc.dstIP || x.DstPort.String() != tc.dstPort {
+			t.Errorf("Expected exclusion #%d to match tcp to %s port '%s', got %+v", i+1, tc.dstIP, tc.dstPort, x)
+		}
+	}
+}
+
+func TestConfig_Priorities(t *testing.T) {
+	rule := func(name, src string, priority int) Rule {
+		return Rule{Name: name, SrcIntf: src, Priority: priority, DstIntf: Interfaces{"eth9"}, Filters: []filter.Filter{{IPProto: "tcp"}}}
+	}
+
+	testCases := []struct {
+		name     string
+		rules    []Rule
+		expected []int
+		wantErr  bool
+	}{
+		{
+			name:     "config order",
+			rules:    []Rule{rule("a", "eth0", 0), rule("b", "eth0", 0), rule("c", "eth1", 0)},
+			expected: []int{1, 2, 1},
+		},
+		{
+			name:     "explicit priority continues",
+			rules:    []Rule{rule("a", "eth0", 10), rule("b", "eth0", 0), rule("c", "eth0", 5)},
+			expected: []int{10, 11, 5},
+		},
+		{
+			name:    "taken priority",
+			rules:   []Rule{rule("a", "eth0", 0), rule("b", "eth0", 0), rule("c", "eth0", 2)},
+			wantErr: true,
+		},
+		{
+			name:    "priority out of range",
+			rules:   []Rule{rule("a", "eth0", 100)},
+			wantErr: true,
+		},
+		{
+			name:    "implicit priority out of range",
+			rules:   []Rule{rule("a", "eth0", 99), rule("b", "eth0", 0)},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			rules:   []Rule{rule("a", "eth0", 0), rule("a", "eth1", 0)},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Rules: tc.rules}
+			err := cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := cfg.Priorities()
+			for i, want := range tc.expected {
+				if got[i] != want {
+					t.Errorf("Expected rule '%s' to get priority %d, got %d", tc.rules[i].Name, want, got[i])
+				}
+			}
+		})
+	}
+}
@@ -2,46 +2,131 @@ package filter
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
 
-// BuildTCArgs constructs the arguments for a `tc filter` command based on the
-// provided filter criteria. This function builds arguments for use with clsact qdisc,
-// where the hook (ingress/egress) itself specifies the attachment point.
-func BuildTCArgs(ifaceName, hook, target string, f Filter) []string {
-	args := []string{"filter", "add", "dev", ifaceName, hook}
+// tc protocols of the generated flower filters, spelled the way
+// `tc filter show` prints them
+const (
+	ProtocolAll   = "all"
+	ProtocolIPv4  = "ip"
+	ProtocolIPv6  = "ipv6"
+	ProtocolARP   = "arp"
+	ProtocolLLDP  = "LLDP"
+	Protocol8021Q = "802.1Q"
+)
 
-	// Protocol is required for flower, but we can default to 'all' if not specified
-	// to match any IP traffic.
-	proto := "all"
-	if f.IPProto != "" {
-		// Flower uses 'ip_proto' to match on the protocol name.
-		proto = f.IPProto
+// Protocol returns the tc protocol of the traffic a filter matches: 802.1Q
+// for VLAN filters and the NetworkProtocol otherwise.
+func Protocol(f Filter, rewrite *RewriteOptions) string {
+	if f.IsVLAN() {
+		return Protocol8021Q
 	}
-	args = append(args, "protocol", "ip", "flower") // "protocol ip" is more specific than "all"
+	return NetworkProtocol(f, rewrite)
+}
 
-	if f.SrcIP != "" {
-		args = append(args, "src_ip", f.SrcIP)
+// NetworkProtocol returns the tc protocol of the packets a filter matches,
+// inside the VLAN tag for VLAN filters. An explicit eth_type wins; otherwise
+// an IPv6 address in the filter or in the rewrite options selects IPv6.
+// Filters on Ethernet fields alone match every protocol, and everything else
+// is IPv4.
+func NetworkProtocol(f Filter, rewrite *RewriteOptions) string {
+	switch f.EthType {
+	case EthTypeIPv4:
+		return ProtocolIPv4
+	case EthTypeIPv6:
+		return ProtocolIPv6
+	case EthTypeARP:
+		return ProtocolARP
+	case EthTypeLLDP:
+		return ProtocolLLDP
 	}
-	if f.DstIP != "" {
-		args = append(args, "dst_ip", f.DstIP)
+
+	addrs := []string{f.SrcIP, f.DstIP}
+	if rewrite != nil {
+		addrs = append(addrs, rewrite.SrcIP, rewrite.DstIP)
 	}
+	rewritesIP := false
+	for _, addr := range addrs {
+		if isIPv6(addr) {
+			return ProtocolIPv6
+		}
+		rewritesIP = rewritesIP || addr != ""
+	}
+	if !f.HasL3() && !rewritesIP && (f.HasL2() || f.IsVLAN()) {
+		return ProtocolAll
+	}
+	return ProtocolIPv4
+}
 
-	// Only add protocol matcher if a specific L4 protocol is given
-	if f.IPProto != "" {
-		args = append(args, "ip_proto", proto)
+// isIPv6 reports whether addr is an IPv6 address or CIDR.
+func isIPv6(addr string) bool {
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
 	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// ID pins where tc installs a filter and tags its actions. A zero Pref or
+// Handle is left to the kernel to pick, and an empty Cookie is omitted.
+type ID struct {
+	Pref   int
+	Handle uint32
+	// Cookie is stored with every action of the filter as a hex string of up
+	// to 16 bytes, which tc reports back with the action's counters.
+	Cookie string
+}
+
+// HandleString returns the handle the way tc prints it, e.g. "0x1".
+func (id ID) HandleString() string {
+	return fmt.Sprintf("0x%x", id.Handle)
+}
+
+// BuildTCArgs constructs the arguments for a `tc filter` command based on the
+// provided filter criteria. This function builds arguments for use with clsact qdisc,
+// where the hook (ingress/egress) itself specifies the attachment point.
+// Port lists must have been split with Expand first.
+func BuildTCArgs(ifaceName, hook string, target Mirred, id ID, f Filter) []string {
+	args := filterAddArgs(ifaceName, hook, id, Protocol(f, nil))
+	args = append(args, matchArgs(f, nil)...)
+
+	return append(args, MirredArgs(target, id.Cookie)...)
+}
+
+// BuildPassArgs constructs the arguments of a filter that accepts matching
+// packets with `action pass`, which ends classification on the hook so the
+// filters behind it never see them. Exclusions are installed this way ahead
+// of the mirror filters of their rule.
+func BuildPassArgs(ifaceName, hook string, id ID, f Filter) []string {
+	args := filterAddArgs(ifaceName, hook, id, Protocol(f, nil))
+	args = append(args, matchArgs(f, nil)...)
+	return appendCookie(append(args, "action", "pass"), id.Cookie)
+}
 
-	if f.SrcPort != 0 {
-		args = append(args, "src_port", strconv.Itoa(f.SrcPort))
+// filterAddArgs returns the arguments of a `tc filter add` up to and
+// including the flower keyword.
+func filterAddArgs(ifaceName, hook string, id ID, protocol string) []string {
+	args := []string{"filter", "add", "dev", ifaceName, hook}
+	if id.Pref != 0 {
+		args = append(args, "pref", strconv.Itoa(id.Pref))
 	}
-	if f.DstPort != 0 {
-		args = append(args, "dst_port", strconv.Itoa(f.DstPort))
+	args = append(args, "protocol", protocol)
+	if id.Handle != 0 {
+		args = append(args, "handle", id.HandleString())
 	}
+	return append(args, "flower")
+}
 
-	args = append(args, "action", "mirred", "egress", "mirror", "dev", target, "continue")
-	return args
+// appendCookie ends the arguments of an action with its cookie, if any. tc
+// takes the cookie after the action's control keyword.
+func appendCookie(args []string, cookie string) []string {
+	if cookie == "" {
+		return args
+	}
+	return append(args, "cookie", cookie)
 }
 
 // RewriteOptions specifies packet rewrite parameters.
@@ -53,33 +138,11 @@ type RewriteOptions struct {
 }
 
 // BuildTCArgsWithRewrite constructs tc filter arguments with packet rewrite support.
-// Always uses mirror action with optional MAC/IP rewriting.
-func BuildTCArgsWithRewrite(ifaceName, hook, target string, f Filter, rewrite *RewriteOptions) []string {
-	args := []string{"filter", "add", "dev", ifaceName, hook}
-
-	// Protocol setup
-	proto := "all"
-	if f.IPProto != "" {
-		proto = f.IPProto
-	}
-	args = append(args, "protocol", "ip", "flower")
-
-	// Match conditions
-	if f.SrcIP != "" {
-		args = append(args, "src_ip", f.SrcIP)
-	}
-	if f.DstIP != "" {
-		args = append(args, "dst_ip", f.DstIP)
-	}
-	if f.IPProto != "" {
-		args = append(args, "ip_proto", proto)
-	}
-	if f.SrcPort != 0 {
-		args = append(args, "src_port", strconv.Itoa(f.SrcPort))
-	}
-	if f.DstPort != 0 {
-		args = append(args, "dst_port", strconv.Itoa(f.DstPort))
-	}
+// The optional MAC/IP rewrite actions run before the mirred action.
+func BuildTCArgsWithRewrite(ifaceName, hook string, target Mirred, id ID, f Filter, rewrite *RewriteOptions) []string {
+	args := filterAddArgs(ifaceName, hook, id, Protocol(f, rewrite))
+	args = append(args, matchArgs(f, rewrite)...)
+	ipv6 := NetworkProtocol(f, rewrite) == ProtocolIPv6
 
 	// Add packet rewrite actions
 	if rewrite != nil && (rewrite.DstMAC != "" || rewrite.SrcMAC != "" || rewrite.DstIP != "" || rewrite.SrcIP != "") {
@@ -92,38 +155,154 @@ func BuildTCArgsWithRewrite(ifaceName, hook, target string, f Filter, rewrite *R
 			if rewrite.SrcMAC != "" {
 				args = append(args, "set", "smac", rewrite.SrcMAC)
 			}
-			args = append(args, "pipe")
+			args = appendCookie(append(args, "pipe"), id.Cookie)
 		}
 
 		// IP address rewriting using pedit (skbmod doesn't support IP)
 		if rewrite.DstIP != "" || rewrite.SrcIP != "" {
 			args = append(args, "action", "pedit", "ex")
 
+			// The IPv6 header is edited through pedit's ip6 header type
+			header := "ip"
+			if ipv6 {
+				header = "ip6"
+			}
 			if rewrite.DstIP != "" {
-				args = append(args, "munge", "ip", "dst", "set", rewrite.DstIP)
+				args = append(args, "munge", header, "dst", "set", rewrite.DstIP)
 			}
 			if rewrite.SrcIP != "" {
-				args = append(args, "munge", "ip", "src", "set", rewrite.SrcIP)
+				args = append(args, "munge", header, "src", "set", rewrite.SrcIP)
 			}
 
 			// Add checksum recalculation after IP modification
-			checksums := []string{"ip"}
-			switch f.IPProto {
-			case "tcp":
-				checksums = append(checksums, "tcp")
-			case "udp":
-				checksums = append(checksums, "udp")
-			case "icmp":
-				checksums = append(checksums, "icmp")
-			}
+			args = appendCookie(append(args, "pipe"), id.Cookie)
+			args = append(args, "action", "csum")
+			args = append(args, CsumTargets(f.IPProto, ipv6)...)
+			args = appendCookie(append(args, "pipe"), id.Cookie)
+		}
+	}
+
+	// Final mirred action
+	return append(args, MirredArgs(target, id.Cookie)...)
+}
 
-			args = append(args, "pipe", "action", "csum", strings.Join(checksums, " and "))
+// matchArgs returns the flower matchers of f. The ethertype inside the tag of
+// a VLAN filter must come before the IP matchers, which tc parses for it.
+func matchArgs(f Filter, rewrite *RewriteOptions) []string {
+	var args []string
+	if f.SrcMAC != "" {
+		args = append(args, "src_mac", f.SrcMAC)
+	}
+	if f.DstMAC != "" {
+		args = append(args, "dst_mac", f.DstMAC)
+	}
+	if f.VlanID != 0 {
+		args = append(args, "vlan_id", strconv.Itoa(f.VlanID))
+	}
+	if f.VlanPrio != nil {
+		args = append(args, "vlan_prio", strconv.Itoa(*f.VlanPrio))
+	}
+	if f.IsVLAN() {
+		if proto := NetworkProtocol(f, rewrite); proto != ProtocolAll {
+			args = append(args, "vlan_ethtype", proto)
 		}
 	}
 
-	// Final mirred action - always mirror
-	args = append(args, "action", "mirred", "egress", "mirror", "dev", target, "continue")
+	if f.SrcIP != "" {
+		args = append(args, "src_ip", f.SrcIP)
+	}
+	if f.DstIP != "" {
+		args = append(args, "dst_ip", f.DstIP)
+	}
+	if f.IPProto != "" {
+		args = append(args, "ip_proto", f.IPProto)
+	}
+	if f.IPTOS != nil {
+		args = append(args, "ip_tos", fmt.Sprintf("0x%x/0x%x", f.IPTOS.Value, f.IPTOS.MaskOf(MaxU8)))
+	}
+	if f.IPTTL != nil {
+		args = append(args, "ip_ttl", fmt.Sprintf("0x%x/0x%x", f.IPTTL.Value, f.IPTTL.MaskOf(MaxU8)))
+	}
+	if len(f.SrcPort) > 0 {
+		args = append(args, "src_port", f.SrcPort.String())
+	}
+	if len(f.DstPort) > 0 {
+		args = append(args, "dst_port", f.DstPort.String())
+	}
+	if f.TCPFlags != nil {
+		args = append(args, "tcp_flags", fmt.Sprintf("0x%x/0x%x", f.TCPFlags.Value, f.TCPFlags.MaskOf(MaxTCPFlags)))
+	}
+	// flower's ICMP keywords follow ip_proto icmp or icmpv6 and take
+	// decimal values
+	if f.ICMPType != nil {
+		args = append(args, "type", icmpArg(f.ICMPType))
+	}
+	if f.ICMPCode != nil {
+		args = append(args, "code", icmpArg(f.ICMPCode))
+	}
+	return args
+}
+
+// icmpArg renders an ICMP type or code for tc, with the mask only if it
+// is partial.
+func icmpArg(m *Masked) string {
+	if mask := m.MaskOf(MaxU8); mask != MaxU8 {
+		return fmt.Sprintf("%d/%d", m.Value, mask)
+	}
+	return strconv.Itoa(int(m.Value))
+}
+
+// MirredArgs returns the chained mirred actions that end a filter: a mirror
+// piped to the next action for every target but the last, which gets the
+// configured action. A final mirror ends with continue so later filters still
+// see the packet; a final redirect keeps mirred's default of stealing it.
+// Every action carries the cookie, if any.
+func MirredArgs(m Mirred, cookie string) []string {
+	var args []string
+	for i, dev := range m.Devs {
+		if i < len(m.Devs)-1 {
+			args = append(args, "action", "mirred", m.GetHook(), MirredMirror, "dev", dev, "pipe")
+		} else {
+			args = append(args, "action", "mirred", m.GetHook(), m.GetAction(), "dev", dev)
+			if m.GetAction() == MirredMirror {
+				args = append(args, "continue")
+			}
+		}
+		args = appendCookie(args, cookie)
+	}
+	return args
+}
 
+// CsumTargets returns the `tc action csum` targets, joined by "and", that
+// must be updated after rewriting the IP addresses of ipProto traffic.
+// IPv6 has no header checksum, so only the L4 checksum covering the pseudo
+// header is updated, for TCP, UDP and ICMPv6 alike if ipProto is not one of
+// them.
+func CsumTargets(ipProto string, ipv6 bool) []string {
+	var targets []string
+	if !ipv6 {
+		targets = append(targets, "ip")
+	}
+	switch ipProto {
+	case "tcp":
+		targets = append(targets, "tcp")
+	case "udp":
+		targets = append(targets, "udp")
+	case "icmp", "icmpv6":
+		targets = append(targets, "icmp")
+	default:
+		if ipv6 {
+			targets = append(targets, "tcp", "udp", "icmp")
+		}
+	}
+
+	args := []string{}
+	for i, t := range targets {
+		if i > 0 {
+			args = append(args, "and")
+		}
+		args = append(args, t)
+	}
 	return args
 }
 
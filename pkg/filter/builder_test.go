@@ -0,0 +1,187 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTCArgsWithRewrite(t *testing.T) {
+	prio := 5
+	testCases := []struct {
+		name     string
+		filter   Filter
+		rewrite  *RewriteOptions
+		target   Mirred
+		expected string
+	}{
+		{
+			name:     "redirect",
+			filter:   Filter{IPProto: "tcp", DstPort: Port(80)},
+			target:   Mirred{Devs: []string{"ids0"}, Action: MirredRedirect},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto tcp dst_port 80 action mirred egress redirect dev ids0",
+		},
+		{
+			name:    "ingress redirect after rewrite",
+			filter:  Filter{IPProto: "tcp", DstPort: Port(80)},
+			rewrite: &RewriteOptions{DstMAC: "52:54:00:12:34:56"},
+			target:  Mirred{Devs: []string{"ids0"}, Action: MirredRedirect, Hook: "ingress"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto tcp dst_port 80" +
+				" action skbmod set dmac 52:54:00:12:34:56 pipe" +
+				" action mirred ingress redirect dev ids0",
+		},
+		{
+			name:   "fan-out mirror",
+			filter: Filter{IPProto: "udp", DstPort: Port(53)},
+			target: Mirred{Devs: []string{"ids0", "rec0"}},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto udp dst_port 53" +
+				" action mirred egress mirror dev ids0 pipe" +
+				" action mirred egress mirror dev rec0 continue",
+		},
+		{
+			name:   "fan-out redirect",
+			filter: Filter{IPProto: "udp", DstPort: Port(53)},
+			target: Mirred{Devs: []string{"rec0", "ids0"}, Action: MirredRedirect},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto udp dst_port 53" +
+				" action mirred egress mirror dev rec0 pipe" +
+				" action mirred egress redirect dev ids0",
+		},
+		{
+			name:     "port range",
+			filter:   Filter{IPProto: "tcp", SrcPort: Ports{{Min: 32768, Max: 60999}}, DstPort: Port(80)},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto tcp src_port 32768-60999 dst_port 80 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "IPv4 mirror",
+			filter:   Filter{IPProto: "tcp", DstIP: "10.0.0.1", DstPort: Port(80)},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower dst_ip 10.0.0.1 ip_proto tcp dst_port 80 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "IPv6 mirror",
+			filter:   Filter{IPProto: "udp", SrcIP: "2001:db8::/32", DstPort: Port(53)},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ipv6 flower src_ip 2001:db8::/32 ip_proto udp dst_port 53 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "explicit eth_type",
+			filter:   Filter{EthType: "ipv6", IPProto: "icmpv6"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ipv6 flower ip_proto icmpv6 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:    "IPv4 rewrite",
+			filter:  Filter{IPProto: "tcp", DstPort: Port(22)},
+			rewrite: &RewriteOptions{DstIP: "10.0.0.100", DstMAC: "52:54:00:12:34:56"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto tcp dst_port 22" +
+				" action skbmod set dmac 52:54:00:12:34:56 pipe" +
+				" action pedit ex munge ip dst set 10.0.0.100 pipe" +
+				" action csum ip and tcp pipe" +
+				" action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:    "IPv6 rewrite selects the protocol",
+			filter:  Filter{IPProto: "tcp", DstPort: Port(22)},
+			rewrite: &RewriteOptions{DstIP: "2001:db8::100", SrcIP: "2001:db8::1"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ipv6 flower ip_proto tcp dst_port 22" +
+				" action pedit ex munge ip6 dst set 2001:db8::100 munge ip6 src set 2001:db8::1 pipe" +
+				" action csum tcp pipe" +
+				" action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:    "IPv6 rewrite without ip_proto",
+			filter:  Filter{DstIP: "2001:db8::1"},
+			rewrite: &RewriteOptions{DstIP: "2001:db8::100"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ipv6 flower dst_ip 2001:db8::1" +
+				" action pedit ex munge ip6 dst set 2001:db8::100 pipe" +
+				" action csum tcp and udp and icmp pipe" +
+				" action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "TCP SYN",
+			filter:   Filter{IPProto: "tcp", DstPort: Port(22), TCPFlags: &TCPFlags{Masked{Value: 0x02, Mask: 0x12}}},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto tcp dst_port 22 tcp_flags 0x2/0x12 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "ICMP echo request with TOS and TTL",
+			filter:   Filter{IPProto: "icmp", ICMPType: Exact(8), ICMPCode: &Masked{Value: 0, Mask: 0xf0}, IPTOS: &Masked{Value: 0xb8, Mask: 0xfc}, IPTTL: Exact(64)},
+			expected: "filter add dev eth0 ingress pref 30000 protocol ip flower ip_proto icmp ip_tos 0xb8/0xfc ip_ttl 0x40/0xff type 8 code 0/240 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "MAC only matches every protocol",
+			filter:   Filter{SrcMAC: "52:54:00:12:34:56"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol all flower src_mac 52:54:00:12:34:56 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "ARP",
+			filter:   Filter{EthType: "arp", DstMAC: "ff:ff:ff:ff:ff:ff"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol arp flower dst_mac ff:ff:ff:ff:ff:ff action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "LLDP",
+			filter:   Filter{EthType: "lldp"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol LLDP flower action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "VLAN",
+			filter:   Filter{VlanID: 100},
+			expected: "filter add dev eth0 ingress pref 30000 protocol 802.1Q flower vlan_id 100 action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "any tagged packet",
+			filter:   Filter{EthType: "802.1Q"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol 802.1Q flower action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:     "VLAN priority and inner IPv6",
+			filter:   Filter{VlanID: 100, VlanPrio: &prio, IPProto: "tcp", DstIP: "2001:db8::1"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol 802.1Q flower vlan_id 100 vlan_prio 5 vlan_ethtype ipv6 dst_ip 2001:db8::1 ip_proto tcp action mirred egress mirror dev eth1 continue",
+		},
+		{
+			name:    "VLAN with IPv4 rewrite",
+			filter:  Filter{VlanID: 10, EthType: "ipv4"},
+			rewrite: &RewriteOptions{DstIP: "10.0.0.100"},
+			expected: "filter add dev eth0 ingress pref 30000 protocol 802.1Q flower vlan_id 10 vlan_ethtype ip" +
+				" action pedit ex munge ip dst set 10.0.0.100 pipe" +
+				" action csum ip pipe" +
+				" action mirred egress mirror dev eth1 continue",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.target.Devs == nil {
+				tc.target.Devs = []string{"eth1"}
+			}
+			args := BuildTCArgsWithRewrite("eth0", "ingress", tc.target, ID{Pref: 30000}, tc.filter, tc.rewrite)
+			if got := strings.Join(args, " "); got != tc.expected {
+				t.Errorf("Expected:\n  %s\ngot:\n  %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildPassArgs(t *testing.T) {
+	f := Filter{EthType: EthTypeIPv4, IPProto: "tcp", DstIP: "10.0.0.1", DstPort: Port(22)}
+	expected := "filter add dev eth0 ingress pref 30100 protocol ip handle 0x1 flower dst_ip 10.0.0.1 ip_proto tcp dst_port 22 action pass"
+	if got := strings.Join(BuildPassArgs("eth0", "ingress", ID{Pref: 30100, Handle: 1}, f), " "); got != expected {
+		t.Errorf("Expected:\n  %s\ngot:\n  %s", expected, got)
+	}
+}
+
+func TestBuildTCArgsCookie(t *testing.T) {
+	f := Filter{IPProto: "tcp", DstPort: Port(80)}
+	rewrite := &RewriteOptions{DstMAC: "52:54:00:12:34:56", DstIP: "10.0.0.100"}
+	target := Mirred{Devs: []string{"eth1", "eth2"}}
+	expected := "filter add dev eth0 ingress pref 30100 protocol ip handle 0x1 flower ip_proto tcp dst_port 80" +
+		" action skbmod set dmac 52:54:00:12:34:56 pipe cookie 0123abcd" +
+		" action pedit ex munge ip dst set 10.0.0.100 pipe cookie 0123abcd" +
+		" action csum ip and tcp pipe cookie 0123abcd" +
+		" action mirred egress mirror dev eth1 pipe cookie 0123abcd" +
+		" action mirred egress mirror dev eth2 continue cookie 0123abcd"
+	id := ID{Pref: 30100, Handle: 1, Cookie: "0123abcd"}
+	if got := strings.Join(BuildTCArgsWithRewrite("eth0", "ingress", target, id, f, rewrite), " "); got != expected {
+		t.Errorf("Expected:\n  %s\ngot:\n  %s", expected, got)
+	}
+
+	expected = "filter add dev eth0 ingress pref 30100 protocol ip handle 0x1 flower ip_proto tcp dst_port 80 action pass cookie 0123abcd"
+	if got := strings.Join(BuildPassArgs("eth0", "ingress", id, f), " "); got != expected {
+		t.Errorf("Expected:\n  %s\ngot:\n  %s", expected, got)
+	}
+}
@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"net"
+	"strings"
+)
+
+// Intersect returns a filter matching exactly the packets both a and b
+// match, and false if no packet can match both. Port lists must have been
+// split with Expand first.
+func Intersect(a, b Filter) (Filter, bool) {
+	out := a
+	ok := true
+	same := func(x, y string, fold bool) string {
+		switch {
+		case x == "":
+			return y
+		case y == "" || x == y || (fold && strings.EqualFold(x, y)):
+			return x
+		}
+		ok = false
+		return x
+	}
+
+	out.SrcMAC = same(a.SrcMAC, b.SrcMAC, true)
+	out.DstMAC = same(a.DstMAC, b.DstMAC, true)
+	out.EthType = same(a.EthType, b.EthType, false)
+	out.IPProto = same(a.IPProto, b.IPProto, false)
+
+	switch {
+	case a.VlanID == 0:
+		out.VlanID = b.VlanID
+	case b.VlanID != 0 && a.VlanID != b.VlanID:
+		ok = false
+	}
+	switch {
+	case a.VlanPrio == nil:
+		out.VlanPrio = b.VlanPrio
+	case b.VlanPrio != nil && *a.VlanPrio != *b.VlanPrio:
+		ok = false
+	}
+
+	var found bool
+	if out.SrcIP, found = intersectPrefixes(a.SrcIP, b.SrcIP); !found {
+		ok = false
+	}
+	if out.DstIP, found = intersectPrefixes(a.DstIP, b.DstIP); !found {
+		ok = false
+	}
+	if out.SrcPort, found = intersectPorts(a.SrcPort, b.SrcPort); !found {
+		ok = false
+	}
+	if out.DstPort, found = intersectPorts(a.DstPort, b.DstPort); !found {
+		ok = false
+	}
+
+	if a.TCPFlags == nil || b.TCPFlags == nil {
+		if out.TCPFlags = a.TCPFlags; out.TCPFlags == nil {
+			out.TCPFlags = b.TCPFlags
+		}
+	} else if m, found := intersectMasked(&a.TCPFlags.Masked, &b.TCPFlags.Masked, MaxTCPFlags); found {
+		out.TCPFlags = &TCPFlags{Masked: *m}
+	} else {
+		ok = false
+	}
+	masked := []struct {
+		out  **Masked
+		a, b *Masked
+	}{
+		{&out.ICMPType, a.ICMPType, b.ICMPType},
+		{&out.ICMPCode, a.ICMPCode, b.ICMPCode},
+		{&out.IPTOS, a.IPTOS, b.IPTOS},
+		{&out.IPTTL, a.IPTTL, b.IPTTL},
+	}
+	for _, m := range masked {
+		if *m.out, found = intersectMasked(m.a, m.b, MaxU8); !found {
+			ok = false
+		}
+	}
+
+	return out, ok
+}
+
+// intersectPrefixes returns the narrower of two addresses or CIDRs if one
+// contains the other. An empty prefix matches every address.
+func intersectPrefixes(a, b string) (string, bool) {
+	if a == "" || b == "" {
+		return a + b, true
+	}
+	na, errA := parsePrefix(a)
+	nb, errB := parsePrefix(b)
+	if errA != nil || errB != nil {
+		return a, a == b
+	}
+	onesA, _ := na.Mask.Size()
+	onesB, _ := nb.Mask.Size()
+	switch {
+	case onesA >= onesB && nb.Contains(na.IP):
+		return a, true
+	case onesB > onesA && na.Contains(nb.IP):
+		return b, true
+	}
+	return a, false
+}
+
+// parsePrefix parses an address or CIDR, treating an address as a host prefix.
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if isIPv6(s) {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// intersectPorts returns the ports both single-entry Ports match.
+func intersectPorts(a, b Ports) (Ports, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		if len(a) == 0 {
+			return b, true
+		}
+		return a, true
+	}
+	r := PortRange{Min: max(a[0].Min, b[0].Min), Max: min(a[0].Max, b[0].Max)}
+	if r.Min > r.Max {
+		return a, false
+	}
+	return Ports{r}, true
+}
+
+// intersectMasked combines the bits two masked values require. A nil value
+// matches everything.
+func intersectMasked(a, b *Masked, full uint32) (*Masked, bool) {
+	if a == nil {
+		return b, true
+	}
+	if b == nil {
+		return a, true
+	}
+	if !a.Overlaps(b, full) {
+		return a, false
+	}
+	mask := a.MaskOf(full) | b.MaskOf(full)
+	m := &Masked{Value: a.Value | b.Value, Mask: mask}
+	if mask == full {
+		m.Mask = 0
+	}
+	return m, true
+}
@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIntersect(t *testing.T) {
+	prio := 3
+	testCases := []struct {
+		name     string
+		a, b     Filter
+		expected Filter
+		ok       bool
+	}{
+		{
+			name:     "narrower prefix",
+			a:        Filter{IPProto: "tcp", DstIP: "10.0.0.0/8"},
+			b:        Filter{DstIP: "10.1.2.3"},
+			expected: Filter{IPProto: "tcp", DstIP: "10.1.2.3"},
+			ok:       true,
+		},
+		{
+			name: "disjoint prefixes",
+			a:    Filter{DstIP: "10.0.0.0/8"},
+			b:    Filter{DstIP: "192.168.0.0/16"},
+		},
+		{
+			name:     "port ranges",
+			a:        Filter{IPProto: "tcp", DstPort: Ports{{Min: 8000, Max: 8100}}},
+			b:        Filter{DstPort: Ports{{Min: 8080, Max: 9000}}},
+			expected: Filter{IPProto: "tcp", DstPort: Ports{{Min: 8080, Max: 8100}}},
+			ok:       true,
+		},
+		{
+			name: "different protocols",
+			a:    Filter{IPProto: "tcp"},
+			b:    Filter{IPProto: "udp"},
+		},
+		{
+			name:     "MAC case and VLAN",
+			a:        Filter{SrcMAC: "52:54:00:AB:CD:EF", VlanID: 100},
+			b:        Filter{SrcMAC: "52:54:00:ab:cd:ef", VlanPrio: &prio},
+			expected: Filter{SrcMAC: "52:54:00:AB:CD:EF", VlanID: 100, VlanPrio: &prio},
+			ok:       true,
+		},
+		{
+			name:     "masked bits combine",
+			a:        Filter{IPProto: "tcp", TCPFlags: &TCPFlags{Masked: Masked{Value: 0x02, Mask: 0x02}}},
+			b:        Filter{TCPFlags: &TCPFlags{Masked: Masked{Value: 0x00, Mask: 0x10}}},
+			expected: Filter{IPProto: "tcp", TCPFlags: &TCPFlags{Masked: Masked{Value: 0x02, Mask: 0x12}}},
+			ok:       true,
+		},
+		{
+			name:     "masks covering every bit become exact",
+			a:        Filter{IPTOS: &Masked{Value: 0xb8, Mask: 0xf0}},
+			b:        Filter{IPTOS: &Masked{Value: 0x08, Mask: 0x0f}},
+			expected: Filter{IPTOS: Exact(0xb8)},
+			ok:       true,
+		},
+		{
+			name: "conflicting masked bits",
+			a:    Filter{ICMPType: Exact(8)},
+			b:    Filter{ICMPType: Exact(0)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := Intersect(tc.a, tc.b)
+			if ok != tc.ok {
+				t.Fatalf("Expected ok %v, got %v", tc.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Widest values of the masked header fields
+const (
+	MaxTCPFlags = 0xfff // 12 bits: the TCP flags including the reserved ones
+	MaxU8       = 0xff  // ICMP type and code, IP TOS and TTL
+)
+
+// Masked is a header field matched under a mask, written as VALUE or
+// VALUE/MASK in decimal or 0x-prefixed hex. A zero Mask matches every bit of
+// the field.
+type Masked struct {
+	Value uint32
+	Mask  uint32
+}
+
+// Exact returns a Masked matching v on every bit.
+func Exact(v uint32) *Masked {
+	return &Masked{Value: v}
+}
+
+// MaskOf returns the mask, full is the mask of every bit of the field.
+func (m Masked) MaskOf(full uint32) uint32 {
+	if m.Mask == 0 {
+		return full
+	}
+	return m.Mask
+}
+
+// String returns the value and, if it has one, the mask in hex.
+func (m Masked) String() string {
+	if m.Mask == 0 {
+		return fmt.Sprintf("0x%x", m.Value)
+	}
+	return fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+}
+
+// MarshalYAML writes the value as a number, or as a "value/mask" string if
+// it has a mask. TCPFlags are written the same way.
+func (m Masked) MarshalYAML() (any, error) {
+	if m.Mask == 0 {
+		return m.Value, nil
+	}
+	return m.String(), nil
+}
+
+// UnmarshalYAML accepts a number or a "value/mask" string.
+func (m *Masked) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a value or value/mask", value.Line)
+	}
+	parsed, err := parseMasked(value.Value, parseNumber)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*m = parsed
+	return nil
+}
+
+// Validate checks that value and mask fit in a field whose widest value is
+// full and that the value has no bits outside the mask.
+func (m Masked) Validate(full uint32) error {
+	if m.Value > full {
+		return fmt.Errorf("value 0x%x exceeds 0x%x", m.Value, full)
+	}
+	if m.Mask > full {
+		return fmt.Errorf("mask 0x%x exceeds 0x%x", m.Mask, full)
+	}
+	if m.Value&^m.MaskOf(full) != 0 {
+		return fmt.Errorf("value 0x%x has bits outside the mask 0x%x", m.Value, m.Mask)
+	}
+	return nil
+}
+
+// Overlaps reports whether some field value matches both m and o. A nil
+// Masked matches every value.
+func (m *Masked) Overlaps(o *Masked, full uint32) bool {
+	if m == nil || o == nil {
+		return true
+	}
+	return (m.Value^o.Value)&m.MaskOf(full)&o.MaskOf(full) == 0
+}
+
+// TCPFlags is the value of tcp_flags: a Masked whose value and mask may also
+// be written as flag names joined by "|", e.g. "syn/syn|ack" for the first
+// packet of a handshake.
+type TCPFlags struct {
+	Masked
+}
+
+// tcpFlagBits maps the TCP flag names to their bits.
+var tcpFlagBits = map[string]uint32{
+	"fin": 0x01,
+	"syn": 0x02,
+	"rst": 0x04,
+	"psh": 0x08,
+	"ack": 0x10,
+	"urg": 0x20,
+	"ece": 0x40,
+	"cwr": 0x80,
+}
+
+// UnmarshalYAML accepts a number, flag names or a "value/mask" string of
+// either.
+func (f *TCPFlags) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected TCP flags or flags/mask", value.Line)
+	}
+	parsed, err := parseMasked(value.Value, parseTCPFlags)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	f.Masked = parsed
+	return nil
+}
+
+// parseMasked splits "value/mask" and parses both halves with parse.
+func parseMasked(s string, parse func(string) (uint32, error)) (Masked, error) {
+	v, mask, hasMask := strings.Cut(strings.TrimSpace(s), "/")
+	value, err := parse(v)
+	if err != nil {
+		return Masked{}, err
+	}
+	m := Masked{Value: value}
+	if hasMask {
+		if m.Mask, err = parse(mask); err != nil {
+			return Masked{}, err
+		}
+		if m.Mask == 0 {
+			return Masked{}, fmt.Errorf("mask of '%s' must not be zero", s)
+		}
+	}
+	return m, nil
+}
+
+// parseNumber parses a decimal or 0x-prefixed hex number.
+func parseNumber(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+	return uint32(n), nil
+}
+
+// parseTCPFlags parses a number or TCP flag names joined by "|".
+func parseTCPFlags(s string) (uint32, error) {
+	if n, err := parseNumber(s); err == nil {
+		return n, nil
+	}
+	var flags uint32
+	for _, name := range strings.Split(s, "|") {
+		bit, ok := tcpFlagBits[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("invalid TCP flag '%s': must be a number or fin, syn, rst, psh, ack, urg, ece or cwr", name)
+		}
+		flags |= bit
+	}
+	return flags, nil
+}
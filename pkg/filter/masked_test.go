@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMaskedUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected Masked
+		wantErr  bool
+	}{
+		{name: "decimal", input: "ip_ttl: 64", expected: Masked{Value: 64}},
+		{name: "hex with mask", input: "ip_tos: 0xb8/0xfc", expected: Masked{Value: 0xb8, Mask: 0xfc}},
+		{name: "decimal with mask", input: "ip_tos: 184/252", expected: Masked{Value: 0xb8, Mask: 0xfc}},
+		{name: "zero mask", input: "ip_tos: 0/0", wantErr: true},
+		{name: "not a number", input: "ip_ttl: high", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var f Filter
+			err := yaml.Unmarshal([]byte(tc.input), &f)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := f.IPTOS
+			if got == nil {
+				got = f.IPTTL
+			}
+			if got == nil || *got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTCPFlagsUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected Masked
+		wantErr  bool
+	}{
+		{name: "name", input: "tcp_flags: syn", expected: Masked{Value: 0x02}},
+		{name: "names with mask", input: "tcp_flags: syn/syn|ack", expected: Masked{Value: 0x02, Mask: 0x12}},
+		{name: "upper case", input: "tcp_flags: SYN|ACK", expected: Masked{Value: 0x12}},
+		{name: "hex", input: "tcp_flags: 0x2/0x12", expected: Masked{Value: 0x02, Mask: 0x12}},
+		{name: "unknown flag", input: "tcp_flags: syn|foo", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var f Filter
+			err := yaml.Unmarshal([]byte(tc.input), &f)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && (f.TCPFlags == nil || f.TCPFlags.Masked != tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, f.TCPFlags)
+			}
+		})
+	}
+}
+
+func TestMaskedMarshalYAML(t *testing.T) {
+	f := Filter{
+		IPTTL:    Exact(64),
+		IPTOS:    &Masked{Value: 0xb8, Mask: 0xfc},
+		TCPFlags: &TCPFlags{Masked{Value: 0x02, Mask: 0x12}},
+	}
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	expected := "tcp_flags: 0x2/0x12\nip_tos: 0xb8/0xfc\nip_ttl: 64\n"
+	if string(data) != expected {
+		t.Errorf("Expected %q, got %q", expected, data)
+	}
+
+	var got Filter
+	if err := yaml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if *got.IPTTL != *f.IPTTL || *got.IPTOS != *f.IPTOS || *got.TCPFlags != *f.TCPFlags {
+		t.Errorf("Expected %+v after a round trip, got %+v", f, got)
+	}
+}
+
+func TestMaskedValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		masked  Masked
+		full    uint32
+		wantErr bool
+	}{
+		{name: "exact", masked: Masked{Value: 8}, full: MaxU8},
+		{name: "masked", masked: Masked{Value: 0xb8, Mask: 0xfc}, full: MaxU8},
+		{name: "value too large", masked: Masked{Value: 256}, full: MaxU8, wantErr: true},
+		{name: "mask too large", masked: Masked{Value: 0x2, Mask: 0x1fff}, full: MaxTCPFlags, wantErr: true},
+		{name: "value outside mask", masked: Masked{Value: 0x12, Mask: 0x02}, full: MaxTCPFlags, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.masked.Validate(tc.full); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaskedOverlaps(t *testing.T) {
+	syn := &Masked{Value: 0x02, Mask: 0x12}
+	testCases := []struct {
+		name     string
+		a, b     *Masked
+		expected bool
+	}{
+		{name: "unset", a: nil, b: syn, expected: true},
+		{name: "SYN and SYN-ACK", a: syn, b: Exact(0x12), expected: false},
+		{name: "SYN and SYN only", a: syn, b: Exact(0x02), expected: true},
+		{name: "mask ignores bit", a: &Masked{Value: 0xb8, Mask: 0xfc}, b: Exact(0xb9), expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.a.Overlaps(tc.b, MaxTCPFlags); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PortRange is a single port (Min == Max) or an inclusive range of ports.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// String returns the port or range the way tc flower writes it, e.g. "80"
+// or "8000-8100".
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// IsRange reports whether r spans more than one port.
+func (r PortRange) IsRange() bool {
+	return r.Min != r.Max
+}
+
+// Ports is the value of src_port or dst_port: a port, a range such as
+// 8000-8100, or a list of both. An empty Ports matches every port.
+type Ports []PortRange
+
+// Port returns Ports matching the single port p.
+func Port(p int) Ports {
+	return Ports{{Min: p, Max: p}}
+}
+
+// String returns the entries separated by commas.
+func (p Ports) String() string {
+	parts := make([]string, len(p))
+	for i, r := range p {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// MarshalYAML writes a single port as a number, a range as a "min-max"
+// string and anything else as a list of both.
+func (p Ports) MarshalYAML() (any, error) {
+	values := make([]any, len(p))
+	for i, r := range p {
+		if r.IsRange() {
+			values[i] = r.String()
+		} else {
+			values[i] = r.Min
+		}
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return values, nil
+}
+
+// UnmarshalYAML accepts a port number, a "min-max" range or a list of both.
+func (p *Ports) UnmarshalYAML(value *yaml.Node) error {
+	var values []string
+	switch value.Kind {
+	case yaml.ScalarNode:
+		values = []string{value.Value}
+	case yaml.SequenceNode:
+		if err := value.Decode(&values); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: expected a port, a port range or a list of them", value.Line)
+	}
+
+	ports := make(Ports, 0, len(values))
+	for _, v := range values {
+		r, err := parsePortRange(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", value.Line, err)
+		}
+		ports = append(ports, r)
+	}
+	*p = ports
+	return nil
+}
+
+// parsePortRange parses "80" or "8000-8100". Bounds are checked by Validate.
+func parsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port '%s'", s)
+	}
+	if !isRange {
+		return PortRange{Min: first, Max: first}, nil
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range '%s'", s)
+	}
+	return PortRange{Min: first, Max: last}, nil
+}
+
+// Validate checks that every port is between 1 and 65535 and that no range
+// is reversed.
+func (p Ports) Validate() error {
+	for _, r := range p {
+		if r.Min < 1 || r.Min > 65535 || r.Max < 1 || r.Max > 65535 {
+			return fmt.Errorf("port '%s' out of range: must be between 1 and 65535", r)
+		}
+		if r.Min > r.Max {
+			return fmt.Errorf("port range '%s' is reversed", r)
+		}
+	}
+	return nil
+}
+
+// Overlaps reports whether some port is matched by both p and other.
+func (p Ports) Overlaps(other Ports) bool {
+	if len(p) == 0 || len(other) == 0 {
+		return true
+	}
+	for _, a := range p {
+		for _, b := range other {
+			if a.Min <= b.Max && b.Min <= a.Max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expand returns the filters to install for f: one per combination of its
+// src_port and dst_port entries, since a flower filter matches a single
+// port or range per field. Filters without port lists are returned as is.
+func Expand(f Filter) []Filter {
+	srcs := []Ports{f.SrcPort}
+	if len(f.SrcPort) > 1 {
+		srcs = srcs[:0]
+		for _, r := range f.SrcPort {
+			srcs = append(srcs, Ports{r})
+		}
+	}
+	dsts := []Ports{f.DstPort}
+	if len(f.DstPort) > 1 {
+		dsts = dsts[:0]
+		for _, r := range f.DstPort {
+			dsts = append(dsts, Ports{r})
+		}
+	}
+
+	var filters []Filter
+	for _, src := range srcs {
+		for _, dst := range dsts {
+			expanded := f
+			expanded.SrcPort, expanded.DstPort = src, dst
+			filters = append(filters, expanded)
+		}
+	}
+	return filters
+}
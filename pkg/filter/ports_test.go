@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPortsUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{name: "single port", input: "dst_port: 80", expected: "80"},
+		{name: "range", input: "dst_port: 8000-8100", expected: "8000-8100"},
+		{name: "list", input: "dst_port: [80, 443, 8000-8100]", expected: "80,443,8000-8100"},
+		{name: "block list", input: "dst_port:\n  - 53\n  - \"5353\"", expected: "53,5353"},
+		{name: "not a number", input: "dst_port: http", wantErr: true},
+		{name: "bad range", input: "dst_port: 80-", wantErr: true},
+		{name: "mapping", input: "dst_port: {min: 80}", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var f Filter
+			err := yaml.Unmarshal([]byte(tc.input), &f)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && f.DstPort.String() != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, f.DstPort.String())
+			}
+		})
+	}
+}
+
+func TestPortsMarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ports    Ports
+		expected string
+	}{
+		{name: "single port", ports: Port(80), expected: "dst_port: 80\n"},
+		{name: "range", ports: Ports{{Min: 8000, Max: 8100}}, expected: "dst_port: 8000-8100\n"},
+		{name: "list", ports: Ports{{Min: 80, Max: 80}, {Min: 8000, Max: 8100}}, expected: "dst_port:\n    - 80\n    - 8000-8100\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := yaml.Marshal(Filter{DstPort: tc.ports})
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, data)
+			}
+			var f Filter
+			if err := yaml.Unmarshal(data, &f); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if f.DstPort.String() != tc.ports.String() {
+				t.Errorf("Expected '%s' after a round trip, got '%s'", tc.ports, f.DstPort)
+			}
+		})
+	}
+}
+
+func TestPortsValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ports   Ports
+		wantErr bool
+	}{
+		{name: "empty", ports: nil},
+		{name: "valid", ports: Ports{{Min: 80, Max: 80}, {Min: 1024, Max: 65535}}},
+		{name: "zero", ports: Port(0), wantErr: true},
+		{name: "too large", ports: Port(65536), wantErr: true},
+		{name: "reversed", ports: Ports{{Min: 8100, Max: 8000}}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.ports.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	f := Filter{
+		IPProto: "tcp",
+		SrcPort: Ports{{Min: 1024, Max: 65535}},
+		DstPort: Ports{{Min: 80, Max: 80}, {Min: 443, Max: 443}, {Min: 8000, Max: 8100}},
+	}
+
+	expanded := Expand(f)
+	expected := []string{"80", "443", "8000-8100"}
+	if len(expanded) != len(expected) {
+		t.Fatalf("Expected %d filters, got %d", len(expected), len(expanded))
+	}
+	for i, want := range expected {
+		if got := expanded[i].DstPort.String(); got != want {
+			t.Errorf("Expected filter %d dst_port '%s', got '%s'", i+1, want, got)
+		}
+		if got := expanded[i].SrcPort.String(); got != "1024-65535" {
+			t.Errorf("Expected filter %d src_port '1024-65535', got '%s'", i+1, got)
+		}
+	}
+
+	if got := len(Expand(Filter{IPProto: "udp"})); got != 1 {
+		t.Errorf("Expected a filter without ports to stay a single filter, got %d", got)
+	}
+}
@@ -2,9 +2,76 @@ package filter
 
 // Filter represents a packet filter rule.
 type Filter struct {
-	IPProto string `yaml:"ip_proto,omitempty"` // IP protocol (tcp, udp, icmp, etc.)
-	SrcIP   string `yaml:"src_ip,omitempty"`   // Source IP address or CIDR
-	DstIP   string `yaml:"dst_ip,omitempty"`   // Destination IP address or CIDR
-	SrcPort int    `yaml:"src_port,omitempty"` // Source port number
-	DstPort int    `yaml:"dst_port,omitempty"` // Destination port number
+	SrcMAC   string `yaml:"src_mac,omitempty"`   // Source MAC address
+	DstMAC   string `yaml:"dst_mac,omitempty"`   // Destination MAC address
+	VlanID   int    `yaml:"vlan_id,omitempty"`   // 802.1Q VLAN ID (1-4094)
+	VlanPrio *int   `yaml:"vlan_prio,omitempty"` // 802.1Q priority code point (0-7)
+	EthType  string `yaml:"eth_type,omitempty"`  // Ethertype: ipv4, ipv6, arp, lldp or 802.1Q (derived from the other fields if empty)
+	IPProto  string `yaml:"ip_proto,omitempty"`  // IP protocol (tcp, udp, icmp, icmpv6, etc.)
+	SrcIP    string `yaml:"src_ip,omitempty"`    // Source IP address or CIDR
+	DstIP    string `yaml:"dst_ip,omitempty"`    // Destination IP address or CIDR
+	SrcPort  Ports  `yaml:"src_port,omitempty"`  // Source port, range (8000-8100) or list of both
+	DstPort  Ports  `yaml:"dst_port,omitempty"`  // Destination port, range (8000-8100) or list of both
+
+	TCPFlags *TCPFlags `yaml:"tcp_flags,omitempty"` // TCP flags with optional mask, e.g. syn/syn|ack or 0x2/0x12
+	ICMPType *Masked   `yaml:"icmp_type,omitempty"` // ICMP or ICMPv6 type with optional mask
+	ICMPCode *Masked   `yaml:"icmp_code,omitempty"` // ICMP or ICMPv6 code with optional mask
+	IPTOS    *Masked   `yaml:"ip_tos,omitempty"`    // IPv4 TOS or IPv6 traffic class with optional mask, e.g. 0xb8/0xfc for DSCP EF
+	IPTTL    *Masked   `yaml:"ip_ttl,omitempty"`    // IPv4 TTL or IPv6 hop limit with optional mask
+}
+
+// Ethertypes accepted in eth_type
+const (
+	EthTypeIPv4  = "ipv4"
+	EthTypeIPv6  = "ipv6"
+	EthTypeARP   = "arp"
+	EthTypeLLDP  = "lldp"
+	EthType8021Q = "802.1Q"
+)
+
+// IsVLAN reports whether the filter matches 802.1Q tagged traffic. The
+// eth_type of a filter on the VLAN fields is the ethertype inside the tag.
+func (f Filter) IsVLAN() bool {
+	return f.VlanID != 0 || f.VlanPrio != nil || f.EthType == EthType8021Q
+}
+
+// HasL2 reports whether the filter matches on Ethernet or VLAN header fields.
+func (f Filter) HasL2() bool {
+	return f.SrcMAC != "" || f.DstMAC != "" || f.VlanID != 0 || f.VlanPrio != nil
+}
+
+// HasL3 reports whether the filter matches on IP or transport header fields.
+func (f Filter) HasL3() bool {
+	return f.IPProto != "" || f.SrcIP != "" || f.DstIP != "" || len(f.SrcPort) > 0 || len(f.DstPort) > 0 ||
+		f.TCPFlags != nil || f.ICMPType != nil || f.ICMPCode != nil || f.IPTOS != nil || f.IPTTL != nil
+}
+
+// Mirred actions
+const (
+	MirredMirror   = "mirror"
+	MirredRedirect = "redirect"
+)
+
+// Mirred describes the mirred actions that end every filter: the interfaces
+// matching packets are sent to and whether the original packet goes on.
+type Mirred struct {
+	Devs   []string // Target interfaces, one chained mirred action each
+	Action string   // mirror (default) copies the packet, redirect steals it after the last copy
+	Hook   string   // egress (default) transmits on Devs, ingress receives on Devs
+}
+
+// GetAction returns the mirred action, defaulting to mirror.
+func (m Mirred) GetAction() string {
+	if m.Action == "" {
+		return MirredMirror
+	}
+	return m.Action
+}
+
+// GetHook returns the direction on the target, defaulting to egress.
+func (m Mirred) GetHook() string {
+	if m.Hook == "" {
+		return "egress"
+	}
+	return m.Hook
 }
@@ -0,0 +1,273 @@
+package tc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"tcbroker/pkg/filter"
+)
+
+// SkbmodAction holds the rewrites of a skbmod action.
+type SkbmodAction struct {
+	DstMAC string
+	SrcMAC string
+}
+
+// PeditKey is one 32-bit edit of a pedit action: Cmd ("set" or "add")
+// applies Value to the word at Offset of the header, keeping the bits that
+// are set in Mask.
+type PeditKey struct {
+	HeaderType string // "eth", "ipv4", "ipv6", "tcp", "udp" or "" for raw offsets
+	Offset     int
+	Cmd        string
+	Value      uint32
+	Mask       uint32
+}
+
+// PeditAction holds the keys of a pedit action.
+type PeditAction struct {
+	Keys []PeditKey
+}
+
+// CsumAction holds the checksums a csum action recomputes, named the way
+// tc prints them, e.g. "iph" and "tcp".
+type CsumAction struct {
+	Targets []string
+}
+
+// PoliceAction holds the token bucket of a police action.
+type PoliceAction struct {
+	Rate  uint64 // bytes per second
+	Burst uint64 // bytes
+}
+
+// peditHeaderTypes names the pedit header types by their
+// TCA_PEDIT_KEY_EX_HDR_TYPE value.
+var peditHeaderTypes = []string{"", "eth", "ipv4", "ipv6", "tcp", "udp"}
+
+// csumTargetNames lists the checksums of a csum action in the order tc
+// prints them.
+var csumTargetNames = []string{"iph", "icmp", "igmp", "tcp", "udp", "udplite", "sctp"}
+
+// Describe returns a human-readable description of what the action does,
+// e.g. "skbmod set dmac 52:54:00:12:34:56".
+func (a *ActionStats) Describe() string {
+	var parts []string
+	switch {
+	case a.Type == "mirred" && a.Operation != "":
+		return fmt.Sprintf("mirred (%s to device %s)", a.Operation, a.TargetDev)
+	case a.Type == "gact" && a.Operation != "":
+		return "gact " + a.Operation
+	case a.Skbmod != nil:
+		parts = append(parts, "skbmod")
+		if a.Skbmod.DstMAC != "" {
+			parts = append(parts, "set dmac "+a.Skbmod.DstMAC)
+		}
+		if a.Skbmod.SrcMAC != "" {
+			parts = append(parts, "set smac "+a.Skbmod.SrcMAC)
+		}
+	case a.Pedit != nil:
+		parts = append(parts, "pedit", strings.Join(a.Pedit.Munges(), ", "))
+	case a.Csum != nil:
+		parts = append(parts, "csum", strings.Join(a.Csum.Targets, ", "))
+	case a.Police != nil:
+		parts = append(parts, "police rate", formatRate(a.Police.Rate), "burst", FormatBytes(int64(a.Police.Burst)))
+	default:
+		return a.Type
+	}
+	return strings.Join(parts, " ")
+}
+
+// String describes the key the way `tc filter show` prints it, e.g.
+// "ipv4+16 set 0a000064". The mask is shown only if it keeps any bits.
+func (k PeditKey) String() string {
+	at := strconv.Itoa(k.Offset)
+	if k.HeaderType != "" {
+		at = k.HeaderType + "+" + at
+	}
+	s := fmt.Sprintf("%s %s %08x", at, k.Cmd, k.Value)
+	if k.Mask != 0 {
+		s += fmt.Sprintf(" mask %08x", k.Mask)
+	}
+	return s
+}
+
+// Munges describes the keys of the action. Keys that set a whole IPv4 or
+// IPv6 address are combined the way pedit's munge takes them, e.g.
+// "ip dst set 10.0.0.100".
+func (p *PeditAction) Munges() []string {
+	var munges []string
+	for i := 0; i < len(p.Keys); {
+		if munge, n := addressMunge(p.Keys[i:]); n > 0 {
+			munges = append(munges, munge)
+			i += n
+			continue
+		}
+		munges = append(munges, p.Keys[i].String())
+		i++
+	}
+	return munges
+}
+
+// addressMunge describes the keys at the start of keys that set an address,
+// and returns how many keys it used, or 0 if they don't set one.
+func addressMunge(keys []PeditKey) (string, int) {
+	type field struct {
+		header, name string
+		offset, size int
+	}
+	for _, f := range []field{
+		{"ipv4", "ip src", 12, 4},
+		{"ipv4", "ip dst", 16, 4},
+		{"ipv6", "ip6 src", 8, 16},
+		{"ipv6", "ip6 dst", 24, 16},
+	} {
+		n := f.size / 4
+		if len(keys) < n {
+			continue
+		}
+		ip := make(net.IP, f.size)
+		for i, k := range keys[:n] {
+			if k.HeaderType != f.header || k.Offset != f.offset+4*i || k.Cmd != "set" || k.Mask != 0 {
+				ip = nil
+				break
+			}
+			binary.BigEndian.PutUint32(ip[4*i:], k.Value)
+		}
+		if ip != nil {
+			return f.name + " set " + ip.String(), n
+		}
+	}
+	return "", 0
+}
+
+// rewriteKeys returns the pedit keys that set the rewritten addresses of
+// ipv6 or IPv4 traffic, 32 bits at a time at their offset in the IP header:
+// one key per IPv4 and four per IPv6 address.
+func rewriteKeys(rewrite *filter.RewriteOptions, ipv6 bool) ([]PeditKey, error) {
+	htype, srcOff, dstOff := "ipv4", 12, 16
+	if ipv6 {
+		htype, srcOff, dstOff = "ipv6", 8, 24
+	}
+	var keys []PeditKey
+	addKeys := func(name, value string, off int) error {
+		ip := net.ParseIP(value)
+		if ip == nil || (ip.To4() == nil) != ipv6 {
+			family := "IPv4"
+			if ipv6 {
+				family = "IPv6"
+			}
+			return fmt.Errorf("invalid %s '%s': must be an %s address", name, value, family)
+		}
+		if !ipv6 {
+			ip = ip.To4()
+		}
+		for i := 0; i < len(ip); i += 4 {
+			keys = append(keys, PeditKey{HeaderType: htype, Offset: off + i, Cmd: "set", Value: binary.BigEndian.Uint32(ip[i : i+4])})
+		}
+		return nil
+	}
+	if rewrite.DstIP != "" {
+		if err := addKeys("dst_ip", rewrite.DstIP, dstOff); err != nil {
+			return nil, err
+		}
+	}
+	if rewrite.SrcIP != "" {
+		if err := addKeys("src_ip", rewrite.SrcIP, srcOff); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// csumTargets converts the targets of filter.CsumTargets into the names tc
+// prints for them.
+func csumTargets(ipProto string, ipv6 bool) []string {
+	var targets []string
+	for _, target := range filter.CsumTargets(ipProto, ipv6) {
+		switch target {
+		case "and":
+		case "ip":
+			targets = append(targets, "iph")
+		default:
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// formatRate renders a rate in bytes per second the way tc prints it: in
+// bits per second with the largest decimal prefix that keeps it exact, e.g.
+// "1Mbit".
+func formatRate(bytesPerSec uint64) string {
+	rate := bytesPerSec * 8
+	units := []string{"", "K", "M", "G", "T"}
+	i := 0
+	for ; i < len(units)-1; i++ {
+		if rate < 1000 || (rate%1000 != 0 && rate < 1000*1000) {
+			break
+		}
+		rate /= 1000
+	}
+	return fmt.Sprintf("%d%sbit", rate, units[i])
+}
+
+// rateUnits maps the units tc accepts for rates to bits per second.
+var rateUnits = map[string]float64{
+	"": 1, "bit": 1,
+	"kbit": 1e3, "mbit": 1e6, "gbit": 1e9, "tbit": 1e12,
+	"kibit": 1 << 10, "mibit": 1 << 20, "gibit": 1 << 30, "tibit": 1 << 40,
+	"bps": 8, "kbps": 8e3, "mbps": 8e6, "gbps": 8e9, "tbps": 8e12,
+}
+
+// parseRate reads a rate as tc prints it, e.g. "1Mbit", into bytes per
+// second.
+func parseRate(s string) (uint64, error) {
+	value, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	scale, ok := rateUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+	return uint64(value * scale / 8), nil
+}
+
+// sizeUnits maps the units tc prints sizes with to bytes.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30,
+}
+
+// parseSize reads a size as tc prints it, e.g. "10Kb", into bytes.
+func parseSize(s string) (uint64, error) {
+	value, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	scale, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return uint64(value * scale), nil
+}
+
+// splitUnit splits a number with a unit suffix, such as "1.5Kb", into the
+// number and the lower-cased unit.
+func splitUnit(s string) (float64, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid number '%s'", s)
+	}
+	return value, strings.ToLower(s[i:]), nil
+}
@@ -0,0 +1,141 @@
+package tc
+
+import (
+	"testing"
+
+	"tcbroker/pkg/filter"
+)
+
+func TestActionStatsDescribe(t *testing.T) {
+	ipv6Keys, err := rewriteKeys(&filter.RewriteOptions{SrcIP: "2001:db8::100"}, true)
+	if err != nil {
+		t.Fatalf("rewriteKeys failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		action   ActionStats
+		expected string
+	}{
+		{
+			name:     "mirred",
+			action:   ActionStats{Type: "mirred", Operation: "Egress Mirror", TargetDev: "eth1"},
+			expected: "mirred (Egress Mirror to device eth1)",
+		},
+		{
+			name:     "gact",
+			action:   ActionStats{Type: "gact", Operation: "pass"},
+			expected: "gact pass",
+		},
+		{
+			name:     "skbmod",
+			action:   ActionStats{Type: "skbmod", Skbmod: &SkbmodAction{DstMAC: "52:54:00:12:34:56", SrcMAC: "52:54:00:00:00:01"}},
+			expected: "skbmod set dmac 52:54:00:12:34:56 set smac 52:54:00:00:00:01",
+		},
+		{
+			name: "pedit IPv4",
+			action: ActionStats{Type: "pedit", Pedit: &PeditAction{Keys: []PeditKey{
+				{HeaderType: "ipv4", Offset: 16, Cmd: "set", Value: 0x0a000064},
+				{HeaderType: "ipv4", Offset: 12, Cmd: "set", Value: 0xc0a80101},
+			}}},
+			expected: "pedit ip dst set 10.0.0.100, ip src set 192.168.1.1",
+		},
+		{
+			name:     "pedit IPv6",
+			action:   ActionStats{Type: "pedit", Pedit: &PeditAction{Keys: ipv6Keys}},
+			expected: "pedit ip6 src set 2001:db8::100",
+		},
+		{
+			name: "pedit raw keys",
+			action: ActionStats{Type: "pedit", Pedit: &PeditAction{Keys: []PeditKey{
+				{HeaderType: "tcp", Offset: 0, Cmd: "set", Value: 0x1f900000, Mask: 0x0000ffff},
+				{Offset: 8, Cmd: "add", Value: 0xff000000},
+			}}},
+			expected: "pedit tcp+0 set 1f900000 mask 0000ffff, 8 add ff000000",
+		},
+		{
+			name:     "csum",
+			action:   ActionStats{Type: "csum", Csum: &CsumAction{Targets: []string{"iph", "udp"}}},
+			expected: "csum iph, udp",
+		},
+		{
+			name:     "police",
+			action:   ActionStats{Type: "police", Police: &PoliceAction{Rate: 125000, Burst: 10240}},
+			expected: "police rate 1Mbit burst 10.0 KB",
+		},
+		{
+			name:     "unknown kind",
+			action:   ActionStats{Type: "vlan"},
+			expected: "vlan",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.action.Describe(); got != tc.expected {
+				t.Errorf("Expected '%s', got '%s'", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewriteKeysRejectsMixedFamilies(t *testing.T) {
+	if _, err := rewriteKeys(&filter.RewriteOptions{DstIP: "10.0.0.100"}, true); err == nil {
+		t.Error("Expected an error for an IPv4 rewrite on IPv6 traffic")
+	}
+	if _, err := rewriteKeys(&filter.RewriteOptions{SrcIP: "2001:db8::1"}, false); err == nil {
+		t.Error("Expected an error for an IPv6 rewrite on IPv4 traffic")
+	}
+}
+
+func TestRatesAndSizes(t *testing.T) {
+	for _, tc := range []struct {
+		rate string
+		want uint64
+	}{
+		{"1Mbit", 125000},
+		{"500Kbit", 62500},
+		{"8bit", 1},
+		{"1Gbps", 1000000000},
+		{"1Mibit", 131072},
+	} {
+		got, err := parseRate(tc.rate)
+		if err != nil || got != tc.want {
+			t.Errorf("parseRate(%q) = %d, %v; want %d", tc.rate, got, err, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		size string
+		want uint64
+	}{
+		{"1600b", 1600},
+		{"10Kb", 10240},
+		{"1.5Kb", 1536},
+		{"2Mb", 2 << 20},
+	} {
+		got, err := parseSize(tc.size)
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", tc.size, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "fast", "10furlongs"} {
+		if _, err := parseRate(bad); err == nil {
+			t.Errorf("Expected an error for rate %q", bad)
+		}
+	}
+
+	for _, tc := range []struct {
+		rate uint64
+		want string
+	}{
+		{125000, "1Mbit"},
+		{62500, "500Kbit"},
+		{1, "8bit"},
+		{125125, "1001Kbit"},
+		{125000000, "1Gbit"},
+	} {
+		if got := formatRate(tc.rate); got != tc.want {
+			t.Errorf("formatRate(%d) = %s, want %s", tc.rate, got, tc.want)
+		}
+	}
+}
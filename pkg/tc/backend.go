@@ -0,0 +1,91 @@
+package tc
+
+import (
+	"fmt"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// Names of the available backends, as accepted by NewBackend and the
+// --backend CLI flag.
+const (
+	BackendExec    = "exec"
+	BackendNetlink = "netlink"
+)
+
+// Backend programs clsact qdiscs and mirror filters on the host.
+// Runner implements it by shelling out to the tc binary, NetlinkBackend by
+// talking rtnetlink directly, and FakeBackend in memory for tests.
+type Backend interface {
+	// EnsureClsactQdisc attaches a clsact qdisc to iface unless one is already present.
+	EnsureClsactQdisc(iface string) error
+	// DeleteClsactQdisc removes the clsact qdisc from iface. A missing qdisc is not an error.
+	DeleteClsactQdisc(iface string) error
+	// HasClsactQdisc reports whether iface has a clsact qdisc attached.
+	HasClsactQdisc(iface string) (bool, error)
+	// AddMirrorFilter installs a flower filter on iface that mirrors or redirects matching traffic to target,
+	// with the preference and handle of id on every hook. It fails if the preference is taken. The filters
+	// installed are returned, also when a later hook of a "both" direction fails.
+	AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) ([]FilterRef, error)
+	// AddPassFilter installs a flower filter on iface that lets matching traffic through, so the
+	// filters behind it never see it. id and the returned filters work as for AddMirrorFilter.
+	AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) ([]FilterRef, error)
+	// DeleteFilter removes the filters with preference pref from a hook of iface. A missing filter is not an error.
+	DeleteFilter(iface, hook string, pref int) error
+	// ListFilterStats returns the filters attached to the given hook of iface together with their counters.
+	ListFilterStats(iface, hook string) ([]FilterStats, error)
+}
+
+var (
+	_ Backend = (*Runner)(nil)
+	_ Backend = (*NetlinkBackend)(nil)
+	_ Backend = (*FakeBackend)(nil)
+)
+
+// FilterRef identifies a filter tcbroker installed.
+type FilterRef struct {
+	Iface    string
+	Hook     string
+	Priority int
+}
+
+// NewBackend returns the backend registered under name.
+func NewBackend(name string, debug, dryRun bool) (Backend, error) {
+	switch name {
+	case "", BackendExec:
+		return NewRunner(debug, dryRun), nil
+	case BackendNetlink:
+		return NewNetlinkBackend(debug, dryRun)
+	default:
+		return nil, fmt.Errorf("unknown backend '%s' (expected %s or %s)", name, BackendExec, BackendNetlink)
+	}
+}
+
+// hooksForDirection expands a rule direction into the clsact hooks it uses.
+func hooksForDirection(direction string) ([]string, error) {
+	switch direction {
+	case "ingress":
+		return []string{"ingress"}, nil
+	case "egress":
+		return []string{"egress"}, nil
+	case "both":
+		return []string{"ingress", "egress"}, nil
+	default:
+		return nil, fmt.Errorf("invalid direction '%s'", direction)
+	}
+}
+
+// toFilterRewrite converts config rewrite options into the form used by the
+// filter builders.
+func toFilterRewrite(rewrite *config.RewriteOptions) *filter.RewriteOptions {
+	if rewrite == nil {
+		return nil
+	}
+	return &filter.RewriteOptions{
+		DstMAC: rewrite.DstMAC,
+		SrcMAC: rewrite.SrcMAC,
+		DstIP:  rewrite.DstIP,
+		SrcIP:  rewrite.SrcIP,
+	}
+}
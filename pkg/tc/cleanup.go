@@ -2,25 +2,101 @@ package tc
 
 import (
 	"fmt"
+
 	"tcbroker/pkg/config"
 )
 
-// Cleanup removes all tc configurations (qdisc and filters) for the interfaces
-// specified in the given configuration.
-// This is done by deleting the clsact qdisc from each interface, which implicitly
-// removes all attached filters.
-func (r *Runner) Cleanup(cfg *config.Config) error {
+// Cleanup removes the filters tcbroker installed on the interfaces specified
+// in the given configuration. Filters are recognized by their preference,
+// which lies in the range reserved for tcbroker; anything else attached to the
+// same clsact qdisc is left alone. The clsact qdisc itself is only deleted
+// once no filters remain on either of its hooks.
+func Cleanup(b Backend, cfg *config.Config) error {
 	// Collect unique source interfaces from rules
 	interfaceMap := make(map[string]bool)
 	for _, rule := range cfg.Rules {
 		interfaceMap[rule.SrcIntf] = true
 	}
 
-	// Delete clsact qdisc from each source interface
 	for ifaceName := range interfaceMap {
-		if err := r.DeleteClsactQdisc(ifaceName); err != nil {
+		if err := cleanupInterface(b, ifaceName); err != nil {
 			return fmt.Errorf("failed to cleanup %s: %w", ifaceName, err)
 		}
 	}
 	return nil
 }
+
+// CleanupRule removes the filters of the named rule, and only those: they are
+// recognized by the block of preferences the rule's priority owns on its
+// source interface. The clsact qdisc stays in place.
+func CleanupRule(b Backend, cfg *config.Config, name string) error {
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		if rule.Name != name {
+			continue
+		}
+
+		hasClsact, err := b.HasClsactQdisc(rule.SrcIntf)
+		if err != nil || !hasClsact {
+			return err
+		}
+		// Both hooks, in case the rule's direction changed since it was installed
+		for _, hook := range []string{"ingress", "egress"} {
+			filters, err := b.ListFilterStats(rule.SrcIntf, hook)
+			if err != nil {
+				return err
+			}
+			deleted := make(map[int]bool)
+			for _, f := range filters {
+				if RulePriority(f.Priority) != priorities[i] || deleted[f.Priority] {
+					continue
+				}
+				if err := b.DeleteFilter(rule.SrcIntf, hook, f.Priority); err != nil {
+					return fmt.Errorf("failed to remove filter pref %d from %s (%s): %w", f.Priority, rule.SrcIntf, hook, err)
+				}
+				deleted[f.Priority] = true
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no rule named '%s' in the configuration", name)
+}
+
+func cleanupInterface(b Backend, ifaceName string) error {
+	hasClsact, err := b.HasClsactQdisc(ifaceName)
+	if err != nil {
+		return err
+	}
+	if !hasClsact {
+		return nil
+	}
+
+	foreign := 0
+	for _, hook := range []string{"ingress", "egress"} {
+		filters, err := b.ListFilterStats(ifaceName, hook)
+		if err != nil {
+			return err
+		}
+
+		deleted := make(map[int]bool)
+		for _, f := range filters {
+			if !f.IsOwned() {
+				foreign++
+				continue
+			}
+			if deleted[f.Priority] {
+				continue
+			}
+			if err := b.DeleteFilter(ifaceName, hook, f.Priority); err != nil {
+				return err
+			}
+			deleted[f.Priority] = true
+		}
+	}
+
+	// Other tools still rely on the qdisc
+	if foreign > 0 {
+		return nil
+	}
+	return b.DeleteClsactQdisc(ifaceName)
+}
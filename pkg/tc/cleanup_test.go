@@ -0,0 +1,30 @@
+package tc
+
+import (
+	"testing"
+)
+
+func TestCleanupRule(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	// A filter of another tool sharing the qdisc
+	key := FakeKey("eth0", "ingress")
+	b.Filters[key] = append(b.Filters[key], FilterStats{Priority: 1, Matches: map[string]string{"ip_proto": "tcp"}})
+
+	if err := CleanupRule(b, cfg, "http-mirror"); err != nil {
+		t.Fatalf("CleanupRule failed: %v", err)
+	}
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	if len(filters) != 2 || filters[0].Priority != 30200 || filters[1].Priority != 1 {
+		t.Errorf("Expected only the DNS filter and the foreign filter to remain, got %+v", filters)
+	}
+	if !b.Qdiscs["eth0"] {
+		t.Error("Expected the clsact qdisc to stay")
+	}
+
+	if err := CleanupRule(b, cfg, "missing"); err == nil {
+		t.Error("Expected an error for an unknown rule")
+	}
+}
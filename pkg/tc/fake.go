@@ -0,0 +1,174 @@
+package tc
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// FakeBackend is an in-memory Backend for tests. It models clsact qdiscs,
+// the flower filters attached to each hook and their action counters, without
+// touching the host.
+type FakeBackend struct {
+	// Qdiscs records which interfaces have a clsact qdisc.
+	Qdiscs map[string]bool
+	// Filters holds the filters per interface and hook, keyed by FakeKey.
+	Filters map[string][]FilterStats
+	// Calls lists every operation in the order it was made, e.g. "EnsureClsactQdisc eth0".
+	Calls []string
+	// Fail is consulted before every operation. A non-nil return value is
+	// returned to the caller and the operation has no effect.
+	Fail func(op, iface string) error
+}
+
+// NewFakeBackend creates an empty FakeBackend.
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		Qdiscs:  make(map[string]bool),
+		Filters: make(map[string][]FilterStats),
+	}
+}
+
+// FakeKey returns the key FakeBackend uses for the filters on a hook.
+func FakeKey(iface, hook string) string {
+	return iface + "/" + hook
+}
+
+func (b *FakeBackend) call(op, iface string) error {
+	b.Calls = append(b.Calls, op+" "+iface)
+	if b.Fail != nil {
+		return b.Fail(op, iface)
+	}
+	return nil
+}
+
+// EnsureClsactQdisc attaches a clsact qdisc to iface unless one is already present.
+func (b *FakeBackend) EnsureClsactQdisc(iface string) error {
+	if err := b.call("EnsureClsactQdisc", iface); err != nil {
+		return err
+	}
+	b.Qdiscs[iface] = true
+	return nil
+}
+
+// DeleteClsactQdisc removes the clsact qdisc and every filter attached to it.
+func (b *FakeBackend) DeleteClsactQdisc(iface string) error {
+	if err := b.call("DeleteClsactQdisc", iface); err != nil {
+		return err
+	}
+	delete(b.Qdiscs, iface)
+	delete(b.Filters, FakeKey(iface, "ingress"))
+	delete(b.Filters, FakeKey(iface, "egress"))
+	return nil
+}
+
+// HasClsactQdisc reports whether iface has a clsact qdisc attached.
+func (b *FakeBackend) HasClsactQdisc(iface string) (bool, error) {
+	if err := b.call("HasClsactQdisc", iface); err != nil {
+		return false, err
+	}
+	return b.Qdiscs[iface], nil
+}
+
+// AddMirrorFilter records a filter as tc would report it back. Like
+// tc, it fails when iface has no clsact qdisc.
+func (b *FakeBackend) AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) ([]FilterRef, error) {
+	if err := b.call("AddMirrorFilter", ifaceName); err != nil {
+		return nil, err
+	}
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+	if !b.Qdiscs[ifaceName] {
+		return nil, fmt.Errorf("failed to add mirror filter to %s: no clsact qdisc", ifaceName)
+	}
+
+	return b.addFilters(ifaceName, hooks, id, expectedFilterStats(id, target, f, toFilterRewrite(rewrite)))
+}
+
+// AddPassFilter records a pass filter as tc would report it back. Like tc,
+// it fails when iface has no clsact qdisc.
+func (b *FakeBackend) AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) ([]FilterRef, error) {
+	if err := b.call("AddPassFilter", ifaceName); err != nil {
+		return nil, err
+	}
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+	if !b.Qdiscs[ifaceName] {
+		return nil, fmt.Errorf("failed to add pass filter to %s: no clsact qdisc", ifaceName)
+	}
+	return b.addFilters(ifaceName, hooks, id, expectedPassFilterStats(id, f))
+}
+
+// addFilters records fs on every hook, in preference order like tc lists
+// them. Like the kernel, it refuses a preference that is already taken.
+func (b *FakeBackend) addFilters(ifaceName string, hooks []string, id FilterID, fs FilterStats) ([]FilterRef, error) {
+	var installed []FilterRef
+	for _, hook := range hooks {
+		key := FakeKey(ifaceName, hook)
+		filters := b.Filters[key]
+		i := sort.Search(len(filters), func(i int) bool { return filters[i].Priority >= id.Pref })
+		if i < len(filters) && filters[i].Priority == id.Pref {
+			return installed, fmt.Errorf("failed to add filter to %s (%s): preference %d is taken", ifaceName, hook, id.Pref)
+		}
+		stored := fs
+		stored.Matches = maps.Clone(fs.Matches)
+		stored.Actions = slices.Clone(fs.Actions)
+		b.Filters[key] = slices.Insert(filters, i, stored)
+		installed = append(installed, FilterRef{Iface: ifaceName, Hook: hook, Priority: id.Pref})
+	}
+	return installed, nil
+}
+
+// DeleteFilter removes the filters with preference pref from a hook of iface.
+func (b *FakeBackend) DeleteFilter(iface, hook string, pref int) error {
+	if err := b.call("DeleteFilter", iface); err != nil {
+		return err
+	}
+	key := FakeKey(iface, hook)
+	var kept []FilterStats
+	for _, f := range b.Filters[key] {
+		if f.Priority != pref {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == 0 {
+		delete(b.Filters, key)
+	} else {
+		b.Filters[key] = kept
+	}
+	return nil
+}
+
+// ListFilterStats returns a copy of the filters on the given hook of iface.
+func (b *FakeBackend) ListFilterStats(iface, hook string) ([]FilterStats, error) {
+	if err := b.call("ListFilterStats", iface); err != nil {
+		return nil, err
+	}
+	filters := make([]FilterStats, len(b.Filters[FakeKey(iface, hook)]))
+	copy(filters, b.Filters[FakeKey(iface, hook)])
+	return filters, nil
+}
+
+// Count adds traffic to the counters of every action of the index-th filter
+// on the given hook, as if packets had matched it.
+func (b *FakeBackend) Count(iface, hook string, index int, packets, bytes int64) {
+	filters := b.Filters[FakeKey(iface, hook)]
+	if index < 0 || index >= len(filters) {
+		return
+	}
+	actions := make([]ActionStats, len(filters[index].Actions))
+	for i, action := range filters[index].Actions {
+		action.Packets += packets
+		action.Bytes += bytes
+		actions[i] = action
+	}
+	filters[index].Actions = actions
+}
@@ -2,49 +2,99 @@ package tc
 
 import (
 	"fmt"
+	"strconv"
 
 	"tcbroker/pkg/config"
 	"tcbroker/pkg/filter"
 )
 
-// AddMirrorFilter adds a new filter to the given interface that mirrors traffic
-// to the target interface. It attaches the filter to the appropriate hook (ingress/egress)
-// on the clsact qdisc. Optionally supports packet rewriting.
-// Command: `tc filter add dev <iface> <hook> protocol <proto> flower <matchers> action mirred egress mirror dev <target>`
-func (r *Runner) AddMirrorFilter(ifaceName, direction, target string, f filter.Filter, rewrite *config.RewriteOptions) error {
-	directions := []string{}
-	switch direction {
-	case "ingress":
-		directions = append(directions, "ingress")
-	case "egress":
-		directions = append(directions, "egress")
-	case "both":
-		directions = append(directions, "ingress", "egress")
-	default:
-		return fmt.Errorf("invalid direction '%s'", direction)
-	}
-
-	for _, hook := range directions {
+// AddMirrorFilter adds a new filter to the given interface that mirrors or
+// redirects traffic to the target interface. It attaches the filter to the appropriate hook (ingress/egress)
+// on the clsact qdisc. Optionally supports packet rewriting. The filter is
+// installed with the preference and handle of id. The filters installed so
+// far are returned even when a later hook fails.
+// Command: `tc filter add dev <iface> <hook> pref <pref> protocol <proto> handle <handle> flower <matchers> action mirred <egress|ingress> <mirror|redirect> dev <target>`
+func (r *Runner) AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) ([]FilterRef, error) {
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []FilterRef
+	for _, hook := range hooks {
 		var args []string
 
 		// Use BuildTCArgsWithRewrite if rewrite options are provided
 		if rewrite != nil {
-			// Convert config.RewriteOptions to filter.RewriteOptions
-			filterRewrite := &filter.RewriteOptions{
-				DstMAC: rewrite.DstMAC,
-				SrcMAC: rewrite.SrcMAC,
-				DstIP:  rewrite.DstIP,
-				SrcIP:  rewrite.SrcIP,
-			}
-			args = filter.BuildTCArgsWithRewrite(ifaceName, hook, target, f, filterRewrite)
+			args = filter.BuildTCArgsWithRewrite(ifaceName, hook, target, id, f, toFilterRewrite(rewrite))
 		} else {
-			args = filter.BuildTCArgs(ifaceName, hook, target, f)
+			args = filter.BuildTCArgs(ifaceName, hook, target, id, f)
 		}
 
 		_, stderr, err := r.Run(args...)
 		if err != nil {
-			return fmt.Errorf("failed to add mirror filter to %s (%s): %w, stderr: %s", ifaceName, hook, err, stderr)
+			return installed, fmt.Errorf("failed to add mirror filter to %s (%s): %w, stderr: %s", ifaceName, hook, err, stderr)
+		}
+		installed = append(installed, FilterRef{Iface: ifaceName, Hook: hook, Priority: id.Pref})
+	}
+	return installed, nil
+}
+
+// hasFilter reports whether a hook of iface has filters with preference
+// pref, asking tc rather than reading its error messages. An interface or
+// clsact qdisc that is gone has none.
+func (r *Runner) hasFilter(iface, hook string, pref int) (bool, error) {
+	if !linkExists(iface) {
+		return false, nil
+	}
+	present, err := r.HasClsactQdisc(iface)
+	if err != nil || !present {
+		return false, err
+	}
+	filters, err := r.ListFilterStats(iface, hook)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range filters {
+		if f.Priority == pref {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddPassFilter adds a filter to the given interface that accepts matching
+// traffic, ending classification for it, with the preference and handle of
+// id on each hook. The filters installed so far are returned even when a
+// later hook fails.
+// Command: `tc filter add dev <iface> <hook> pref <pref> protocol <proto> handle <handle> flower <matchers> action pass`
+func (r *Runner) AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) ([]FilterRef, error) {
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []FilterRef
+	for _, hook := range hooks {
+		_, stderr, err := r.Run(filter.BuildPassArgs(ifaceName, hook, id, f)...)
+		if err != nil {
+			return installed, fmt.Errorf("failed to add pass filter to %s (%s): %w, stderr: %s", ifaceName, hook, err, stderr)
+		}
+		installed = append(installed, FilterRef{Iface: ifaceName, Hook: hook, Priority: id.Pref})
+	}
+	return installed, nil
+}
+
+// DeleteFilter removes the filters with the given preference from a hook of
+// iface. Filters that are already gone are not an error.
+// Command: `tc filter del dev <iface> <hook> pref <pref>`
+func (r *Runner) DeleteFilter(iface, hook string, pref int) error {
+	_, stderr, err := r.Run("filter", "del", "dev", iface, hook, "pref", strconv.Itoa(pref))
+	if err != nil {
+		if exists, qerr := r.hasFilter(iface, hook, pref); qerr == nil && !exists {
+			return nil
 		}
+		return fmt.Errorf("failed to delete filter pref %d from %s (%s): %w, stderr: %s", pref, iface, hook, err, stderr)
 	}
 	return nil
 }
@@ -0,0 +1,281 @@
+package tc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Qdisc is a qdisc as `tc -j qdisc show` reports it.
+type Qdisc struct {
+	Kind   string `json:"kind"`
+	Handle string `json:"handle"`
+	Parent string `json:"parent"`
+	Root   bool   `json:"root"`
+}
+
+// filterJSON is one entry of `tc -s -j filter show`. tc lists every
+// preference once without options before the filters installed at it.
+type filterJSON struct {
+	Protocol string             `json:"protocol"`
+	Pref     int                `json:"pref"`
+	Kind     string             `json:"kind"`
+	Chain    int                `json:"chain"`
+	Options  *filterOptionsJSON `json:"options"`
+}
+
+// filterOptionsJSON holds the classifier specific part of a filter. flower
+// prints its handle as a number, u32 as a "fh" string.
+type filterOptionsJSON struct {
+	Handle  *uint32                    `json:"handle"`
+	FH      string                     `json:"fh"`
+	Keys    map[string]json.RawMessage `json:"keys"`
+	Actions []actionJSON               `json:"actions"`
+}
+
+// actionJSON is one action of a filter. The fields after Kind are only set
+// by the actions that print them.
+type actionJSON struct {
+	Order         int               `json:"order"`
+	Kind          string            `json:"kind"`
+	ControlAction controlActionJSON `json:"control_action"`
+	Index         int               `json:"index"`
+	Installed     int64             `json:"installed"`
+	LastUsed      int64             `json:"last_used"`
+	Stats         actionStatsJSON   `json:"stats"`
+	Cookie        string            `json:"cookie"`
+
+	// mirred
+	MirredAction string `json:"mirred_action"`
+	Direction    string `json:"direction"`
+	ToDev        string `json:"to_dev"`
+
+	// skbmod
+	DMAC string `json:"dmac"`
+	SMAC string `json:"smac"`
+
+	// pedit
+	Keys []peditKeyJSON `json:"keys"`
+
+	// csum, e.g. "iph, tcp"
+	Csum string `json:"csum"`
+
+	// police, as numbers of bytes (per second) or, in some versions of tc,
+	// as the strings of the text output
+	Rate  json.RawMessage `json:"rate"`
+	Burst json.RawMessage `json:"burst"`
+}
+
+// peditKeyJSON is one key of a pedit action. The value and mask are hex
+// without a 0x prefix.
+type peditKeyJSON struct {
+	HType  string `json:"htype"`
+	Offset int    `json:"offset"`
+	Cmd    string `json:"cmd"`
+	Val    string `json:"val"`
+	Mask   string `json:"mask"`
+}
+
+// controlActionJSON is the verdict of an action, e.g. pipe or pass.
+type controlActionJSON struct {
+	Type string `json:"type"`
+}
+
+// actionStatsJSON holds the counters of an action.
+type actionStatsJSON struct {
+	Bytes      int64 `json:"bytes"`
+	Packets    int64 `json:"packets"`
+	Drops      int64 `json:"drops"`
+	Overlimits int64 `json:"overlimits"`
+	Requeues   int64 `json:"requeues"`
+	Backlog    int64 `json:"backlog"`
+	Qlen       int64 `json:"qlen"`
+}
+
+// portRangeJSON is how flower prints a port range key.
+type portRangeJSON struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// isJSON reports whether tc output is a JSON array rather than text, which
+// versions of tc that ignore -j print.
+func isJSON(output string) bool {
+	return strings.HasPrefix(strings.TrimSpace(output), "[")
+}
+
+// ParseFilterStatsJSON decodes the output of `tc -s -j filter show` into the
+// same FilterStats ParseFilterStats reads from the text output.
+func ParseFilterStatsJSON(data []byte) ([]FilterStats, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []FilterStats{}, nil
+	}
+	var entries []filterJSON
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode tc filter JSON: %w", err)
+	}
+
+	filters := []FilterStats{}
+	for _, e := range entries {
+		// Skip the per-preference entries that carry no filter
+		if e.Options == nil || (e.Options.Handle == nil && e.Options.FH == "") {
+			continue
+		}
+		fs := FilterStats{
+			Protocol:  e.Protocol,
+			Priority:  e.Pref,
+			Handle:    e.Options.FH,
+			Chain:     e.Chain,
+			MatchType: e.Kind,
+			Matches:   make(map[string]string),
+			Actions:   []ActionStats{},
+		}
+		if e.Options.Handle != nil {
+			fs.Handle = fmt.Sprintf("0x%x", *e.Options.Handle)
+		}
+		for key, raw := range e.Options.Keys {
+			value, err := keyValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode flower key '%s': %w", key, err)
+			}
+			fs.Matches[key] = value
+		}
+		for _, a := range e.Options.Actions {
+			fs.Actions = append(fs.Actions, a.stats())
+		}
+		filters = append(filters, fs)
+	}
+	return filters, nil
+}
+
+// keyValue renders a flower key the way the text output prints it: strings
+// as they are, numbers in decimal and port ranges as "start-end".
+func keyValue(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String(), nil
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return strconv.FormatBool(b), nil
+	}
+	var r portRangeJSON
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End), nil
+}
+
+// stats converts a decoded action into its ActionStats.
+func (a *actionJSON) stats() ActionStats {
+	action := ActionStats{
+		Type:         a.Kind,
+		Packets:      a.Stats.Packets,
+		Bytes:        a.Stats.Bytes,
+		Dropped:      a.Stats.Drops,
+		Overlimits:   a.Stats.Overlimits,
+		Requeues:     a.Stats.Requeues,
+		BacklogBytes: a.Stats.Backlog,
+		BacklogPkts:  a.Stats.Qlen,
+		Installed:    fmt.Sprintf("%d sec", a.Installed),
+		Used:         fmt.Sprintf("%d sec", a.LastUsed),
+		Cookie:       a.Cookie,
+	}
+	switch a.Kind {
+	case "mirred":
+		if a.Direction != "" && a.MirredAction != "" {
+			action.Operation = mirredOperationName(a.Direction, a.MirredAction)
+		}
+		action.TargetDev = a.ToDev
+	case "gact":
+		action.Operation = a.ControlAction.Type
+	case "skbmod":
+		action.Skbmod = &SkbmodAction{DstMAC: a.DMAC, SrcMAC: a.SMAC}
+	case "pedit":
+		action.Pedit = &PeditAction{}
+		for _, k := range a.Keys {
+			key := PeditKey{HeaderType: k.HType, Offset: k.Offset, Cmd: k.Cmd}
+			if key.HeaderType == "network" {
+				key.HeaderType = ""
+			}
+			if v, err := strconv.ParseUint(k.Val, 16, 32); err == nil {
+				key.Value = uint32(v)
+			}
+			if v, err := strconv.ParseUint(k.Mask, 16, 32); err == nil {
+				key.Mask = uint32(v)
+			}
+			action.Pedit.Keys = append(action.Pedit.Keys, key)
+		}
+	case "csum":
+		action.Csum = &CsumAction{}
+		if a.Csum != "" {
+			action.Csum.Targets = strings.Split(a.Csum, ", ")
+		}
+	case "police":
+		action.Police = &PoliceAction{
+			Rate:  jsonQuantity(a.Rate, parseRate),
+			Burst: jsonQuantity(a.Burst, parseSize),
+		}
+	}
+	return action
+}
+
+// jsonQuantity reads a number, or a string in the format parse reads, and
+// returns 0 if raw is neither.
+func jsonQuantity(raw json.RawMessage, parse func(string) (uint64, error)) uint64 {
+	var n uint64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if n, err := parse(s); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// ParseQdiscs decodes the output of `tc -j qdisc show`.
+func ParseQdiscs(data []byte) ([]Qdisc, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []Qdisc{}, nil
+	}
+	var qdiscs []Qdisc
+	if err := json.Unmarshal(data, &qdiscs); err != nil {
+		return nil, fmt.Errorf("failed to decode tc qdisc JSON: %w", err)
+	}
+	return qdiscs, nil
+}
+
+// parseQdiscsText reads the kind, handle and parent of every qdisc from the
+// text output of `tc qdisc show`, e.g.
+// "qdisc clsact ffff: parent ffff:fff1".
+func parseQdiscsText(output string) []Qdisc {
+	qdiscs := []Qdisc{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "qdisc" {
+			continue
+		}
+		q := Qdisc{Kind: fields[1], Handle: fields[2]}
+		for i := 3; i < len(fields); i++ {
+			switch fields[i] {
+			case "root":
+				q.Root = true
+			case "parent":
+				if i+1 < len(fields) {
+					q.Parent = fields[i+1]
+				}
+			}
+		}
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs
+}
@@ -0,0 +1,186 @@
+package tc
+
+import (
+	"reflect"
+	"testing"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+func TestParseFilterStatsJSON(t *testing.T) {
+	sampleOutput := `[{"protocol":"ip","pref":30100,"kind":"flower","chain":0},{"protocol":"ip","pref":30100,"kind":"flower","chain":0,"options":{"handle":1,"keys":{"eth_type":"ipv4","ip_proto":"tcp","dst_ip":"10.0.0.1","dst_port":80},"not_in_hw":true,"actions":[` +
+		`{"order":1,"kind":"skbmod","control_action":{"type":"pipe"},"dmac":"52:54:00:12:34:56","index":1,"ref":1,"bind":1,"installed":30,"last_used":5,"stats":{"bytes":840,"packets":10,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0},"cookie":"9f1c2a7d3b5e4f60"},` +
+		`{"order":2,"kind":"pedit","control_action":{"type":"pipe"},"nkeys":1,"index":1,"ref":1,"bind":1,"installed":30,"last_used":5,"keys":[{"htype":"ipv4","offset":16,"cmd":"set","val":"a000064","mask":"0"}],"stats":{"bytes":840,"packets":10,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0},"cookie":"9f1c2a7d3b5e4f60"},` +
+		`{"order":3,"kind":"csum","csum":"iph, tcp","control_action":{"type":"pipe"},"index":1,"ref":1,"bind":1,"installed":30,"last_used":5,"stats":{"bytes":840,"packets":10,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0},"cookie":"9f1c2a7d3b5e4f60"},` +
+		`{"order":4,"kind":"mirred","mirred_action":"mirror","direction":"egress","to_dev":"ids0","control_action":{"type":"pipe"},"index":1,"ref":1,"bind":1,"installed":30,"last_used":5,"stats":{"bytes":840,"packets":10,"drops":1,"overlimits":2,"requeues":0,"backlog":64,"qlen":1},"cookie":"9f1c2a7d3b5e4f60"},` +
+		`{"order":5,"kind":"mirred","mirred_action":"mirror","direction":"egress","to_dev":"rec 0","control_action":{"type":"continue"},"index":2,"ref":1,"bind":1,"installed":30,"last_used":5,"stats":{"bytes":420,"packets":5,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0},"cookie":"9f1c2a7d3b5e4f60"}` +
+		`]}}]`
+
+	filters, err := ParseFilterStatsJSON([]byte(sampleOutput))
+	if err != nil {
+		t.Fatalf("ParseFilterStatsJSON failed: %v", err)
+	}
+	if len(filters) != 1 {
+		t.Fatalf("Expected 1 filter, got %d", len(filters))
+	}
+	f := filters[0]
+	if f.Protocol != "ip" || f.Priority != 30100 || f.Handle != "0x1" || f.MatchType != "flower" {
+		t.Errorf("Unexpected filter header: %+v", f)
+	}
+	expectedMatches := map[string]string{"eth_type": "ipv4", "ip_proto": "tcp", "dst_ip": "10.0.0.1", "dst_port": "80"}
+	if !reflect.DeepEqual(f.Matches, expectedMatches) {
+		t.Errorf("Expected matches %v, got %v", expectedMatches, f.Matches)
+	}
+
+	expectedTypes := []string{"skbmod", "pedit", "csum", "mirred", "mirred"}
+	if len(f.Actions) != len(expectedTypes) {
+		t.Fatalf("Expected %d actions, got %d", len(expectedTypes), len(f.Actions))
+	}
+	for i, want := range expectedTypes {
+		if f.Actions[i].Type != want || f.Actions[i].Cookie != "9f1c2a7d3b5e4f60" {
+			t.Errorf("Expected %s action with cookie at %d, got %+v", want, i+1, f.Actions[i])
+		}
+	}
+	ids := f.Actions[3]
+	expected := ActionStats{
+		Type:         "mirred",
+		Operation:    "Egress Mirror",
+		TargetDev:    "ids0",
+		Packets:      10,
+		Bytes:        840,
+		Dropped:      1,
+		Overlimits:   2,
+		BacklogBytes: 64,
+		BacklogPkts:  1,
+		Installed:    "30 sec",
+		Used:         "5 sec",
+		Cookie:       "9f1c2a7d3b5e4f60",
+	}
+	if ids != expected {
+		t.Errorf("Expected action:\n  %+v\ngot:\n  %+v", expected, ids)
+	}
+	if !reflect.DeepEqual(f.Actions[0].Skbmod, &SkbmodAction{DstMAC: "52:54:00:12:34:56"}) {
+		t.Errorf("Unexpected skbmod details: %+v", f.Actions[0].Skbmod)
+	}
+	expectedKeys := []PeditKey{{HeaderType: "ipv4", Offset: 16, Cmd: "set", Value: 0x0a000064}}
+	if f.Actions[1].Pedit == nil || !reflect.DeepEqual(f.Actions[1].Pedit.Keys, expectedKeys) {
+		t.Errorf("Expected pedit keys %+v, got %+v", expectedKeys, f.Actions[1].Pedit)
+	}
+	if f.Actions[2].Csum == nil || !reflect.DeepEqual(f.Actions[2].Csum.Targets, []string{"iph", "tcp"}) {
+		t.Errorf("Expected csum targets [iph tcp], got %+v", f.Actions[2].Csum)
+	}
+	// Values with spaces are read whole
+	if dev := f.Actions[4].TargetDev; dev != "rec 0" {
+		t.Errorf("Expected target device 'rec 0', got '%s'", dev)
+	}
+
+	// The decoded filter is the one tcbroker installs for the rule
+	desired := DesiredFilter{
+		ID:      FilterID{Pref: 30100, Handle: 1, Cookie: "9f1c2a7d3b5e4f60"},
+		Target:  filter.Mirred{Devs: []string{"ids0", "rec 0"}},
+		Filter:  filter.Filter{IPProto: "tcp", DstIP: "10.0.0.1", DstPort: filter.Port(80)},
+		Rewrite: &config.RewriteOptions{DstMAC: "52:54:00:12:34:56", DstIP: "10.0.0.100"},
+	}
+	if live, want := liveSignature(&f), desiredSignature(&desired); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+}
+
+func TestParseFilterStatsJSONKeys(t *testing.T) {
+	sampleOutput := `[{"protocol":"802.1Q","pref":30000,"kind":"flower","chain":0,"options":{"handle":2,"keys":{"vlan_id":100,"vlan_prio":3,"vlan_ethtype":"ipv4","ip_proto":"udp","src_port":53,"dst_port":{"start":8000,"end":8100}},"not_in_hw":true,"actions":[{"order":1,"kind":"gact","control_action":{"type":"pass"},"prob":{"random_type":"none","control_action":{"type":"pass"},"val":0},"index":1,"ref":1,"bind":1,"installed":12,"last_used":3,"stats":{"bytes":1200,"packets":20,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0}}]}}]`
+
+	filters, err := ParseFilterStatsJSON([]byte(sampleOutput))
+	if err != nil {
+		t.Fatalf("ParseFilterStatsJSON failed: %v", err)
+	}
+	if len(filters) != 1 || len(filters[0].Actions) != 1 {
+		t.Fatalf("Expected 1 filter with 1 action, got %+v", filters)
+	}
+	f := filters[0]
+	if f.Handle != "0x2" {
+		t.Errorf("Expected handle '0x2', got '%s'", f.Handle)
+	}
+	expectedMatches := map[string]string{
+		"vlan_id":      "100",
+		"vlan_prio":    "3",
+		"vlan_ethtype": "ipv4",
+		"ip_proto":     "udp",
+		"src_port":     "53",
+		"dst_port":     "8000-8100",
+	}
+	if !reflect.DeepEqual(f.Matches, expectedMatches) {
+		t.Errorf("Expected matches %v, got %v", expectedMatches, f.Matches)
+	}
+	if a := f.Actions[0]; a.Type != "gact" || a.Operation != "pass" || a.Packets != 20 {
+		t.Errorf("Expected gact pass with 20 packets, got %+v", a)
+	}
+}
+
+func TestParseFilterStatsJSONPolice(t *testing.T) {
+	for _, sampleOutput := range []string{
+		`[{"protocol":"all","pref":49152,"kind":"matchall","chain":0,"options":{"handle":1,"not_in_hw":true,"actions":[{"order":1,"kind":"police","index":1,"rate":125000,"burst":10240,"control_action":{"type":"drop"},"ref":1,"bind":1}]}}]`,
+		`[{"protocol":"all","pref":49152,"kind":"matchall","chain":0,"options":{"handle":1,"not_in_hw":true,"actions":[{"order":1,"kind":"police","index":1,"rate":"1Mbit","burst":"10Kb","control_action":{"type":"drop"},"ref":1,"bind":1}]}}]`,
+	} {
+		filters, err := ParseFilterStatsJSON([]byte(sampleOutput))
+		if err != nil {
+			t.Fatalf("ParseFilterStatsJSON failed: %v", err)
+		}
+		if len(filters) != 1 || len(filters[0].Actions) != 1 {
+			t.Fatalf("Expected 1 filter with 1 action, got %+v", filters)
+		}
+		if police := filters[0].Actions[0].Police; !reflect.DeepEqual(police, &PoliceAction{Rate: 125000, Burst: 10240}) {
+			t.Errorf("Unexpected police details: %+v", police)
+		}
+	}
+}
+
+func TestParseFilterStatsJSONU32(t *testing.T) {
+	sampleOutput := `[{"protocol":"all","pref":49152,"kind":"u32","chain":0},{"protocol":"all","pref":49152,"kind":"u32","chain":0,"options":{"fh":"800:","ht_divisor":1}},{"protocol":"all","pref":49152,"kind":"u32","chain":0,"options":{"fh":"800::800","order":2048,"key_ht":"800","bkt":"0","actions":[{"order":1,"kind":"gact","control_action":{"type":"drop"},"index":1,"ref":1,"bind":1,"installed":5,"last_used":5,"stats":{"bytes":0,"packets":0,"drops":0,"overlimits":0,"requeues":0,"backlog":0,"qlen":0}}]}}]`
+
+	filters, err := ParseFilterStatsJSON([]byte(sampleOutput))
+	if err != nil {
+		t.Fatalf("ParseFilterStatsJSON failed: %v", err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("Expected 2 filters, got %d", len(filters))
+	}
+	if filters[1].Handle != "800::800" || filters[1].MatchType != "u32" || filters[1].IsOwned() {
+		t.Errorf("Unexpected u32 filter: %+v", filters[1])
+	}
+	if len(filters[1].Actions) != 1 || filters[1].Actions[0].Operation != "drop" {
+		t.Errorf("Expected a gact drop action, got %+v", filters[1].Actions)
+	}
+}
+
+func TestParseFilterStatsJSONEmpty(t *testing.T) {
+	for _, output := range []string{"", "[]", "[]\n"} {
+		filters, err := ParseFilterStatsJSON([]byte(output))
+		if err != nil || len(filters) != 0 {
+			t.Errorf("Expected no filters for %q, got %v (err %v)", output, filters, err)
+		}
+	}
+	if _, err := ParseFilterStatsJSON([]byte(`[{"pref":"x"}]`)); err == nil {
+		t.Error("Expected an error for malformed JSON")
+	}
+}
+
+func TestParseQdiscs(t *testing.T) {
+	expected := []Qdisc{
+		{Kind: "noqueue", Handle: "0:", Root: true},
+		{Kind: "clsact", Handle: "ffff:", Parent: "ffff:fff1"},
+	}
+
+	qdiscs, err := ParseQdiscs([]byte(`[{"kind":"noqueue","handle":"0:","root":true,"refcnt":2,"options":{}},{"kind":"clsact","handle":"ffff:","parent":"ffff:fff1","options":{}}]`))
+	if err != nil {
+		t.Fatalf("ParseQdiscs failed: %v", err)
+	}
+	if !reflect.DeepEqual(qdiscs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, qdiscs)
+	}
+
+	text := "qdisc noqueue 0: root refcnt 2 \nqdisc clsact ffff: parent ffff:fff1 \n"
+	if qdiscs := parseQdiscsText(text); !reflect.DeepEqual(qdiscs, expected) {
+		t.Errorf("Expected %+v from text, got %+v", expected, qdiscs)
+	}
+}
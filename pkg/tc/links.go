@@ -0,0 +1,14 @@
+package tc
+
+// LinkEvent reports that a network interface was added, changed or deleted,
+// as RTM_NEWLINK and RTM_DELLINK notifications do. An event with an empty
+// Name means notifications were lost and every interface may have changed.
+// An event with Err set means the subscription failed; it is the last event
+// before the channel is closed.
+type LinkEvent struct {
+	Name    string
+	Index   int
+	Up      bool
+	Deleted bool
+	Err     error
+}
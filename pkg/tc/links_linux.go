@@ -0,0 +1,105 @@
+package tc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// rtmgrpLink is the multicast group of link notifications (RTMGRP_LINK).
+const rtmgrpLink = 0x1
+
+// linkPollInterval bounds how long WatchLinks takes to notice that its
+// context is done.
+const linkPollInterval = 500 * time.Millisecond
+
+// WatchLinks subscribes to link notifications and sends one LinkEvent per
+// RTM_NEWLINK and RTM_DELLINK until ctx is done, when the channel is closed.
+// If receiving fails, an event with the error is sent before the channel is
+// closed, and the caller has to subscribe again.
+func WatchLinks(ctx context.Context) (<-chan LinkEvent, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to subscribe to link notifications: %w", err)
+	}
+	// Receive with a timeout, so the context is checked regularly
+	tv := syscall.NsecToTimeval(linkPollInterval.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set netlink receive timeout: %w", err)
+	}
+
+	events := make(chan LinkEvent, 16)
+	send := func(ev LinkEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(events)
+		defer syscall.Close(fd)
+		buf := make([]byte, netlinkRecvBufSz)
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			switch {
+			case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+				continue
+			case errors.Is(err, syscall.ENOBUFS):
+				// The socket overran and notifications were dropped
+				if !send(LinkEvent{}) {
+					return
+				}
+				continue
+			case err != nil:
+				send(LinkEvent{Err: fmt.Errorf("failed to receive link notifications: %w", err)})
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if ev, ok := parseLinkMsg(m); ok && !send(ev) {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// parseLinkMsg decodes an RTM_NEWLINK or RTM_DELLINK notification. It
+// reports false for other messages and links without a name.
+func parseLinkMsg(m syscall.NetlinkMessage) (LinkEvent, bool) {
+	if m.Header.Type != syscall.RTM_NEWLINK && m.Header.Type != syscall.RTM_DELLINK {
+		return LinkEvent{}, false
+	}
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return LinkEvent{}, false
+	}
+	attrs, err := parseAttrs(m.Data[syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return LinkEvent{}, false
+	}
+	name, ok := attrMap(attrs)[syscall.IFLA_IFNAME]
+	if !ok {
+		return LinkEvent{}, false
+	}
+	flags := binary.NativeEndian.Uint32(m.Data[8:12])
+	return LinkEvent{
+		Name:    trimCString(name),
+		Index:   int(int32(binary.NativeEndian.Uint32(m.Data[4:8]))),
+		Up:      flags&syscall.IFF_UP != 0,
+		Deleted: m.Header.Type == syscall.RTM_DELLINK,
+	}, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tc
+
+import "context"
+
+// WatchLinks reports that link notifications are unsupported on this
+// platform.
+func WatchLinks(ctx context.Context) (<-chan LinkEvent, error) {
+	return nil, errNetlinkUnsupported
+}
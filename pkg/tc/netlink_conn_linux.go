@@ -0,0 +1,157 @@
+package tc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+const (
+	solNetlink       = 270
+	netlinkCapAck    = 10
+	netlinkExtAck    = 11
+	nlmFCapped       = 0x100
+	nlmFAckTLVs      = 0x200
+	nlmsgerrAttrMsg  = 1
+	sizeofNlMsghdr   = syscall.SizeofNlMsghdr
+	sizeofNlMsgerr   = 4 + syscall.SizeofNlMsghdr
+	netlinkRecvBufSz = 1 << 16
+)
+
+// NetlinkError is returned when the kernel rejects a netlink request. It
+// unwraps to the underlying errno, so callers can use
+// errors.Is(err, syscall.EEXIST) or errors.Is(err, syscall.ENOENT).
+type NetlinkError struct {
+	Errno syscall.Errno
+	Msg   string // extended ack message, if the kernel provided one
+}
+
+func (e *NetlinkError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("%s: %s", e.Errno.Error(), e.Msg)
+	}
+	return e.Errno.Error()
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Errno
+}
+
+// nlConn is a NETLINK_ROUTE socket used for a single tc operation.
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialNetlink() (*nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	// Extended acks give us the kernel's human readable reason for a failure.
+	// Capped acks keep error replies from echoing the whole request back.
+	// Both are best effort; older kernels simply ignore them.
+	_ = syscall.SetsockoptInt(fd, solNetlink, netlinkExtAck, 1)
+	_ = syscall.SetsockoptInt(fd, solNetlink, netlinkCapAck, 1)
+	return &nlConn{fd: fd}, nil
+}
+
+func (c *nlConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends one message and collects the replies. For dump requests the
+// payloads of all replies are returned; for everything else the kernel ack is
+// awaited and a nil slice is returned on success.
+func (c *nlConn) request(msgType uint16, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	c.seq++
+	b := make([]byte, sizeofNlMsghdr+len(payload))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(b[8:12], c.seq)
+	copy(b[sizeofNlMsghdr:], payload)
+
+	if err := syscall.Sendto(c.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to send netlink request: %w", err)
+	}
+
+	var replies []syscall.NetlinkMessage
+	buf := make([]byte, netlinkRecvBufSz)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive netlink reply: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse netlink reply: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				// A dump that fails midway reports the error in NLMSG_DONE.
+				if len(m.Data) >= 4 {
+					if code := int32(binary.NativeEndian.Uint32(m.Data[0:4])); code < 0 {
+						return nil, &NetlinkError{Errno: syscall.Errno(-code)}
+					}
+				}
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if err := parseNlMsgerr(m); err != nil {
+					return nil, err
+				}
+				return replies, nil
+			default:
+				// Copy out of the receive buffer, which is reused.
+				data := make([]byte, len(m.Data))
+				copy(data, m.Data)
+				replies = append(replies, syscall.NetlinkMessage{Header: m.Header, Data: data})
+			}
+		}
+	}
+}
+
+// parseNlMsgerr decodes an NLMSG_ERROR reply. A zero error code is an ack.
+func parseNlMsgerr(m syscall.NetlinkMessage) error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("truncated netlink error message")
+	}
+	code := int32(binary.NativeEndian.Uint32(m.Data[0:4]))
+	if code == 0 {
+		return nil
+	}
+	nerr := &NetlinkError{Errno: syscall.Errno(-code)}
+
+	if m.Header.Flags&nlmFAckTLVs != 0 {
+		off := sizeofNlMsgerr
+		if m.Header.Flags&nlmFCapped == 0 && len(m.Data) >= sizeofNlMsgerr {
+			// Uncapped errors carry the original request after the header.
+			off = 4 + int(binary.NativeEndian.Uint32(m.Data[4:8]))
+		}
+		if off < len(m.Data) {
+			if attrs, err := parseAttrs(m.Data[off:]); err == nil {
+				if msg, ok := attrMap(attrs)[nlmsgerrAttrMsg]; ok {
+					nerr.Msg = trimCString(msg)
+				}
+			}
+		}
+	}
+	return nerr
+}
+
+func trimCString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,1137 @@
+package tc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// userHZ is the clock_t resolution the kernel uses for action timestamps.
+const userHZ = 100
+
+// NetlinkBackend programs tc state over rtnetlink instead of running the tc
+// binary. Errors from the kernel are returned as *NetlinkError, so callers can
+// test them with errors.Is against syscall.EEXIST, syscall.ENOENT and friends.
+type NetlinkBackend struct {
+	Debug  bool
+	DryRun bool
+}
+
+// NewNetlinkBackend creates a new NetlinkBackend.
+func NewNetlinkBackend(debug, dryRun bool) (*NetlinkBackend, error) {
+	return &NetlinkBackend{
+		Debug:  debug,
+		DryRun: dryRun,
+	}, nil
+}
+
+// trace prints the tc command equivalent to a netlink request in debug and
+// dry-run mode. It reports whether the request should be skipped.
+func (b *NetlinkBackend) trace(args ...string) bool {
+	if b.DryRun || b.Debug {
+		fmt.Printf("tc %s\n", strings.Join(args, " "))
+	}
+	return b.DryRun
+}
+
+// traceQuery is trace for read-only requests, which are printed only in
+// debug mode so a dry run shows just the changes.
+func (b *NetlinkBackend) traceQuery(args ...string) bool {
+	if b.Debug {
+		fmt.Printf("tc %s\n", strings.Join(args, " "))
+	}
+	return b.DryRun
+}
+
+// EnsureClsactQdisc attaches a clsact qdisc to iface. An existing clsact
+// qdisc (EEXIST) is not an error.
+func (b *NetlinkBackend) EnsureClsactQdisc(iface string) error {
+	if b.trace("qdisc", "add", "dev", iface, "clsact") {
+		return nil
+	}
+
+	err := b.clsactRequest(iface, syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	if err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("failed to add clsact qdisc to %s: %w", iface, err)
+	}
+	return nil
+}
+
+// DeleteClsactQdisc removes the clsact qdisc from iface. A qdisc or device
+// that is already gone is not an error.
+func (b *NetlinkBackend) DeleteClsactQdisc(iface string) error {
+	if b.trace("qdisc", "del", "dev", iface, "clsact") {
+		return nil
+	}
+
+	err := b.clsactRequest(iface, syscall.RTM_DELQDISC, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENODEV) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete clsact qdisc from %s: %w", iface, err)
+	}
+	return nil
+}
+
+func (b *NetlinkBackend) clsactRequest(iface string, msgType, flags uint16) error {
+	link, err := lookupLink(iface)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialNetlink()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := tcMsg(int32(link.Index), 0xFFFF0000, tcHClsact, 0)
+	kind := &nlAttr{typ: tcaKind, data: cstring("clsact")}
+	_, err = conn.request(msgType, flags, append(msg, encodeAttrs([]*nlAttr{kind})...))
+	return err
+}
+
+// HasClsactQdisc reports whether iface has a clsact qdisc attached.
+func (b *NetlinkBackend) HasClsactQdisc(iface string) (bool, error) {
+	if b.traceQuery("qdisc", "show", "dev", iface) {
+		return false, nil
+	}
+
+	link, err := lookupLink(iface)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := dialNetlink()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	replies, err := conn.request(syscall.RTM_GETQDISC, syscall.NLM_F_DUMP, tcMsg(int32(link.Index), 0, 0, 0))
+	if err != nil {
+		return false, fmt.Errorf("failed to list qdiscs for %s: %w", iface, err)
+	}
+
+	for _, m := range replies {
+		if m.Header.Type != syscall.RTM_NEWQDISC || len(m.Data) < 20 {
+			continue
+		}
+		// Older kernels ignore the ifindex in a dump request.
+		if int32(binary.NativeEndian.Uint32(m.Data[4:8])) != int32(link.Index) {
+			continue
+		}
+		attrs, err := parseAttrs(m.Data[20:])
+		if err != nil {
+			return false, err
+		}
+		if kind, ok := attrMap(attrs)[tcaKind]; ok && trimCString(kind) == "clsact" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddMirrorFilter installs a flower filter on the given hook(s) of ifaceName
+// that mirrors or redirects matching packets to target, optionally rewriting
+// them first.
+// It programs the same filter that BuildTCArgsWithRewrite describes.
+func (b *NetlinkBackend) AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) ([]FilterRef, error) {
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []FilterRef
+	filterRewrite := toFilterRewrite(rewrite)
+	for _, hook := range hooks {
+		if !b.trace(filter.BuildTCArgsWithRewrite(ifaceName, hook, target, id, f, filterRewrite)...) {
+			if err := b.addMirrorFilter(ifaceName, hook, id, target, f, filterRewrite); err != nil {
+				return installed, fmt.Errorf("failed to add mirror filter to %s (%s): %w", ifaceName, hook, err)
+			}
+		}
+		installed = append(installed, FilterRef{Iface: ifaceName, Hook: hook, Priority: id.Pref})
+	}
+	return installed, nil
+}
+
+func (b *NetlinkBackend) addMirrorFilter(ifaceName, hook string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *filter.RewriteOptions) error {
+	var targetIndexes []int
+	for _, dev := range target.Devs {
+		targetLink, err := lookupLink(dev)
+		if err != nil {
+			return err
+		}
+		targetIndexes = append(targetIndexes, targetLink.Index)
+	}
+
+	cookie, err := decodeCookie(id.Cookie)
+	if err != nil {
+		return err
+	}
+	ethType := protocolEthType(filter.Protocol(f, rewrite))
+	netType := protocolEthType(filter.NetworkProtocol(f, rewrite))
+	options, err := flowerOptions(f, ethType, netType)
+	if err != nil {
+		return err
+	}
+	if err := mirrorActions(options.nest(tcaFlowerAct), cookie, f, netType, rewrite, target, targetIndexes); err != nil {
+		return err
+	}
+	return b.newFilter(ifaceName, hook, id, ethType, options)
+}
+
+// AddPassFilter installs a flower filter on the given hook(s) of ifaceName
+// that accepts matching packets, ending classification for them.
+// It programs the same filter that BuildPassArgs describes.
+func (b *NetlinkBackend) AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) ([]FilterRef, error) {
+	hooks, err := hooksForDirection(direction)
+	if err != nil {
+		return nil, err
+	}
+
+	var installed []FilterRef
+	for _, hook := range hooks {
+		if !b.trace(filter.BuildPassArgs(ifaceName, hook, id, f)...) {
+			if err := b.addPassFilter(ifaceName, hook, id, f); err != nil {
+				return installed, fmt.Errorf("failed to add pass filter to %s (%s): %w", ifaceName, hook, err)
+			}
+		}
+		installed = append(installed, FilterRef{Iface: ifaceName, Hook: hook, Priority: id.Pref})
+	}
+	return installed, nil
+}
+
+func (b *NetlinkBackend) addPassFilter(ifaceName, hook string, id FilterID, f filter.Filter) error {
+	cookie, err := decodeCookie(id.Cookie)
+	if err != nil {
+		return err
+	}
+	ethType := protocolEthType(filter.Protocol(f, nil))
+	options, err := flowerOptions(f, ethType, protocolEthType(filter.NetworkProtocol(f, nil)))
+	if err != nil {
+		return err
+	}
+	passAction(options.nest(tcaFlowerAct), cookie)
+	return b.newFilter(ifaceName, hook, id, ethType, options)
+}
+
+// newFilter creates a flower filter with the given options, preference and
+// handle on a hook of ifaceName.
+func (b *NetlinkBackend) newFilter(ifaceName, hook string, id FilterID, ethType uint16, options *nlAttr) error {
+	link, err := lookupLink(ifaceName)
+	if err != nil {
+		return err
+	}
+	parent, err := hookParent(hook)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialNetlink()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// tcm_info carries the preference in the upper and the protocol in the
+	// lower 16 bits.
+	msg := tcMsg(int32(link.Index), id.Handle, parent, uint32(id.Pref)<<16|uint32(htons(ethType)))
+	kind := &nlAttr{typ: tcaKind, data: cstring("flower")}
+	_, err = conn.request(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		append(msg, encodeAttrs([]*nlAttr{kind, options})...))
+	return err
+}
+
+// DeleteFilter removes the filters with preference pref from a hook of
+// iface. A filter, qdisc or device that is already gone is not an error.
+func (b *NetlinkBackend) DeleteFilter(iface, hook string, pref int) error {
+	if b.trace("filter", "del", "dev", iface, hook, "pref", strconv.Itoa(pref)) {
+		return nil
+	}
+
+	link, err := lookupLink(iface)
+	if err != nil {
+		return err
+	}
+	parent, err := hookParent(hook)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialNetlink()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A zero protocol and handle select every filter at this preference.
+	_, err = conn.request(syscall.RTM_DELTFILTER, 0, tcMsg(int32(link.Index), 0, parent, uint32(pref)<<16))
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENODEV) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete filter pref %d from %s (%s): %w", pref, iface, hook, err)
+	}
+	return nil
+}
+
+// ListFilterStats dumps the filters on the given hook of iface together with
+// their action counters.
+func (b *NetlinkBackend) ListFilterStats(iface, hook string) ([]FilterStats, error) {
+	if b.traceQuery("-s", "filter", "show", "dev", iface, hook) {
+		return []FilterStats{}, nil
+	}
+
+	link, err := lookupLink(iface)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := hookParent(hook)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialNetlink()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	replies, err := conn.request(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP, tcMsg(int32(link.Index), 0, parent, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters with stats for %s (%s): %w", iface, hook, err)
+	}
+
+	filters := []FilterStats{}
+	for _, m := range replies {
+		if m.Header.Type != syscall.RTM_NEWTFILTER {
+			continue
+		}
+		fs, ok, err := parseFilterMsg(m.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse filter on %s (%s): %w", iface, hook, err)
+		}
+		if ok {
+			filters = append(filters, fs)
+		}
+	}
+	return filters, nil
+}
+
+func lookupLink(name string) (*net.Interface, error) {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface '%s' not found: %w", name, err)
+	}
+	return link, nil
+}
+
+// hookParent returns the clsact parent handle for an ingress or egress hook.
+func hookParent(hook string) (uint32, error) {
+	switch hook {
+	case "ingress":
+		return tcHClsact&0xFFFF0000 | tcHMinIngress, nil
+	case "egress":
+		return tcHClsact&0xFFFF0000 | tcHMinEgress, nil
+	default:
+		return 0, fmt.Errorf("invalid hook '%s'", hook)
+	}
+}
+
+var ipProtoNumbers = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+func ipProtoNumber(name string) (uint8, error) {
+	if n, ok := ipProtoNumbers[name]; ok {
+		return n, nil
+	}
+	n, err := strconv.ParseUint(name, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown ip_proto '%s'", name)
+	}
+	return uint8(n), nil
+}
+
+func ipProtoName(n uint8) string {
+	for name, num := range ipProtoNumbers {
+		if num == n {
+			return name
+		}
+	}
+	return strconv.Itoa(int(n))
+}
+
+// protocolEthType maps a tc protocol returned by filter.Protocol to its
+// ethertype.
+func protocolEthType(protocol string) uint16 {
+	switch protocol {
+	case filter.ProtocolAll:
+		return ethPAll
+	case filter.ProtocolIPv6:
+		return ethPIPv6
+	case filter.ProtocolARP:
+		return ethPARP
+	case filter.ProtocolLLDP:
+		return ethPLLDP
+	case filter.Protocol8021Q:
+		return ethP8021Q
+	}
+	return ethPIP
+}
+
+// csumUpdateFlags maps the targets of filter.CsumTargets to csum update
+// flags. The "and" separators map to zero.
+var csumUpdateFlags = map[string]uint32{
+	"ip":   csumUpdateIPv4Hdr,
+	"icmp": csumUpdateICMP,
+	"tcp":  csumUpdateTCP,
+	"udp":  csumUpdateUDP,
+}
+
+// flowerOptions builds the TCA_OPTIONS of a flower filter matching f on
+// traffic of the given ethertype, whose packets are of netType: the same
+// ethertype or, for ethP8021Q, the one inside the VLAN tag.
+func flowerOptions(f filter.Filter, ethType, netType uint16) (*nlAttr, error) {
+	opts := &nlAttr{typ: tcaOptions | nlaFNested}
+	// Like tc, leave the ethertype out when matching every protocol
+	if ethType != ethPAll {
+		opts.add(tcaFlowerKeyEthType, be16(ethType))
+	}
+
+	macs := []struct {
+		name, value  string
+		key, maskKey uint16
+	}{
+		{"dst_mac", f.DstMAC, tcaFlowerKeyEthDst, tcaFlowerKeyEthDstMask},
+		{"src_mac", f.SrcMAC, tcaFlowerKeyEthSrc, tcaFlowerKeyEthSrcMask},
+	}
+	for _, m := range macs {
+		if m.value == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(m.value)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid %s '%s': must be a MAC address", m.name, m.value)
+		}
+		opts.add(m.key, mac).add(m.maskKey, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+
+	if ethType == ethP8021Q {
+		if f.VlanID != 0 {
+			opts.add(tcaFlowerKeyVlanID, u16(uint16(f.VlanID)))
+		}
+		if f.VlanPrio != nil {
+			opts.add(tcaFlowerKeyVlanPrio, u8(uint8(*f.VlanPrio)))
+		}
+		if netType != ethPAll {
+			opts.add(tcaFlowerKeyVlanEthType, be16(netType))
+		}
+	}
+
+	ipv6 := netType == ethPIPv6
+	srcKey, srcMaskKey := uint16(tcaFlowerKeyIPv4Src), uint16(tcaFlowerKeyIPv4SrcMask)
+	dstKey, dstMaskKey := uint16(tcaFlowerKeyIPv4Dst), uint16(tcaFlowerKeyIPv4DstMask)
+	if ipv6 {
+		srcKey, srcMaskKey = tcaFlowerKeyIPv6Src, tcaFlowerKeyIPv6SrcMask
+		dstKey, dstMaskKey = tcaFlowerKeyIPv6Dst, tcaFlowerKeyIPv6DstMask
+	}
+	if f.SrcIP != "" {
+		addr, mask, err := parseIPPrefix(f.SrcIP, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid src_ip: %w", err)
+		}
+		opts.add(srcKey, addr).add(srcMaskKey, mask)
+	}
+	if f.DstIP != "" {
+		addr, mask, err := parseIPPrefix(f.DstIP, ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dst_ip: %w", err)
+		}
+		opts.add(dstKey, addr).add(dstMaskKey, mask)
+	}
+
+	if f.IPProto != "" {
+		proto, err := ipProtoNumber(f.IPProto)
+		if err != nil {
+			return nil, err
+		}
+		opts.add(tcaFlowerKeyIPProto, u8(proto))
+	}
+	if f.IPTOS != nil {
+		opts.add(tcaFlowerKeyIPTOS, u8(uint8(f.IPTOS.Value))).add(tcaFlowerKeyIPTOSMask, u8(uint8(f.IPTOS.MaskOf(filter.MaxU8))))
+	}
+	if f.IPTTL != nil {
+		opts.add(tcaFlowerKeyIPTTL, u8(uint8(f.IPTTL.Value))).add(tcaFlowerKeyIPTTLMask, u8(uint8(f.IPTTL.MaskOf(filter.MaxU8))))
+	}
+	if f.TCPFlags != nil {
+		if f.IPProto != "tcp" {
+			return nil, fmt.Errorf("tcp_flags matching requires ip_proto tcp")
+		}
+		opts.add(tcaFlowerKeyTCPFlags, be16(uint16(f.TCPFlags.Value))).add(tcaFlowerKeyTCPFlagsMask, be16(uint16(f.TCPFlags.MaskOf(filter.MaxTCPFlags))))
+	}
+	if f.ICMPType != nil || f.ICMPCode != nil {
+		var typeKey, typeMask, codeKey, codeMask uint16
+		switch f.IPProto {
+		case "icmp":
+			typeKey, typeMask, codeKey, codeMask = tcaFlowerKeyICMPv4Type, tcaFlowerKeyICMPv4TypeMask, tcaFlowerKeyICMPv4Code, tcaFlowerKeyICMPv4CodeMask
+		case "icmpv6":
+			typeKey, typeMask, codeKey, codeMask = tcaFlowerKeyICMPv6Type, tcaFlowerKeyICMPv6TypeMask, tcaFlowerKeyICMPv6Code, tcaFlowerKeyICMPv6CodeMask
+		default:
+			return nil, fmt.Errorf("icmp_type and icmp_code matching requires ip_proto icmp or icmpv6")
+		}
+		if f.ICMPType != nil {
+			opts.add(typeKey, u8(uint8(f.ICMPType.Value))).add(typeMask, u8(uint8(f.ICMPType.MaskOf(filter.MaxU8))))
+		}
+		if f.ICMPCode != nil {
+			opts.add(codeKey, u8(uint8(f.ICMPCode.Value))).add(codeMask, u8(uint8(f.ICMPCode.MaskOf(filter.MaxU8))))
+		}
+	}
+
+	if len(f.SrcPort) > 0 || len(f.DstPort) > 0 {
+		var srcKey, dstKey uint16
+		switch f.IPProto {
+		case "tcp":
+			srcKey, dstKey = tcaFlowerKeyTCPSrc, tcaFlowerKeyTCPDst
+		case "udp":
+			srcKey, dstKey = tcaFlowerKeyUDPSrc, tcaFlowerKeyUDPDst
+		case "sctp":
+			srcKey, dstKey = tcaFlowerKeySCTPSrc, tcaFlowerKeySCTPDst
+		default:
+			return nil, fmt.Errorf("port matching requires ip_proto tcp, udp or sctp")
+		}
+		// Ranges use flower's protocol independent range keys
+		if err := addPortKey(opts, "src_port", f.SrcPort, srcKey, tcaFlowerKeyPortSrcMin, tcaFlowerKeyPortSrcMax); err != nil {
+			return nil, err
+		}
+		if err := addPortKey(opts, "dst_port", f.DstPort, dstKey, tcaFlowerKeyPortDstMin, tcaFlowerKeyPortDstMax); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+// addPortKey adds the flower key for a single port or a port range. Lists
+// must have been split with filter.Expand.
+func addPortKey(opts *nlAttr, name string, ports filter.Ports, key, minKey, maxKey uint16) error {
+	switch {
+	case len(ports) == 0:
+		return nil
+	case len(ports) > 1:
+		return fmt.Errorf("%s '%s' lists several ports, expand the filter first", name, ports)
+	case ports[0].IsRange():
+		opts.add(minKey, be16(uint16(ports[0].Min))).add(maxKey, be16(uint16(ports[0].Max)))
+	default:
+		opts.add(key, be16(uint16(ports[0].Min)))
+	}
+	return nil
+}
+
+// parseIPPrefix parses an IPv4 or, if ipv6 is set, an IPv6 address or CIDR
+// into flower key and mask values.
+func parseIPPrefix(s string, ipv6 bool) ([]byte, []byte, error) {
+	if !strings.Contains(s, "/") {
+		if ipv6 {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ipv6 {
+		if ip.To4() != nil {
+			return nil, nil, fmt.Errorf("'%s' is not an IPv6 address", s)
+		}
+		return []byte(ip.Mask(ipNet.Mask)), []byte(ipNet.Mask), nil
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, nil, fmt.Errorf("'%s' is not an IPv4 address", s)
+	}
+	return []byte(ip4.Mask(ipNet.Mask)), []byte(ipNet.Mask), nil
+}
+
+// decodeCookie returns the bytes of a hex action cookie, which the kernel
+// limits to 16.
+func decodeCookie(s string) ([]byte, error) {
+	cookie, err := hex.DecodeString(s)
+	if err != nil || len(cookie) > tcCookieMaxSize {
+		return nil, fmt.Errorf("invalid action cookie '%s'", s)
+	}
+	return cookie, nil
+}
+
+// newAction appends action number order of the given kind, tagged with
+// cookie unless it is empty, and returns the nest for its options.
+func newAction(acts *nlAttr, order uint16, kind string, cookie []byte) *nlAttr {
+	act := acts.nest(order)
+	act.add(tcaActKind, cstring(kind))
+	if len(cookie) > 0 {
+		act.add(tcaActCookie, cookie)
+	}
+	return act.nest(tcaActOptions)
+}
+
+// passAction appends the single gact action of BuildPassArgs.
+func passAction(acts *nlAttr, cookie []byte) {
+	// struct tc_gact is a bare tc_gen.
+	parms := make([]byte, 20)
+	tcGen(parms, tcActOK)
+	newAction(acts, 1, "gact", cookie).add(tcaGactParms, parms)
+}
+
+// mirrorActions appends the action chain produced by BuildTCArgsWithRewrite:
+// optional skbmod and pedit/csum rewrites followed by one mirred action per
+// target interface, whose indexes are given by targetIndexes. netType is the
+// ethertype of the rewritten packets, inside the VLAN tag for VLAN filters.
+// Every action is tagged with cookie.
+func mirrorActions(acts *nlAttr, cookie []byte, f filter.Filter, netType uint16, rewrite *filter.RewriteOptions, target filter.Mirred, targetIndexes []int) error {
+	order := uint16(0)
+	next := func(kind string) *nlAttr {
+		order++
+		return newAction(acts, order, kind, cookie)
+	}
+
+	if rewrite != nil && (rewrite.DstMAC != "" || rewrite.SrcMAC != "") {
+		opts := next("skbmod")
+		var flags uint64
+		if rewrite.DstMAC != "" {
+			mac, err := net.ParseMAC(rewrite.DstMAC)
+			if err != nil {
+				return fmt.Errorf("invalid dst_mac: %w", err)
+			}
+			flags |= skbmodFDMAC
+			opts.add(tcaSkbmodDMAC, mac)
+		}
+		if rewrite.SrcMAC != "" {
+			mac, err := net.ParseMAC(rewrite.SrcMAC)
+			if err != nil {
+				return fmt.Errorf("invalid src_mac: %w", err)
+			}
+			flags |= skbmodFSMAC
+			opts.add(tcaSkbmodSMAC, mac)
+		}
+		// struct tc_skbmod: tc_gen followed by a 64-bit aligned flags field.
+		parms := make([]byte, 32)
+		tcGen(parms, tcActPipe)
+		binary.NativeEndian.PutUint64(parms[24:32], flags)
+		opts.add(tcaSkbmodParms, parms)
+	}
+
+	if rewrite != nil && (rewrite.DstIP != "" || rewrite.SrcIP != "") {
+		ipv6 := netType == ethPIPv6
+		keys, err := rewriteKeys(rewrite, ipv6)
+		if err != nil {
+			return err
+		}
+
+		opts := next("pedit")
+		// struct tc_pedit_sel: tc_gen, nkeys, flags, padding, then one
+		// 24 byte tc_pedit_key per key. A zero mask replaces all 32 bits.
+		parms := make([]byte, 24+24*len(keys))
+		tcGen(parms, tcActPipe)
+		parms[20] = uint8(len(keys))
+		keysEx := opts.nest(tcaPeditKeysEx)
+		for i, k := range keys {
+			kb := parms[24+24*i:]
+			binary.BigEndian.PutUint32(kb[4:8], k.Value)
+			binary.NativeEndian.PutUint32(kb[8:12], uint32(k.Offset))
+			keysEx.nest(tcaPeditKeyEx).
+				add(tcaPeditKeyExHType, u16(uint16(slices.Index(peditHeaderTypes, k.HeaderType)))).
+				add(tcaPeditKeyExCmd, u16(peditCmdSet))
+		}
+		opts.add(tcaPeditParmsEx, parms)
+
+		var updates uint32
+		for _, target := range filter.CsumTargets(f.IPProto, ipv6) {
+			updates |= csumUpdateFlags[target]
+		}
+		// struct tc_csum: tc_gen followed by update_flags.
+		csum := make([]byte, 24)
+		tcGen(csum, tcActPipe)
+		binary.NativeEndian.PutUint32(csum[20:24], updates)
+		next("csum").add(tcaCsumParms, csum)
+	}
+
+	// struct tc_mirred: tc_gen, eaction, ifindex. Every mirror but the last
+	// pipes to the next one. A final mirror's "continue" is TC_ACT_UNSPEC, a
+	// final redirect steals the packet like tc's default.
+	ingress := target.GetHook() == "ingress"
+	for i, index := range targetIndexes {
+		eaction, gen := uint32(tcaEgressMirror), int32(tcActPipe)
+		if ingress {
+			eaction = tcaIngressMirror
+		}
+		if i == len(targetIndexes)-1 {
+			gen = tcActUnspec
+			if target.GetAction() == filter.MirredRedirect {
+				eaction, gen = tcaEgressRedir, tcActStolen
+				if ingress {
+					eaction = tcaIngressRedir
+				}
+			}
+		}
+		parms := make([]byte, 28)
+		tcGen(parms, gen)
+		binary.NativeEndian.PutUint32(parms[20:24], eaction)
+		binary.NativeEndian.PutUint32(parms[24:28], uint32(index))
+		next("mirred").add(tcaMirredParms, parms)
+	}
+
+	return nil
+}
+
+// parseFilterMsg decodes an RTM_NEWTFILTER message into FilterStats. The
+// second return value is false for the per-priority header entries that carry
+// no filter handle, which `tc filter show` prints but ParseFilterStats skips.
+func parseFilterMsg(data []byte) (FilterStats, bool, error) {
+	if len(data) < 20 {
+		return FilterStats{}, false, fmt.Errorf("truncated tcmsg")
+	}
+	handle := binary.NativeEndian.Uint32(data[8:12])
+	info := binary.NativeEndian.Uint32(data[16:20])
+	if handle == 0 {
+		return FilterStats{}, false, nil
+	}
+
+	fs := FilterStats{
+		Protocol: protocolName(htons(uint16(info & 0xFFFF))),
+		Priority: int(info >> 16),
+		Handle:   fmt.Sprintf("0x%x", handle),
+		Matches:  make(map[string]string),
+		Actions:  []ActionStats{},
+	}
+
+	attrs, err := parseAttrs(data[20:])
+	if err != nil {
+		return FilterStats{}, false, err
+	}
+	m := attrMap(attrs)
+	fs.MatchType = trimCString(m[tcaKind])
+	if chain, ok := m[tcaChain]; ok && len(chain) >= 4 {
+		fs.Chain = int(binary.NativeEndian.Uint32(chain))
+	}
+
+	if fs.MatchType != "flower" {
+		return fs, true, nil
+	}
+	options, ok := m[tcaOptions]
+	if !ok {
+		return fs, true, nil
+	}
+	opts, err := parseAttrs(options)
+	if err != nil {
+		return FilterStats{}, false, err
+	}
+	om := attrMap(opts)
+	parseFlowerKeys(om, fs.Matches)
+
+	if acts, ok := om[tcaFlowerAct]; ok {
+		list, err := parseAttrs(acts)
+		if err != nil {
+			return FilterStats{}, false, err
+		}
+		for _, a := range list {
+			action, err := parseAction(a.data)
+			if err != nil {
+				return FilterStats{}, false, err
+			}
+			fs.Actions = append(fs.Actions, action)
+		}
+	}
+	return fs, true, nil
+}
+
+// parseFlowerKeys fills matches using the same keys and value formats as
+// `tc filter show`.
+func parseFlowerKeys(om map[uint16][]byte, matches map[string]string) {
+	if v, ok := om[tcaFlowerKeyEthType]; ok && len(v) >= 2 {
+		matches["eth_type"] = ethTypeName(binary.BigEndian.Uint16(v))
+	}
+	if v, ok := om[tcaFlowerKeyIPProto]; ok && len(v) >= 1 {
+		matches["ip_proto"] = ipProtoName(v[0])
+	}
+
+	macs := []struct {
+		name      string
+		key, mask uint16
+	}{
+		{"dst_mac", tcaFlowerKeyEthDst, tcaFlowerKeyEthDstMask},
+		{"src_mac", tcaFlowerKeyEthSrc, tcaFlowerKeyEthSrcMask},
+	}
+	for _, m := range macs {
+		if v, ok := om[m.key]; ok {
+			matches[m.name] = formatMAC(v, om[m.mask])
+		}
+	}
+	if v, ok := om[tcaFlowerKeyVlanID]; ok && len(v) >= 2 {
+		matches["vlan_id"] = strconv.Itoa(int(binary.NativeEndian.Uint16(v)))
+	}
+	if v, ok := om[tcaFlowerKeyVlanPrio]; ok && len(v) >= 1 {
+		matches["vlan_prio"] = strconv.Itoa(int(v[0]))
+	}
+	if v, ok := om[tcaFlowerKeyVlanEthType]; ok && len(v) >= 2 {
+		matches["vlan_ethtype"] = ethTypeName(binary.BigEndian.Uint16(v))
+	}
+
+	prefixes := []struct {
+		name      string
+		key, mask uint16
+	}{
+		{"src_ip", tcaFlowerKeyIPv4Src, tcaFlowerKeyIPv4SrcMask},
+		{"dst_ip", tcaFlowerKeyIPv4Dst, tcaFlowerKeyIPv4DstMask},
+		{"src_ip", tcaFlowerKeyIPv6Src, tcaFlowerKeyIPv6SrcMask},
+		{"dst_ip", tcaFlowerKeyIPv6Dst, tcaFlowerKeyIPv6DstMask},
+	}
+	for _, p := range prefixes {
+		if v, ok := om[p.key]; ok {
+			matches[p.name] = formatPrefix(v, om[p.mask])
+		}
+	}
+
+	ports := []struct {
+		name string
+		key  uint16
+	}{
+		{"src_port", tcaFlowerKeyTCPSrc},
+		{"dst_port", tcaFlowerKeyTCPDst},
+		{"src_port", tcaFlowerKeyUDPSrc},
+		{"dst_port", tcaFlowerKeyUDPDst},
+		{"src_port", tcaFlowerKeySCTPSrc},
+		{"dst_port", tcaFlowerKeySCTPDst},
+	}
+	for _, p := range ports {
+		if v, ok := om[p.key]; ok && len(v) >= 2 {
+			matches[p.name] = strconv.Itoa(int(binary.BigEndian.Uint16(v)))
+		}
+	}
+
+	if v, ok := om[tcaFlowerKeyTCPFlags]; ok && len(v) >= 2 {
+		matches["tcp_flags"] = fmt.Sprintf("0x%x", binary.BigEndian.Uint16(v))
+		if m := om[tcaFlowerKeyTCPFlagsMask]; len(m) >= 2 {
+			matches["tcp_flags"] += fmt.Sprintf("/%x", binary.BigEndian.Uint16(m))
+		}
+	}
+	hexKeys := []struct {
+		name      string
+		key, mask uint16
+	}{
+		{"ip_tos", tcaFlowerKeyIPTOS, tcaFlowerKeyIPTOSMask},
+		{"ip_ttl", tcaFlowerKeyIPTTL, tcaFlowerKeyIPTTLMask},
+	}
+	for _, k := range hexKeys {
+		if v, ok := om[k.key]; ok && len(v) >= 1 {
+			matches[k.name] = fmt.Sprintf("0x%x", v[0])
+			if m := om[k.mask]; len(m) >= 1 {
+				matches[k.name] += fmt.Sprintf("/%x", m[0])
+			}
+		}
+	}
+	icmpKeys := []struct {
+		name      string
+		key, mask uint16
+	}{
+		{"icmp_type", tcaFlowerKeyICMPv4Type, tcaFlowerKeyICMPv4TypeMask},
+		{"icmp_code", tcaFlowerKeyICMPv4Code, tcaFlowerKeyICMPv4CodeMask},
+		{"icmp_type", tcaFlowerKeyICMPv6Type, tcaFlowerKeyICMPv6TypeMask},
+		{"icmp_code", tcaFlowerKeyICMPv6Code, tcaFlowerKeyICMPv6CodeMask},
+	}
+	for _, k := range icmpKeys {
+		if v, ok := om[k.key]; ok && len(v) >= 1 {
+			mask := uint8(0xff)
+			if m := om[k.mask]; len(m) >= 1 {
+				mask = m[0]
+			}
+			matches[k.name] = formatMaskedU8(v[0], mask)
+		}
+	}
+
+	ranges := []struct {
+		name     string
+		min, max uint16
+	}{
+		{"src_port", tcaFlowerKeyPortSrcMin, tcaFlowerKeyPortSrcMax},
+		{"dst_port", tcaFlowerKeyPortDstMin, tcaFlowerKeyPortDstMax},
+	}
+	for _, r := range ranges {
+		lo, okLo := om[r.min]
+		hi, okHi := om[r.max]
+		if okLo && okHi && len(lo) >= 2 && len(hi) >= 2 {
+			matches[r.name] = fmt.Sprintf("%d-%d", binary.BigEndian.Uint16(lo), binary.BigEndian.Uint16(hi))
+		}
+	}
+}
+
+// formatPrefix renders an address and mask the way tc does: a bare address
+// for host masks and CIDR notation otherwise.
+func formatPrefix(addr, mask []byte) string {
+	ip := net.IP(addr)
+	if len(mask) != len(addr) {
+		return ip.String()
+	}
+	ones, bits := net.IPMask(mask).Size()
+	if ones == bits {
+		return ip.String()
+	}
+	return fmt.Sprintf("%s/%d", ip.String(), ones)
+}
+
+// formatMAC renders a MAC address and mask the way tc does: a bare address
+// for a full mask and address/mask otherwise.
+func formatMAC(addr, mask []byte) string {
+	mac := net.HardwareAddr(addr).String()
+	if len(mask) == 0 || bytes.Equal(mask, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		return mac
+	}
+	return mac + "/" + net.HardwareAddr(mask).String()
+}
+
+func ethTypeName(v uint16) string {
+	switch v {
+	case ethPIP:
+		return "ipv4"
+	case ethPIPv6:
+		return "ipv6"
+	case ethPARP:
+		return "arp"
+	case ethP8021Q:
+		return "802.1Q"
+	case ethPLLDP:
+		return "LLDP"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+func protocolName(v uint16) string {
+	switch v {
+	case ethPAll:
+		return "all"
+	case ethPIP:
+		return "ip"
+	case ethPIPv6:
+		return "ipv6"
+	case ethPARP:
+		return "arp"
+	case ethP8021Q:
+		return "802.1Q"
+	case ethPLLDP:
+		return "LLDP"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// parseAction decodes one entry of a filter's action list.
+func parseAction(data []byte) (ActionStats, error) {
+	attrs, err := parseAttrs(data)
+	if err != nil {
+		return ActionStats{}, err
+	}
+	m := attrMap(attrs)
+	action := ActionStats{Type: trimCString(m[tcaActKind]), Cookie: hex.EncodeToString(m[tcaActCookie])}
+
+	var opts map[uint16][]byte
+	if raw, ok := m[tcaActOptions]; ok {
+		list, err := parseAttrs(raw)
+		if err != nil {
+			return ActionStats{}, err
+		}
+		opts = attrMap(list)
+	}
+
+	tmKey := uint16(0)
+	switch action.Type {
+	case "mirred":
+		tmKey = tcaMirredTM
+		if parms, ok := opts[tcaMirredParms]; ok && len(parms) >= 28 {
+			action.Operation = mirredOperation(binary.NativeEndian.Uint32(parms[20:24]))
+			index := int(binary.NativeEndian.Uint32(parms[24:28]))
+			if link, err := net.InterfaceByIndex(index); err == nil {
+				action.TargetDev = link.Name
+			} else {
+				action.TargetDev = strconv.Itoa(index)
+			}
+		}
+	case "skbmod":
+		tmKey = tcaSkbmodTM
+		action.Skbmod = &SkbmodAction{}
+		if mac, ok := opts[tcaSkbmodDMAC]; ok {
+			action.Skbmod.DstMAC = net.HardwareAddr(mac).String()
+		}
+		if mac, ok := opts[tcaSkbmodSMAC]; ok {
+			action.Skbmod.SrcMAC = net.HardwareAddr(mac).String()
+		}
+	case "pedit":
+		tmKey = tcaPeditTM
+		pedit, err := parsePedit(opts)
+		if err != nil {
+			return ActionStats{}, err
+		}
+		action.Pedit = pedit
+	case "csum":
+		tmKey = tcaCsumTM
+		action.Csum = &CsumAction{}
+		if parms, ok := opts[tcaCsumParms]; ok && len(parms) >= 24 {
+			flags := binary.NativeEndian.Uint32(parms[20:24])
+			// The update flags follow the order tc prints the targets in
+			for i, name := range csumTargetNames {
+				if flags&(1<<i) != 0 {
+					action.Csum.Targets = append(action.Csum.Targets, name)
+				}
+			}
+		}
+	case "police":
+		tmKey = tcaPoliceTM
+		action.Police = &PoliceAction{}
+		// struct tc_police: index, action, limit, burst, mtu, then the
+		// rate as a tc_ratespec whose last field is the rate in bytes/s.
+		if tbf, ok := opts[tcaPoliceTBF]; ok && len(tbf) >= 32 {
+			action.Police.Rate = uint64(binary.NativeEndian.Uint32(tbf[28:32]))
+			if rate64, ok := opts[tcaPoliceRate64]; ok && len(rate64) >= 8 {
+				action.Police.Rate = binary.NativeEndian.Uint64(rate64)
+			}
+			ticks := uint64(binary.NativeEndian.Uint32(tbf[12:16]))
+			action.Police.Burst = action.Police.Rate * ticks * pschedTickNs / 1e9
+		}
+	case "gact":
+		tmKey = tcaGactTM
+		if parms, ok := opts[tcaGactParms]; ok && len(parms) >= 20 {
+			action.Operation = gactOperation(int32(binary.NativeEndian.Uint32(parms[8:12])))
+		}
+	}
+
+	// struct tcf_t: install, lastuse, expires, firstuse as clock_t ages.
+	if tm, ok := opts[tmKey]; ok && tmKey != 0 && len(tm) >= 16 {
+		action.Installed = fmt.Sprintf("%d sec", binary.NativeEndian.Uint64(tm[0:8])/userHZ)
+		action.Used = fmt.Sprintf("%d sec", binary.NativeEndian.Uint64(tm[8:16])/userHZ)
+	}
+
+	if raw, ok := m[tcaActStats]; ok {
+		list, err := parseAttrs(raw)
+		if err != nil {
+			return ActionStats{}, err
+		}
+		stats := attrMap(list)
+		// struct gnet_stats_basic: u64 bytes, u32 packets.
+		if v, ok := stats[tcaStatsBasic]; ok && len(v) >= 12 {
+			action.Bytes = int64(binary.NativeEndian.Uint64(v[0:8]))
+			action.Packets = int64(binary.NativeEndian.Uint32(v[8:12]))
+		}
+		if v, ok := stats[tcaStatsPkt64]; ok && len(v) >= 8 {
+			action.Packets = int64(binary.NativeEndian.Uint64(v[0:8]))
+		}
+		// struct gnet_stats_queue: qlen, backlog, drops, requeues, overlimits.
+		if v, ok := stats[tcaStatsQueue]; ok && len(v) >= 20 {
+			action.BacklogBytes = int64(binary.NativeEndian.Uint32(v[4:8]))
+			action.Dropped = int64(binary.NativeEndian.Uint32(v[8:12]))
+			action.Requeues = int64(binary.NativeEndian.Uint32(v[12:16]))
+			action.Overlimits = int64(binary.NativeEndian.Uint32(v[16:20]))
+		}
+	}
+
+	return action, nil
+}
+
+// parsePedit reads the keys of a pedit action from its options. The
+// extended keys, if present, give the header type and command of each key.
+func parsePedit(opts map[uint16][]byte) (*PeditAction, error) {
+	pedit := &PeditAction{}
+	parms, ok := opts[tcaPeditParmsEx]
+	if !ok {
+		parms = opts[tcaPeditParms]
+	}
+	if len(parms) < 24 {
+		return pedit, nil
+	}
+
+	var keysEx []rawAttr
+	if raw, ok := opts[tcaPeditKeysEx]; ok {
+		var err error
+		if keysEx, err = parseAttrs(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	// struct tc_pedit_sel: tc_gen, nkeys, flags, padding, then the keys:
+	// mask, val, off, at, offmask, shift.
+	nkeys := int(parms[20])
+	for i := 0; i < nkeys && 24+24*(i+1) <= len(parms); i++ {
+		kb := parms[24+24*i:]
+		key := PeditKey{
+			Cmd:    "set",
+			Mask:   binary.BigEndian.Uint32(kb[0:4]),
+			Value:  binary.BigEndian.Uint32(kb[4:8]),
+			Offset: int(int32(binary.NativeEndian.Uint32(kb[8:12]))),
+		}
+		if i < len(keysEx) {
+			ex, err := parseAttrs(keysEx[i].data)
+			if err != nil {
+				return nil, err
+			}
+			m := attrMap(ex)
+			if v, ok := m[tcaPeditKeyExHType]; ok && len(v) >= 2 {
+				if htype := int(binary.NativeEndian.Uint16(v)); htype < len(peditHeaderTypes) {
+					key.HeaderType = peditHeaderTypes[htype]
+				}
+			}
+			if v, ok := m[tcaPeditKeyExCmd]; ok && len(v) >= 2 && binary.NativeEndian.Uint16(v) == peditCmdAdd {
+				key.Cmd = "add"
+			}
+		}
+		pedit.Keys = append(pedit.Keys, key)
+	}
+	return pedit, nil
+}
+
+// gactOperation names a gact control action the way tc prints it.
+func gactOperation(action int32) string {
+	switch action {
+	case tcActOK:
+		return "pass"
+	case tcActShot:
+		return "drop"
+	case tcActPipe:
+		return "pipe"
+	default:
+		return strconv.Itoa(int(action))
+	}
+}
+
+func mirredOperation(eaction uint32) string {
+	switch eaction {
+	case tcaEgressRedir:
+		return "Egress Redirect"
+	case tcaEgressMirror:
+		return "Egress Mirror"
+	case tcaIngressRedir:
+		return "Ingress Redirect"
+	case tcaIngressMirror:
+		return "Ingress Mirror"
+	default:
+		return fmt.Sprintf("Unknown %d", eaction)
+	}
+}
@@ -0,0 +1,365 @@
+package tc
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"tcbroker/pkg/filter"
+)
+
+func TestFlowerFilterRoundTrip(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("loopback interface not available: %v", err)
+	}
+
+	f := filter.Filter{IPProto: "tcp", SrcIP: "192.168.1.0/24", DstIP: "10.0.0.1", DstPort: filter.Port(80)}
+	rewrite := &filter.RewriteOptions{DstMAC: "52:54:00:12:34:56", DstIP: "10.0.0.100"}
+
+	options, err := flowerOptions(f, ethPIP, ethPIP)
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+	cookie := []byte{0x01, 0x23, 0xab, 0xcd}
+	if err := mirrorActions(options.nest(tcaFlowerAct), cookie, f, ethPIP, rewrite, filter.Mirred{Devs: []string{lo.Name}}, []int{lo.Index}); err != nil {
+		t.Fatalf("mirrorActions failed: %v", err)
+	}
+
+	// Encode the filter the way the kernel echoes it back in a dump.
+	msg := tcMsg(int32(lo.Index), 0x1, tcHClsact&0xFFFF0000|tcHMinIngress, 49152<<16|uint32(htons(ethPIP)))
+	kind := &nlAttr{typ: tcaKind, data: cstring("flower")}
+	data := append(msg, encodeAttrs([]*nlAttr{kind, options})...)
+
+	fs, ok, err := parseFilterMsg(data)
+	if err != nil {
+		t.Fatalf("parseFilterMsg failed: %v", err)
+	}
+	if !ok {
+		t.Fatal("Expected a filter entry, got a header entry")
+	}
+
+	if fs.Protocol != "ip" {
+		t.Errorf("Expected protocol 'ip', got '%s'", fs.Protocol)
+	}
+	if fs.Priority != 49152 {
+		t.Errorf("Expected priority 49152, got %d", fs.Priority)
+	}
+	if fs.Handle != "0x1" {
+		t.Errorf("Expected handle '0x1', got '%s'", fs.Handle)
+	}
+	if fs.MatchType != "flower" {
+		t.Errorf("Expected match type 'flower', got '%s'", fs.MatchType)
+	}
+
+	expectedMatches := map[string]string{
+		"eth_type": "ipv4",
+		"ip_proto": "tcp",
+		"src_ip":   "192.168.1.0/24",
+		"dst_ip":   "10.0.0.1",
+		"dst_port": "80",
+	}
+	for key, want := range expectedMatches {
+		if got := fs.Matches[key]; got != want {
+			t.Errorf("Expected %s '%s', got '%s'", key, want, got)
+		}
+	}
+
+	expectedTypes := []string{"skbmod", "pedit", "csum", "mirred"}
+	if len(fs.Actions) != len(expectedTypes) {
+		t.Fatalf("Expected %d actions, got %d", len(expectedTypes), len(fs.Actions))
+	}
+	for i, want := range expectedTypes {
+		if fs.Actions[i].Type != want {
+			t.Errorf("Expected action %d type '%s', got '%s'", i+1, want, fs.Actions[i].Type)
+		}
+		if fs.Actions[i].Cookie != "0123abcd" {
+			t.Errorf("Expected action %d cookie '0123abcd', got '%s'", i+1, fs.Actions[i].Cookie)
+		}
+	}
+
+	for i, want := range []string{
+		"skbmod set dmac 52:54:00:12:34:56",
+		"pedit ip dst set 10.0.0.100",
+		"csum iph, tcp",
+	} {
+		if got := fs.Actions[i].Describe(); got != want {
+			t.Errorf("Expected action %d to read back as '%s', got '%s'", i+1, want, got)
+		}
+	}
+
+	mirred := fs.Actions[3]
+	if mirred.Operation != "Egress Mirror" {
+		t.Errorf("Expected operation 'Egress Mirror', got '%s'", mirred.Operation)
+	}
+	if mirred.TargetDev != lo.Name {
+		t.Errorf("Expected target device '%s', got '%s'", lo.Name, mirred.TargetDev)
+	}
+}
+
+func TestFlowerFilterRoundTripIPv6(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("loopback interface not available: %v", err)
+	}
+
+	f := filter.Filter{IPProto: "icmpv6", SrcIP: "2001:db8::/32", DstIP: "2001:DB8::1"}
+	rewrite := &filter.RewriteOptions{DstIP: "2001:db8::100"}
+	ethType := protocolEthType(filter.Protocol(f, rewrite))
+	if ethType != ethPIPv6 {
+		t.Fatalf("Expected ethertype 0x%04x, got 0x%04x", ethPIPv6, ethType)
+	}
+
+	options, err := flowerOptions(f, ethType, ethType)
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+	target := filter.Mirred{Devs: []string{lo.Name}, Action: filter.MirredRedirect, Hook: "ingress"}
+	if err := mirrorActions(options.nest(tcaFlowerAct), nil, f, ethType, rewrite, target, []int{lo.Index}); err != nil {
+		t.Fatalf("mirrorActions failed: %v", err)
+	}
+
+	msg := tcMsg(int32(lo.Index), 0x1, tcHClsact&0xFFFF0000|tcHMinIngress, 49152<<16|uint32(htons(ethType)))
+	kind := &nlAttr{typ: tcaKind, data: cstring("flower")}
+	fs, ok, err := parseFilterMsg(append(msg, encodeAttrs([]*nlAttr{kind, options})...))
+	if err != nil || !ok {
+		t.Fatalf("parseFilterMsg failed: ok=%v err=%v", ok, err)
+	}
+
+	if fs.Protocol != "ipv6" {
+		t.Errorf("Expected protocol 'ipv6', got '%s'", fs.Protocol)
+	}
+	expectedMatches := map[string]string{
+		"eth_type": "ipv6",
+		"ip_proto": "icmpv6",
+		"src_ip":   "2001:db8::/32",
+		"dst_ip":   "2001:db8::1",
+	}
+	for key, want := range expectedMatches {
+		if got := fs.Matches[key]; got != want {
+			t.Errorf("Expected %s '%s', got '%s'", key, want, got)
+		}
+	}
+	expectedTypes := []string{"pedit", "csum", "mirred"}
+	if len(fs.Actions) != len(expectedTypes) {
+		t.Fatalf("Expected %d actions, got %d", len(expectedTypes), len(fs.Actions))
+	}
+	for i, want := range expectedTypes {
+		if fs.Actions[i].Type != want {
+			t.Errorf("Expected action %d type '%s', got '%s'", i+1, want, fs.Actions[i].Type)
+		}
+	}
+	if op := fs.Actions[2].Operation; op != "Ingress Redirect" {
+		t.Errorf("Expected operation 'Ingress Redirect', got '%s'", op)
+	}
+	for i, want := range []string{"pedit ip6 dst set 2001:db8::100", "csum icmp"} {
+		if got := fs.Actions[i].Describe(); got != want {
+			t.Errorf("Expected action %d to read back as '%s', got '%s'", i+1, want, got)
+		}
+	}
+}
+
+func TestParsePoliceAction(t *testing.T) {
+	// struct tc_police with a 1Mbit rate and a burst of 10240 bytes, which
+	// takes 81920000 ns or 1280000 ticks to fill at that rate
+	tbf := make([]byte, 56)
+	binary.NativeEndian.PutUint32(tbf[12:16], 1280000)
+	binary.NativeEndian.PutUint32(tbf[28:32], 125000)
+	act := &nlAttr{}
+	act.add(tcaActKind, cstring("police"))
+	act.nest(tcaActOptions).add(tcaPoliceTBF, tbf)
+
+	action, err := parseAction(encodeAttrs(act.children))
+	if err != nil {
+		t.Fatalf("parseAction failed: %v", err)
+	}
+	if action.Police == nil || *action.Police != (PoliceAction{Rate: 125000, Burst: 10240}) {
+		t.Errorf("Unexpected police details: %+v", action.Police)
+	}
+}
+
+func TestMirrorActionsRejectsMixedFamilies(t *testing.T) {
+	acts := &nlAttr{typ: tcaFlowerAct}
+	rewrite := &filter.RewriteOptions{DstIP: "10.0.0.100"}
+	if err := mirrorActions(acts, nil, filter.Filter{}, ethPIPv6, rewrite, filter.Mirred{Devs: []string{"lo"}}, []int{1}); err == nil {
+		t.Error("Expected an error for an IPv4 rewrite on IPv6 traffic")
+	}
+}
+
+func TestFlowerPortRangeRoundTrip(t *testing.T) {
+	f := filter.Filter{IPProto: "udp", SrcPort: filter.Port(53), DstPort: filter.Ports{{Min: 8000, Max: 8100}}}
+	options, err := flowerOptions(f, ethPIP, ethPIP)
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+
+	attrs, err := parseAttrs(encodeAttrs(options.children))
+	if err != nil {
+		t.Fatalf("parseAttrs failed: %v", err)
+	}
+	matches := map[string]string{}
+	parseFlowerKeys(attrMap(attrs), matches)
+	if matches["src_port"] != "53" || matches["dst_port"] != "8000-8100" {
+		t.Errorf("Expected src_port 53 and dst_port 8000-8100, got %v", matches)
+	}
+
+	f.DstPort = filter.Ports{{Min: 80, Max: 80}, {Min: 443, Max: 443}}
+	if _, err := flowerOptions(f, ethPIP, ethPIP); err == nil {
+		t.Error("Expected an error for an unexpanded port list")
+	}
+}
+
+func TestFlowerL2RoundTrip(t *testing.T) {
+	prio := 3
+	f := filter.Filter{SrcMAC: "52:54:00:12:34:56", VlanID: 100, VlanPrio: &prio, IPProto: "tcp", DstIP: "10.0.0.1"}
+	options, err := flowerOptions(f, protocolEthType(filter.Protocol(f, nil)), protocolEthType(filter.NetworkProtocol(f, nil)))
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+
+	attrs, err := parseAttrs(encodeAttrs(options.children))
+	if err != nil {
+		t.Fatalf("parseAttrs failed: %v", err)
+	}
+	matches := map[string]string{}
+	parseFlowerKeys(attrMap(attrs), matches)
+
+	expectedMatches := map[string]string{
+		"eth_type":     "802.1Q",
+		"src_mac":      "52:54:00:12:34:56",
+		"vlan_id":      "100",
+		"vlan_prio":    "3",
+		"vlan_ethtype": "ipv4",
+		"ip_proto":     "tcp",
+		"dst_ip":       "10.0.0.1",
+	}
+	for key, want := range expectedMatches {
+		if got := matches[key]; got != want {
+			t.Errorf("Expected %s '%s', got '%s'", key, want, got)
+		}
+	}
+
+	// A filter on MAC addresses alone matches every protocol
+	options, err = flowerOptions(filter.Filter{DstMAC: "ff:ff:ff:ff:ff:ff"}, ethPAll, ethPAll)
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+	attrs, err = parseAttrs(encodeAttrs(options.children))
+	if err != nil {
+		t.Fatalf("parseAttrs failed: %v", err)
+	}
+	matches = map[string]string{}
+	parseFlowerKeys(attrMap(attrs), matches)
+	if _, ok := matches["eth_type"]; ok || matches["dst_mac"] != "ff:ff:ff:ff:ff:ff" {
+		t.Errorf("Expected only dst_mac ff:ff:ff:ff:ff:ff, got %v", matches)
+	}
+}
+
+func TestFlowerMaskedKeysRoundTrip(t *testing.T) {
+	testCases := []filter.Filter{
+		{IPProto: "tcp", DstPort: filter.Port(22), TCPFlags: &filter.TCPFlags{Masked: filter.Masked{Value: 0x02, Mask: 0x12}}},
+		{IPProto: "icmp", ICMPType: filter.Exact(8), ICMPCode: &filter.Masked{Value: 0, Mask: 0xf0}, IPTOS: &filter.Masked{Value: 0xb8, Mask: 0xfc}},
+		{IPProto: "icmpv6", ICMPType: filter.Exact(128), IPTTL: filter.Exact(255)},
+	}
+
+	for _, f := range testCases {
+		ethType := protocolEthType(filter.Protocol(f, nil))
+		options, err := flowerOptions(f, ethType, ethType)
+		if err != nil {
+			t.Fatalf("flowerOptions failed: %v", err)
+		}
+		attrs, err := parseAttrs(encodeAttrs(options.children))
+		if err != nil {
+			t.Fatalf("parseAttrs failed: %v", err)
+		}
+		matches := map[string]string{}
+		parseFlowerKeys(attrMap(attrs), matches)
+
+		// The dump must read back the way tcbroker expects tc to print it
+		for key, want := range FilterMatches(f, nil) {
+			if got := matches[key]; got != want {
+				t.Errorf("Expected %s '%s', got '%s'", key, want, got)
+			}
+		}
+	}
+}
+
+func TestPassFilterRoundTrip(t *testing.T) {
+	f := filter.Filter{EthType: filter.EthTypeIPv4, IPProto: "tcp", DstPort: filter.Port(22)}
+	options, err := flowerOptions(f, ethPIP, ethPIP)
+	if err != nil {
+		t.Fatalf("flowerOptions failed: %v", err)
+	}
+	id := NewFilterID("ssh", 0, 0, 0)
+	cookie, err := decodeCookie(id.Cookie)
+	if err != nil {
+		t.Fatalf("decodeCookie failed: %v", err)
+	}
+	passAction(options.nest(tcaFlowerAct), cookie)
+
+	msg := tcMsg(1, 0x1, tcHClsact&0xFFFF0000|tcHMinIngress, 30000<<16|uint32(htons(ethPIP)))
+	kind := &nlAttr{typ: tcaKind, data: cstring("flower")}
+	fs, ok, err := parseFilterMsg(append(msg, encodeAttrs([]*nlAttr{kind, options})...))
+	if err != nil || !ok {
+		t.Fatalf("parseFilterMsg failed: ok=%v err=%v", ok, err)
+	}
+
+	if fs.Cookie() != id.Cookie {
+		t.Errorf("Expected cookie '%s', got '%s'", id.Cookie, fs.Cookie())
+	}
+	expected := expectedPassFilterStats(id, f)
+	if live, want := liveSignature(&fs), signature(expected.Matches, expected.Actions); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+}
+
+func TestDecodeCookie(t *testing.T) {
+	if cookie, err := decodeCookie(""); err != nil || len(cookie) != 0 {
+		t.Errorf("Expected no cookie, got %x (err %v)", cookie, err)
+	}
+	for _, bad := range []string{"xyz", "abc", "00112233445566778899aabbccddeeff00"} {
+		if _, err := decodeCookie(bad); err == nil {
+			t.Errorf("Expected an error for cookie '%s'", bad)
+		}
+	}
+}
+
+func TestFlowerOptionsRejectsPortWithoutProto(t *testing.T) {
+	if _, err := flowerOptions(filter.Filter{DstPort: filter.Port(80)}, ethPIP, ethPIP); err == nil {
+		t.Error("Expected an error for dst_port without ip_proto")
+	}
+}
+
+func TestNetlinkErrorIs(t *testing.T) {
+	var err error = &NetlinkError{Errno: syscall.EEXIST, Msg: "Exclusivity flag on, cannot modify"}
+	if !errors.Is(err, syscall.EEXIST) {
+		t.Error("Expected NetlinkError to match syscall.EEXIST")
+	}
+	if errors.Is(err, syscall.ENOENT) {
+		t.Error("Expected NetlinkError not to match syscall.ENOENT")
+	}
+}
+
+func TestParseLinkMsg(t *testing.T) {
+	ifinfo := make([]byte, syscall.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(ifinfo[4:8], 7)
+	binary.NativeEndian.PutUint32(ifinfo[8:12], syscall.IFF_UP|syscall.IFF_BROADCAST)
+	data := append(ifinfo, encodeAttrs([]*nlAttr{{typ: syscall.IFLA_IFNAME, data: cstring("veth0")}})...)
+
+	ev, ok := parseLinkMsg(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK}, Data: data})
+	if !ok || ev != (LinkEvent{Name: "veth0", Index: 7, Up: true}) {
+		t.Errorf("Expected veth0 to be up, got %+v (%v)", ev, ok)
+	}
+	ev, ok = parseLinkMsg(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_DELLINK}, Data: data})
+	if !ok || !ev.Deleted {
+		t.Errorf("Expected veth0 to be deleted, got %+v (%v)", ev, ok)
+	}
+	if _, ok := parseLinkMsg(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR}, Data: data}); ok {
+		t.Error("Expected address notifications to be ignored")
+	}
+	if _, ok := parseLinkMsg(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK}, Data: ifinfo}); ok {
+		t.Error("Expected a link without a name to be ignored")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !linux
+
+package tc
+
+import (
+	"errors"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+var errNetlinkUnsupported = errors.New("the netlink backend is only supported on linux")
+
+// NetlinkBackend is only available on Linux.
+type NetlinkBackend struct {
+	Debug  bool
+	DryRun bool
+}
+
+// NewNetlinkBackend reports that the netlink backend is unsupported on this platform.
+func NewNetlinkBackend(debug, dryRun bool) (*NetlinkBackend, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) EnsureClsactQdisc(iface string) error {
+	return errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) DeleteClsactQdisc(iface string) error {
+	return errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) HasClsactQdisc(iface string) (bool, error) {
+	return false, errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) ([]FilterRef, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) ([]FilterRef, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) DeleteFilter(iface, hook string, pref int) error {
+	return errNetlinkUnsupported
+}
+
+func (b *NetlinkBackend) ListFilterStats(iface, hook string) ([]FilterStats, error) {
+	return nil, errNetlinkUnsupported
+}
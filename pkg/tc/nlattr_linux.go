@@ -0,0 +1,289 @@
+package tc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Netlink attribute and message constants from linux/rtnetlink.h,
+// linux/pkt_sched.h, linux/pkt_cls.h and the tc_act headers. Only the
+// values tcbroker needs are declared here.
+const (
+	nlaFNested = 0x8000
+
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaChain   = 11
+
+	tcHClsact     = 0xFFFFFFF1
+	tcHMinIngress = 0xFFF2
+	tcHMinEgress  = 0xFFF3
+
+	ethPAll   = 0x0003
+	ethPIP    = 0x0800
+	ethPIPv6  = 0x86DD
+	ethPARP   = 0x0806
+	ethP8021Q = 0x8100
+	ethPLLDP  = 0x88CC
+
+	tcaFlowerAct               = 3
+	tcaFlowerKeyEthDst         = 4
+	tcaFlowerKeyEthDstMask     = 5
+	tcaFlowerKeyEthSrc         = 6
+	tcaFlowerKeyEthSrcMask     = 7
+	tcaFlowerKeyEthType        = 8
+	tcaFlowerKeyIPProto        = 9
+	tcaFlowerKeyIPv4Src        = 10
+	tcaFlowerKeyIPv4SrcMask    = 11
+	tcaFlowerKeyIPv4Dst        = 12
+	tcaFlowerKeyIPv4DstMask    = 13
+	tcaFlowerKeyIPv6Src        = 14
+	tcaFlowerKeyIPv6SrcMask    = 15
+	tcaFlowerKeyIPv6Dst        = 16
+	tcaFlowerKeyIPv6DstMask    = 17
+	tcaFlowerKeyTCPSrc         = 18
+	tcaFlowerKeyTCPDst         = 19
+	tcaFlowerKeyUDPSrc         = 20
+	tcaFlowerKeyUDPDst         = 21
+	tcaFlowerFlags             = 22
+	tcaFlowerKeyVlanID         = 23
+	tcaFlowerKeyVlanPrio       = 24
+	tcaFlowerKeyVlanEthType    = 25
+	tcaFlowerKeySCTPSrc        = 41
+	tcaFlowerKeySCTPDst        = 42
+	tcaFlowerKeyICMPv4Code     = 49
+	tcaFlowerKeyICMPv4CodeMask = 50
+	tcaFlowerKeyICMPv4Type     = 51
+	tcaFlowerKeyICMPv4TypeMask = 52
+	tcaFlowerKeyICMPv6Code     = 53
+	tcaFlowerKeyICMPv6CodeMask = 54
+	tcaFlowerKeyICMPv6Type     = 55
+	tcaFlowerKeyICMPv6TypeMask = 56
+	tcaFlowerKeyTCPFlags       = 71
+	tcaFlowerKeyTCPFlagsMask   = 72
+	tcaFlowerKeyIPTOS          = 73
+	tcaFlowerKeyIPTOSMask      = 74
+	tcaFlowerKeyIPTTL          = 75
+	tcaFlowerKeyIPTTLMask      = 76
+	tcaFlowerKeyPortSrcMin     = 87
+	tcaFlowerKeyPortSrcMax     = 88
+	tcaFlowerKeyPortDstMin     = 89
+	tcaFlowerKeyPortDstMax     = 90
+
+	tcaActKind    = 1
+	tcaActOptions = 2
+	tcaActStats   = 4
+	tcaActCookie  = 6
+
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+	tcaStatsPkt64 = 8
+
+	tcActUnspec = -1
+	tcActOK     = 0
+	tcActShot   = 2
+	tcActPipe   = 3
+	tcActStolen = 4
+
+	tcCookieMaxSize = 16
+
+	tcaMirredTM    = 1
+	tcaMirredParms = 2
+
+	tcaGactTM    = 1
+	tcaGactParms = 2
+
+	tcaEgressRedir   = 1
+	tcaEgressMirror  = 2
+	tcaIngressRedir  = 3
+	tcaIngressMirror = 4
+
+	tcaSkbmodTM    = 1
+	tcaSkbmodParms = 2
+	tcaSkbmodDMAC  = 3
+	tcaSkbmodSMAC  = 4
+
+	skbmodFDMAC = 0x1
+	skbmodFSMAC = 0x2
+
+	tcaPeditTM         = 1
+	tcaPeditParms      = 2
+	tcaPeditParmsEx    = 4
+	tcaPeditKeysEx     = 5
+	tcaPeditKeyEx      = 6
+	tcaPeditKeyExHType = 1
+	tcaPeditKeyExCmd   = 2
+
+	peditCmdSet = 0
+	peditCmdAdd = 1
+
+	tcaCsumParms = 1
+	tcaCsumTM    = 2
+
+	tcaPoliceTBF    = 1
+	tcaPoliceTM     = 6
+	tcaPoliceRate64 = 8
+
+	// psched ticks are 64 ns (PSCHED_SHIFT 6); police bursts are given as
+	// the time the bucket takes to fill at the policed rate.
+	pschedTickNs = 64
+
+	csumUpdateIPv4Hdr = 0x1
+	csumUpdateICMP    = 0x2
+	csumUpdateTCP     = 0x8
+	csumUpdateUDP     = 0x10
+	csumUpdateSCTP    = 0x40
+
+	// sizeofTcGen is the size of the tc_gen header shared by every
+	// action's parameter struct.
+	sizeofTcGen = 20
+)
+
+// nlAttr is a netlink attribute under construction. Nested attributes keep
+// their children and are only flattened when the message is encoded.
+type nlAttr struct {
+	typ      uint16
+	data     []byte
+	children []*nlAttr
+}
+
+// add appends a leaf attribute and returns the receiver so calls can chain.
+func (a *nlAttr) add(typ uint16, data []byte) *nlAttr {
+	a.children = append(a.children, &nlAttr{typ: typ, data: data})
+	return a
+}
+
+// nest appends an empty nested attribute and returns it.
+func (a *nlAttr) nest(typ uint16) *nlAttr {
+	child := &nlAttr{typ: typ | nlaFNested}
+	a.children = append(a.children, child)
+	return child
+}
+
+func (a *nlAttr) len() int {
+	n := 4
+	if a.children == nil {
+		return n + len(a.data)
+	}
+	for _, child := range a.children {
+		n += nlAlign(child.len())
+	}
+	return n
+}
+
+func (a *nlAttr) encode(b []byte) int {
+	l := a.len()
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], a.typ)
+	if a.children == nil {
+		copy(b[4:], a.data)
+		return nlAlign(l)
+	}
+	off := 4
+	for _, child := range a.children {
+		off += child.encode(b[off:])
+	}
+	return nlAlign(l)
+}
+
+// encodeAttrs serializes a list of top level attributes.
+func encodeAttrs(attrs []*nlAttr) []byte {
+	n := 0
+	for _, a := range attrs {
+		n += nlAlign(a.len())
+	}
+	b := make([]byte, n)
+	off := 0
+	for _, a := range attrs {
+		off += a.encode(b[off:])
+	}
+	return b
+}
+
+func nlAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+// rawAttr is a decoded netlink attribute. Attributes are kept in wire order
+// because action lists are ordered.
+type rawAttr struct {
+	typ  uint16
+	data []byte
+}
+
+// parseAttrs decodes a buffer of netlink attributes.
+func parseAttrs(b []byte) ([]rawAttr, error) {
+	var attrs []rawAttr
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		typ := binary.NativeEndian.Uint16(b[2:4])
+		if l < 4 || l > len(b) {
+			return nil, fmt.Errorf("malformed netlink attribute (len %d, %d bytes left)", l, len(b))
+		}
+		// Strip NLA_F_NESTED and NLA_F_NET_BYTEORDER.
+		attrs = append(attrs, rawAttr{typ: typ & 0x3FFF, data: b[4:l]})
+		if nlAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlAlign(l):]
+	}
+	return attrs, nil
+}
+
+// attrMap indexes attributes by type. When a type repeats, the last one wins.
+func attrMap(attrs []rawAttr) map[uint16][]byte {
+	m := make(map[uint16][]byte, len(attrs))
+	for _, a := range attrs {
+		m[a.typ] = a.data
+	}
+	return m
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.NativeEndian.PutUint16(b, v)
+	return b
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// tcGen encodes the tc_gen header that prefixes action parameter structs.
+func tcGen(b []byte, action int32) {
+	binary.NativeEndian.PutUint32(b[8:12], uint32(action))
+}
+
+// tcMsg encodes a struct tcmsg.
+func tcMsg(ifindex int32, handle, parent, info uint32) []byte {
+	b := make([]byte, 20)
+	binary.NativeEndian.PutUint32(b[4:8], uint32(ifindex))
+	binary.NativeEndian.PutUint32(b[8:12], handle)
+	binary.NativeEndian.PutUint32(b[12:16], parent)
+	binary.NativeEndian.PutUint32(b[16:20], info)
+	return b
+}
+
+// htons converts a host-order uint16 into the value the kernel expects when a
+// network-order protocol number is stored in a host-order field.
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.NativeEndian.Uint16(b)
+}
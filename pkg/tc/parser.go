@@ -32,9 +32,41 @@ type ActionStats struct {
 	BacklogPkts  int64
 	Installed    string // "19 sec"
 	Used         string // "19 sec"
+	Cookie       string // hex, as set with `cookie` when the filter was added
+
+	// Details of the action kinds that carry them, nil for the others
+	Skbmod *SkbmodAction
+	Pedit  *PeditAction
+	Csum   *CsumAction
+	Police *PoliceAction
 }
 
-// ParseFilterStats parses the output of `tc -s filter show` command
+// Cookie returns the cookie of the filter's first action that has one, which
+// identifies the rule filter tcbroker installed it for, or "" if none does.
+func (f *FilterStats) Cookie() string {
+	for _, a := range f.Actions {
+		if a.Cookie != "" {
+			return a.Cookie
+		}
+	}
+	return ""
+}
+
+// Patterns of the text output read by ParseFilterStats
+var (
+	mirredRe     = regexp.MustCompile(`mirred \(([^)]+)\)`)
+	sentRe       = regexp.MustCompile(`Sent (\d+) bytes (\d+) pkt`)
+	droppedRe    = regexp.MustCompile(`dropped (\d+)`)
+	overlimitsRe = regexp.MustCompile(`overlimits (\d+)`)
+	requeuesRe   = regexp.MustCompile(`requeues (\d+)`)
+	backlogRe    = regexp.MustCompile(`backlog (\d+)b (\d+)p`)
+	csumRe       = regexp.MustCompile(`csum \(([^)]*)\)`)
+	peditKeyRe   = regexp.MustCompile(`key #\d+\s+at (?:(\w+)\+)?(\d+): (val|add) ([0-9a-f]+) mask ([0-9a-f]+)`)
+)
+
+// ParseFilterStats parses the text output of the `tc -s filter show`
+// command. Runner decodes `tc -s -j filter show` with ParseFilterStatsJSON
+// instead and uses it only for versions of tc without JSON output.
 func ParseFilterStats(output string) ([]FilterStats, error) {
 	if strings.TrimSpace(output) == "" {
 		return []FilterStats{}, nil
@@ -52,8 +84,9 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 	for _, line := range lines {
 		line = strings.TrimRight(line, "\r\n")
 
-		// New filter block - only count lines with "handle" as actual filter entries
-		if strings.HasPrefix(line, "filter protocol") && strings.Contains(line, "handle") {
+		// New filter block - only count lines with a handle as actual filter entries
+		// (u32 prints its handle as "fh")
+		if strings.HasPrefix(line, "filter protocol") && (strings.Contains(line, " handle ") || strings.Contains(line, " fh ")) {
 			// Save previous filter if exists
 			if currentFilter != nil && currentAction != nil {
 				currentFilter.Actions = append(currentFilter.Actions, *currentAction)
@@ -83,7 +116,7 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 							currentFilter.Priority = pref
 						}
 					}
-				case "handle":
+				case "handle", "fh":
 					if i+1 < len(parts) {
 						currentFilter.Handle = parts[i+1]
 					}
@@ -104,6 +137,13 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 			continue
 		}
 
+		// Cookie line, printed after the action statistics: "cookie 0123abcd"
+		if cookie, found := strings.CutPrefix(strings.TrimSpace(line), "cookie "); found && currentAction != nil {
+			currentAction.Cookie = strings.TrimSpace(cookie)
+			inActionStats = false
+			continue
+		}
+
 		// Match conditions (indented lines before action)
 		if strings.HasPrefix(line, "  ") && !strings.Contains(line, "action") && !inActionStats {
 			line = strings.TrimSpace(line)
@@ -131,14 +171,19 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 			currentAction = &ActionStats{}
 			inActionStats = false
 
+			// The action kind follows "action order N:"
+			if _, after, found := strings.Cut(line, ":"); found {
+				if fields := strings.Fields(after); len(fields) > 0 {
+					currentAction.Type = fields[0]
+				}
+			}
+
 			// Parse mirred action
-			if strings.Contains(line, "mirred") {
-				currentAction.Type = "mirred"
+			if currentAction.Type == "mirred" {
 
 				// Extract operation and target device
 				// Example: "mirred (Egress Mirror to device veth1) pipe"
-				re := regexp.MustCompile(`mirred \(([^)]+)\)`)
-				if matches := re.FindStringSubmatch(line); len(matches) > 1 {
+				if matches := mirredRe.FindStringSubmatch(line); len(matches) > 1 {
 					opParts := strings.Fields(matches[1])
 					// "Egress Mirror to device veth1"
 					if len(opParts) >= 2 {
@@ -149,9 +194,76 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 					}
 				}
 			}
+
+			// Parse gact action: "gact action pass"
+			if currentAction.Type == "gact" {
+				if _, op, found := strings.Cut(line, "gact action "); found {
+					if fields := strings.Fields(op); len(fields) > 0 {
+						currentAction.Operation = fields[0]
+					}
+				}
+			}
+
+			fields := strings.Fields(line)
+			switch currentAction.Type {
+			case "skbmod":
+				// "skbmod pipe set dmac 52:54:00:12:34:56 set smac 52:54:00:00:00:01"
+				currentAction.Skbmod = &SkbmodAction{}
+				for i := 0; i+2 < len(fields); i++ {
+					if fields[i] == "set" && fields[i+1] == "dmac" {
+						currentAction.Skbmod.DstMAC = fields[i+2]
+					}
+					if fields[i] == "set" && fields[i+1] == "smac" {
+						currentAction.Skbmod.SrcMAC = fields[i+2]
+					}
+				}
+			case "pedit":
+				// The keys follow on lines of their own
+				currentAction.Pedit = &PeditAction{}
+			case "csum":
+				// "csum (iph, tcp) action pipe"
+				currentAction.Csum = &CsumAction{}
+				if matches := csumRe.FindStringSubmatch(line); len(matches) == 2 && matches[1] != "" {
+					currentAction.Csum.Targets = strings.Split(matches[1], ", ")
+				}
+			case "police":
+				// "police 0x1 rate 1Mbit burst 10Kb mtu 2Kb action drop overhead 0b"
+				currentAction.Police = &PoliceAction{}
+				for i := 0; i+1 < len(fields); i++ {
+					switch fields[i] {
+					case "rate":
+						if rate, errConv := parseRate(fields[i+1]); errConv == nil {
+							currentAction.Police.Rate = rate
+						}
+					case "burst":
+						if burst, errConv := parseSize(fields[i+1]); errConv == nil {
+							currentAction.Police.Burst = burst
+						}
+					}
+				}
+			}
 			continue
 		}
 
+		// pedit key line: "key #0  at ipv4+16: val 0a000064 mask 00000000"
+		if currentAction != nil && currentAction.Pedit != nil {
+			if matches := peditKeyRe.FindStringSubmatch(line); len(matches) == 6 {
+				key := PeditKey{HeaderType: matches[1], Cmd: "set"}
+				if matches[3] == "add" {
+					key.Cmd = "add"
+				}
+				key.Offset, _ = strconv.Atoi(matches[2])
+				if v, errConv := strconv.ParseUint(matches[4], 16, 32); errConv == nil {
+					key.Value = uint32(v)
+				}
+				if v, errConv := strconv.ParseUint(matches[5], 16, 32); errConv == nil {
+					key.Mask = uint32(v)
+				}
+				currentAction.Pedit.Keys = append(currentAction.Pedit.Keys, key)
+				continue
+			}
+		}
+
 		// Metadata line: "index 1 ref 1 bind 1 installed 19 sec used 19 sec"
 		if currentAction != nil && strings.Contains(line, "installed") && strings.Contains(line, "used") {
 			parts := strings.Fields(strings.TrimSpace(line))
@@ -177,8 +289,7 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 			line = strings.TrimSpace(line)
 
 			// Extract: Sent 840 bytes 10 pkt
-			re := regexp.MustCompile(`Sent (\d+) bytes (\d+) pkt`)
-			if matches := re.FindStringSubmatch(line); len(matches) == 3 {
+			if matches := sentRe.FindStringSubmatch(line); len(matches) == 3 {
 				if bytes, errConv := strconv.ParseInt(matches[1], 10, 64); errConv == nil {
 					currentAction.Bytes = bytes
 				}
@@ -188,22 +299,19 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 			}
 
 			// Extract: (dropped 0, overlimits 0 requeues 0)
-			re = regexp.MustCompile(`dropped (\d+)`)
-			if matches := re.FindStringSubmatch(line); len(matches) == 2 {
+			if matches := droppedRe.FindStringSubmatch(line); len(matches) == 2 {
 				if dropped, errConv := strconv.ParseInt(matches[1], 10, 64); errConv == nil {
 					currentAction.Dropped = dropped
 				}
 			}
 
-			re = regexp.MustCompile(`overlimits (\d+)`)
-			if matches := re.FindStringSubmatch(line); len(matches) == 2 {
+			if matches := overlimitsRe.FindStringSubmatch(line); len(matches) == 2 {
 				if overlimits, errConv := strconv.ParseInt(matches[1], 10, 64); errConv == nil {
 					currentAction.Overlimits = overlimits
 				}
 			}
 
-			re = regexp.MustCompile(`requeues (\d+)`)
-			if matches := re.FindStringSubmatch(line); len(matches) == 2 {
+			if matches := requeuesRe.FindStringSubmatch(line); len(matches) == 2 {
 				if requeues, errConv := strconv.ParseInt(matches[1], 10, 64); errConv == nil {
 					currentAction.Requeues = requeues
 				}
@@ -214,8 +322,7 @@ func ParseFilterStats(output string) ([]FilterStats, error) {
 		// Parse backlog: "backlog 0b 0p requeues 0"
 		if inActionStats && currentAction != nil && strings.Contains(line, "backlog") {
 			line = strings.TrimSpace(line)
-			re := regexp.MustCompile(`backlog (\d+)b (\d+)p`)
-			if matches := re.FindStringSubmatch(line); len(matches) == 3 {
+			if matches := backlogRe.FindStringSubmatch(line); len(matches) == 3 {
 				if bytes, errConv := strconv.ParseInt(matches[1], 10, 64); errConv == nil {
 					currentAction.BacklogBytes = bytes
 				}
@@ -257,6 +364,27 @@ func FormatBytes(bytes int64) string {
 func (f *FilterStats) GetMatchDescription() string {
 	parts := []string{}
 
+	// Name the ethertype unless it is implied by the other matches
+	if ethType, ok := f.Matches["eth_type"]; ok && ethType != "ipv4" && ethType != "ipv6" && ethType != "802.1Q" {
+		parts = append(parts, strings.ToUpper(ethType))
+	}
+
+	if vlanID, ok := f.Matches["vlan_id"]; ok {
+		parts = append(parts, fmt.Sprintf("vlan=%s", vlanID))
+	}
+
+	if vlanPrio, ok := f.Matches["vlan_prio"]; ok {
+		parts = append(parts, fmt.Sprintf("vlan_prio=%s", vlanPrio))
+	}
+
+	if srcMAC, ok := f.Matches["src_mac"]; ok {
+		parts = append(parts, fmt.Sprintf("smac=%s", srcMAC))
+	}
+
+	if dstMAC, ok := f.Matches["dst_mac"]; ok {
+		parts = append(parts, fmt.Sprintf("dmac=%s", dstMAC))
+	}
+
 	if proto, ok := f.Matches["ip_proto"]; ok {
 		parts = append(parts, strings.ToUpper(proto))
 	}
@@ -277,6 +405,26 @@ func (f *FilterStats) GetMatchDescription() string {
 		parts = append(parts, fmt.Sprintf("dport=%s", dstPort))
 	}
 
+	if tcpFlags, ok := f.Matches["tcp_flags"]; ok {
+		parts = append(parts, fmt.Sprintf("flags=%s", tcpFlags))
+	}
+
+	if icmpType, ok := f.Matches["icmp_type"]; ok {
+		parts = append(parts, fmt.Sprintf("type=%s", icmpType))
+	}
+
+	if icmpCode, ok := f.Matches["icmp_code"]; ok {
+		parts = append(parts, fmt.Sprintf("code=%s", icmpCode))
+	}
+
+	if tos, ok := f.Matches["ip_tos"]; ok {
+		parts = append(parts, fmt.Sprintf("tos=%s", tos))
+	}
+
+	if ttl, ok := f.Matches["ip_ttl"]; ok {
+		parts = append(parts, fmt.Sprintf("ttl=%s", ttl))
+	}
+
 	if len(parts) == 0 {
 		return "ALL"
 	}
@@ -1,7 +1,11 @@
 package tc
 
 import (
+	"reflect"
 	"testing"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
 )
 
 func TestParseFilterStats(t *testing.T) {
@@ -180,6 +184,26 @@ func TestGetMatchDescription(t *testing.T) {
 			matches:  map[string]string{"ip_proto": "udp", "src_ip": "192.168.1.0/24", "dst_port": "53"},
 			expected: "UDP src=192.168.1.0/24 dport=53",
 		},
+		{
+			name:     "ARP from a host",
+			matches:  map[string]string{"eth_type": "arp", "src_mac": "52:54:00:12:34:56"},
+			expected: "ARP smac=52:54:00:12:34:56",
+		},
+		{
+			name:     "VLAN with TCP",
+			matches:  map[string]string{"eth_type": "802.1Q", "vlan_id": "100", "vlan_prio": "3", "vlan_ethtype": "ipv4", "ip_proto": "tcp"},
+			expected: "vlan=100 vlan_prio=3 TCP",
+		},
+		{
+			name:     "TCP SYN",
+			matches:  map[string]string{"ip_proto": "tcp", "dst_port": "22", "tcp_flags": "0x2/12"},
+			expected: "TCP dport=22 flags=0x2/12",
+		},
+		{
+			name:     "ICMP echo request with DSCP",
+			matches:  map[string]string{"ip_proto": "icmp", "icmp_type": "8", "icmp_code": "0", "ip_tos": "0xb8/fc", "ip_ttl": "0x40/ff"},
+			expected: "ICMP type=8 code=0 tos=0xb8/fc ttl=0x40/ff",
+		},
 		{
 			name:     "Empty matches",
 			matches:  map[string]string{},
@@ -197,3 +221,238 @@ func TestGetMatchDescription(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFilterStatsVLAN(t *testing.T) {
+	sampleOutput := `filter protocol 802.1Q pref 30000 flower chain 0
+filter protocol 802.1Q pref 30000 flower chain 0 handle 0x1
+  vlan_id 100
+  vlan_prio 3
+  vlan_ethtype ipv4
+  dst_mac 52:54:00:12:34:56
+  eth_type 802.1Q
+  ip_proto tcp
+  not_in_hw
+	action order 1: mirred (Egress Mirror to device veth1) continue
+	index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0`
+
+	filters, err := ParseFilterStats(sampleOutput)
+	if err != nil {
+		t.Fatalf("ParseFilterStats failed: %v", err)
+	}
+	if len(filters) != 1 {
+		t.Fatalf("Expected 1 filter, got %d", len(filters))
+	}
+	if filters[0].Protocol != "802.1Q" {
+		t.Errorf("Expected protocol '802.1Q', got '%s'", filters[0].Protocol)
+	}
+
+	// The reported keys must match what tcbroker expects to install
+	prio := 3
+	desired := DesiredFilter{
+		Target: filter.Mirred{Devs: []string{"veth1"}},
+		Filter: filter.Filter{DstMAC: "52:54:00:12:34:56", VlanID: 100, VlanPrio: &prio, EthType: "ipv4", IPProto: "tcp"},
+	}
+	if live, want := liveSignature(&filters[0]), desiredSignature(&desired); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+}
+
+func TestParseFilterStatsPass(t *testing.T) {
+	sampleOutput := `filter protocol ip pref 30000 flower chain 0
+filter protocol ip pref 30000 flower chain 0 handle 0x1
+  eth_type ipv4
+  ip_proto tcp
+  dst_port 22
+  not_in_hw
+	action order 1: gact action pass
+	 random type none pass val 0
+	 index 1 ref 1 bind 1 installed 12 sec used 3 sec
+	Action statistics:
+	Sent 1200 bytes 20 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0`
+
+	filters, err := ParseFilterStats(sampleOutput)
+	if err != nil {
+		t.Fatalf("ParseFilterStats failed: %v", err)
+	}
+	if len(filters) != 1 || len(filters[0].Actions) != 1 {
+		t.Fatalf("Expected 1 filter with 1 action, got %+v", filters)
+	}
+	action := filters[0].Actions[0]
+	if action.Type != "gact" || action.Operation != "pass" || action.Packets != 20 {
+		t.Errorf("Expected gact pass with 20 packets, got %+v", action)
+	}
+
+	desired := DesiredFilter{Exclude: true, Filter: filter.Filter{IPProto: "tcp", DstPort: filter.Port(22)}}
+	if live, want := liveSignature(&filters[0]), desiredSignature(&desired); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+}
+
+func TestParseFilterStatsCookie(t *testing.T) {
+	sampleOutput := `filter protocol ip pref 30100 flower chain 0
+filter protocol ip pref 30100 flower chain 0 handle 0x1
+  eth_type ipv4
+  ip_proto tcp
+  dst_port 443
+  not_in_hw
+	action order 1: mirred (Egress Mirror to device ids0) pipe
+	index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+	cookie 9f1c2a7d3b5e4f60
+
+	action order 2: mirred (Egress Mirror to device rec0) continue
+	index 2 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+	cookie 9f1c2a7d3b5e4f60
+`
+
+	filters, err := ParseFilterStats(sampleOutput)
+	if err != nil {
+		t.Fatalf("ParseFilterStats failed: %v", err)
+	}
+	if len(filters) != 1 || len(filters[0].Actions) != 2 {
+		t.Fatalf("Expected 1 filter with 2 actions, got %+v", filters)
+	}
+	for i, action := range filters[0].Actions {
+		if action.Cookie != "9f1c2a7d3b5e4f60" {
+			t.Errorf("Expected action %d cookie '9f1c2a7d3b5e4f60', got '%s'", i+1, action.Cookie)
+		}
+	}
+	if filters[0].Actions[1].TargetDev != "rec0" || filters[0].Actions[1].Packets != 10 {
+		t.Errorf("Unexpected second action: %+v", filters[0].Actions[1])
+	}
+	if filters[0].Cookie() != "9f1c2a7d3b5e4f60" {
+		t.Errorf("Expected filter cookie '9f1c2a7d3b5e4f60', got '%s'", filters[0].Cookie())
+	}
+
+	// A filter with another cookie needs to be replaced
+	desired := DesiredFilter{
+		ID:     FilterID{Pref: 30100, Handle: 1, Cookie: "9f1c2a7d3b5e4f60"},
+		Target: filter.Mirred{Devs: []string{"ids0", "rec0"}},
+		Filter: filter.Filter{IPProto: "tcp", DstPort: filter.Port(443)},
+	}
+	if live, want := liveSignature(&filters[0]), desiredSignature(&desired); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+	desired.ID.Cookie = "0000000000000000"
+	if liveSignature(&filters[0]) == desiredSignature(&desired) {
+		t.Error("Expected signatures with different cookies to differ")
+	}
+}
+
+func TestParseFilterStatsActionDetails(t *testing.T) {
+	sampleOutput := `filter protocol ip pref 30100 flower chain 0
+filter protocol ip pref 30100 flower chain 0 handle 0x1
+  eth_type ipv4
+  ip_proto tcp
+  dst_ip 10.0.0.1
+  dst_port 80
+  not_in_hw
+	action order 1: skbmod pipe set dmac 52:54:00:12:34:56
+	 index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+
+	action order 2:  pedit action pipe keys 1
+ 	 index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	 key #0  at ipv4+16: val 0a000064 mask 00000000
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+
+	action order 3: csum (iph, tcp) action pipe
+	index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+
+	action order 4: mirred (Egress Mirror to device eth1) continue
+	index 1 ref 1 bind 1 installed 30 sec used 5 sec
+	Action statistics:
+	Sent 840 bytes 10 pkt (dropped 0, overlimits 0 requeues 0)
+	backlog 0b 0p requeues 0
+filter protocol ip pref 49152 flower chain 0
+filter protocol ip pref 49152 flower chain 0 handle 0x1
+  eth_type ipv4
+  not_in_hw
+	action order 1:  police 0x1 rate 1Mbit burst 10Kb mtu 2Kb action drop overhead 0b
+	ref 1 bind 1  installed 5 sec used 5 sec
+	Action statistics:
+	Sent 0 bytes 0 pkt (dropped 3, overlimits 3 requeues 0)
+	backlog 0b 0p requeues 0`
+
+	filters, err := ParseFilterStats(sampleOutput)
+	if err != nil {
+		t.Fatalf("ParseFilterStats failed: %v", err)
+	}
+	if len(filters) != 2 || len(filters[0].Actions) != 4 || len(filters[1].Actions) != 1 {
+		t.Fatalf("Expected filters with 4 and 1 actions, got %+v", filters)
+	}
+
+	actions := filters[0].Actions
+	if !reflect.DeepEqual(actions[0].Skbmod, &SkbmodAction{DstMAC: "52:54:00:12:34:56"}) {
+		t.Errorf("Unexpected skbmod details: %+v", actions[0].Skbmod)
+	}
+	expectedKeys := []PeditKey{{HeaderType: "ipv4", Offset: 16, Cmd: "set", Value: 0x0a000064}}
+	if actions[1].Pedit == nil || !reflect.DeepEqual(actions[1].Pedit.Keys, expectedKeys) {
+		t.Errorf("Expected pedit keys %+v, got %+v", expectedKeys, actions[1].Pedit)
+	}
+	if actions[1].Packets != 10 {
+		t.Errorf("Expected the pedit key line not to disturb the counters, got %d packets", actions[1].Packets)
+	}
+	if actions[2].Csum == nil || !reflect.DeepEqual(actions[2].Csum.Targets, []string{"iph", "tcp"}) {
+		t.Errorf("Expected csum targets [iph tcp], got %+v", actions[2].Csum)
+	}
+	police := filters[1].Actions[0]
+	if !reflect.DeepEqual(police.Police, &PoliceAction{Rate: 125000, Burst: 10240}) || police.Dropped != 3 {
+		t.Errorf("Unexpected police action: %+v (%+v)", police, police.Police)
+	}
+
+	// The details take part in the comparison with the config
+	desired := DesiredFilter{
+		Target:  filter.Mirred{Devs: []string{"eth1"}},
+		Filter:  filter.Filter{IPProto: "tcp", DstIP: "10.0.0.1", DstPort: filter.Port(80)},
+		Rewrite: &config.RewriteOptions{DstMAC: "52:54:00:12:34:56", DstIP: "10.0.0.100"},
+	}
+	if live, want := liveSignature(&filters[0]), desiredSignature(&desired); live != want {
+		t.Errorf("Expected signature:\n  %s\ngot:\n  %s", want, live)
+	}
+	desired.Rewrite.DstIP = "10.0.0.101"
+	if liveSignature(&filters[0]) == desiredSignature(&desired) {
+		t.Error("Expected a different rewrite address to change the signature")
+	}
+}
+
+func TestParseFilterStatsU32(t *testing.T) {
+	// u32 filters print their handle as "fh" and must not be skipped
+	sampleOutput := `filter protocol all pref 5 u32 chain 0 
+filter protocol all pref 5 u32 chain 0 fh 800: ht divisor 1 
+filter protocol all pref 5 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 not_in_hw 
+  match 00000000/00000000 at 0`
+
+	filters, err := ParseFilterStats(sampleOutput)
+	if err != nil {
+		t.Fatalf("ParseFilterStats failed: %v", err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("Expected 2 filters, got %d", len(filters))
+	}
+	if filters[1].Handle != "800::800" {
+		t.Errorf("Expected handle '800::800', got '%s'", filters[1].Handle)
+	}
+	if filters[1].MatchType != "u32" {
+		t.Errorf("Expected match type 'u32', got '%s'", filters[1].MatchType)
+	}
+	if filters[1].IsOwned() {
+		t.Error("Expected pref 5 filter not to be owned by tcbroker")
+	}
+}
@@ -0,0 +1,68 @@
+package tc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// tcbroker installs its filters with preferences from a reserved range so it
+// can tell them apart from filters that other tools (CNIs, eBPF loaders,
+// other teams) attach to the same clsact qdisc.
+const (
+	OwnedPriorityMin = 30000
+	OwnedPriorityMax = 39999
+)
+
+// Each rule priority owns a block of config.MaxFiltersPerRule preferences in
+// the reserved range, so the filters of rule priority p are installed at
+// 30000 + p*100 + n, where n is the position of the filter in its rule.
+const prefsPerRule = config.MaxFiltersPerRule
+
+// IsOwnedPriority reports whether pref lies in the range reserved for tcbroker.
+func IsOwnedPriority(pref int) bool {
+	return pref >= OwnedPriorityMin && pref <= OwnedPriorityMax
+}
+
+// IsOwned reports whether the filter was installed by tcbroker.
+func (f *FilterStats) IsOwned() bool {
+	return IsOwnedPriority(f.Priority)
+}
+
+// FilterID is the preference and flower handle a filter is installed with,
+// and the cookie tagging its actions. All three follow from the configuration
+// alone, so a filter can be found again and deleted without comparing its
+// match, and its counters can be told apart from those of other rules.
+type FilterID = filter.ID
+
+// NewFilterID returns the ID of the n-th filter (counting from 0, exclusions
+// included) of the rule with the given name and priority, installed for the
+// rule filter at filterIndex. Exclusions share the cookie of the filter they
+// precede, and so do the filters a port list expands into.
+func NewFilterID(rule string, rulePriority, filterIndex, n int) FilterID {
+	return FilterID{
+		Pref:   OwnedPriorityMin + rulePriority*prefsPerRule + n,
+		Handle: uint32(n + 1),
+		Cookie: FilterCookie(rule, filterIndex),
+	}
+}
+
+// FilterCookie returns the action cookie of the filter at index of the
+// named rule: the 64-bit FNV-1a hash of both, in hex as tc prints it.
+func FilterCookie(rule string, index int) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d", rule, index)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RulePriority returns the priority of the rule that owns pref, or 0 if pref
+// is not in the reserved range.
+func RulePriority(pref int) int {
+	if !IsOwnedPriority(pref) {
+		return 0
+	}
+	return (pref - OwnedPriorityMin) / prefsPerRule
+}
@@ -2,7 +2,7 @@ package tc
 
 import (
 	"fmt"
-	"strings"
+	"net"
 )
 
 // EnsureClsactQdisc ensures the clsact qdisc is attached to the specified network interface.
@@ -10,14 +10,11 @@ import (
 // ingress and egress hooks.
 // Command: `tc qdisc add dev <iface> clsact`
 func (r *Runner) EnsureClsactQdisc(iface string) error {
-	// Using "replace" is safer as it will create or update the qdisc.
-	// If it already exists, "add" would fail. "replace" avoids this.
-	// However, for simplicity and sticking to the original plan, we use "add"
-	// and handle the error. A simple "add" is often sufficient.
 	_, stderr, err := r.Run("qdisc", "add", "dev", iface, "clsact")
 	if err != nil {
-		// Ignore "File exists" error, which means the qdisc is already there.
-		if strings.Contains(stderr, "File exists") {
+		// tc's messages differ between iproute2 versions and locales, so
+		// whether the qdisc was already there is asked of tc -j instead
+		if present, qerr := r.HasClsactQdisc(iface); qerr == nil && present {
 			return nil
 		}
 		return fmt.Errorf("failed to add clsact qdisc to %s: %w, stderr: %s", iface, err, stderr)
@@ -26,18 +23,24 @@ func (r *Runner) EnsureClsactQdisc(iface string) error {
 }
 
 // DeleteClsactQdisc deletes the clsact qdisc from the specified network interface.
+// A missing qdisc or interface is not an error.
 // Command: `tc qdisc del dev <iface> clsact`
 func (r *Runner) DeleteClsactQdisc(iface string) error {
 	_, stderr, err := r.Run("qdisc", "del", "dev", iface, "clsact")
 	if err != nil {
-		// Ignore errors that indicate the qdisc doesn't exist or is already gone
-		if strings.Contains(stderr, "Cannot find device") ||
-			strings.Contains(stderr, "No such file or directory") ||
-			strings.Contains(stderr, "Invalid handle") ||
-			strings.Contains(stderr, "RTNETLINK answers: No such file or directory") {
+		if !linkExists(iface) {
+			return nil
+		}
+		if present, qerr := r.HasClsactQdisc(iface); qerr == nil && !present {
 			return nil
 		}
 		return fmt.Errorf("failed to delete clsact qdisc from %s: %w, stderr: %s", iface, err, stderr)
 	}
 	return nil
 }
+
+// linkExists reports whether the named network interface exists.
+func linkExists(iface string) bool {
+	_, err := net.InterfaceByName(iface)
+	return err == nil
+}
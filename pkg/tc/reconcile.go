@@ -0,0 +1,548 @@
+package tc
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// Plan actions
+const (
+	PlanAdd    = "add"
+	PlanRemove = "remove"
+	PlanKeep   = "keep"
+)
+
+// DesiredFilter is one filter the configuration asks for on a single hook.
+// Exclusions are pass filters and carry neither Target nor Rewrite.
+type DesiredFilter struct {
+	Rule    string
+	Iface   string
+	Hook    string
+	ID      FilterID
+	Exclude bool
+	Target  filter.Mirred
+	Filter  filter.Filter
+	Rewrite *config.RewriteOptions
+}
+
+// FilterChange is a single entry of a Plan. Added filters carry Desired,
+// removed and kept filters carry the Live filter they refer to.
+type FilterChange struct {
+	Action  string
+	Iface   string
+	Hook    string
+	Desired *DesiredFilter
+	Live    *FilterStats
+}
+
+// Plan is the difference between the configuration and the filters that are
+// installed on the host.
+type Plan struct {
+	// Qdiscs lists the interfaces that need a clsact qdisc before filters can be added.
+	Qdiscs  []string
+	Changes []FilterChange
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(action string) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// HasChanges reports whether applying the plan would modify the host.
+func (p *Plan) HasChanges() bool {
+	return len(p.Qdiscs) > 0 || p.Count(PlanAdd) > 0 || p.Count(PlanRemove) > 0
+}
+
+// Match returns a human-readable description of the filter's match.
+func (c *FilterChange) Match() string {
+	if c.Live != nil {
+		return c.Live.GetMatchDescription()
+	}
+	expected := expectedFilterStats(c.Desired.ID, c.Desired.Target, c.Desired.Filter, toFilterRewrite(c.Desired.Rewrite))
+	return expected.GetMatchDescription()
+}
+
+// Pref returns the preference of the filter: the one it is installed at, or
+// the one it will get if it is added.
+func (c *FilterChange) Pref() int {
+	if c.Live != nil {
+		return c.Live.Priority
+	}
+	return c.Desired.ID.Pref
+}
+
+// Target returns the interfaces the filter mirrors or redirects to,
+// separated by commas. It is empty for exclusions.
+func (c *FilterChange) Target() string {
+	if c.Desired != nil {
+		return strings.Join(c.Desired.Target.Devs, ",")
+	}
+	var targets []string
+	for _, a := range c.Live.Actions {
+		if a.Type == "mirred" {
+			targets = append(targets, a.TargetDev)
+		}
+	}
+	return strings.Join(targets, ",")
+}
+
+// Operation returns the operation of the filter's last mirred action as tc
+// prints it, e.g. "Egress Mirror", or "Pass" for an exclusion.
+func (c *FilterChange) Operation() string {
+	if c.Desired != nil {
+		if c.Desired.Exclude {
+			return passOperationName
+		}
+		return mirredOperationName(c.Desired.Target.GetHook(), c.Desired.Target.GetAction())
+	}
+	operation := ""
+	for _, a := range c.Live.Actions {
+		switch {
+		case a.Type == "mirred":
+			operation = a.Operation
+		case a.Type == "gact" && a.Operation == "pass":
+			operation = passOperationName
+		}
+	}
+	return operation
+}
+
+// passOperationName is the operation shown for exclusions.
+const passOperationName = "Pass"
+
+// Args returns the tc arguments that carry out the change: the
+// BuildTCArgsWithRewrite or BuildPassArgs arguments for an added filter and
+// a `filter del` for a removed one. Kept filters need no command.
+func (c *FilterChange) Args() []string {
+	switch c.Action {
+	case PlanAdd:
+		d := c.Desired
+		if d.Exclude {
+			return filter.BuildPassArgs(d.Iface, d.Hook, d.ID, d.Filter)
+		}
+		return filter.BuildTCArgsWithRewrite(d.Iface, d.Hook, d.Target, d.ID, d.Filter, toFilterRewrite(d.Rewrite))
+	case PlanRemove:
+		return []string{"filter", "del", "dev", c.Iface, c.Hook, "pref", strconv.Itoa(c.Live.Priority)}
+	default:
+		return nil
+	}
+}
+
+// DesiredFilters expands the configuration into one DesiredFilter per rule
+// filter and hook, in configuration order. The exclusions of a filter come
+// right before it, and the IDs number the filters of each rule in this order.
+func DesiredFilters(cfg *config.Config) []DesiredFilter {
+	var desired []DesiredFilter
+	priorities := cfg.Priorities()
+	for i, rule := range cfg.Rules {
+		for _, hook := range rule.Hooks() {
+			n := 0
+			for j, f := range rule.Filters {
+				for _, expanded := range filter.Expand(f) {
+					for _, x := range rule.Exclusions(expanded) {
+						desired = append(desired, DesiredFilter{
+							Rule:    rule.Name,
+							Iface:   rule.SrcIntf,
+							Hook:    hook,
+							ID:      NewFilterID(rule.Name, priorities[i], j, n),
+							Exclude: true,
+							Filter:  x,
+						})
+						n++
+					}
+					desired = append(desired, DesiredFilter{
+						Rule:    rule.Name,
+						Iface:   rule.SrcIntf,
+						Hook:    hook,
+						ID:      NewFilterID(rule.Name, priorities[i], j, n),
+						Target:  rule.Mirred(),
+						Filter:  expanded,
+						Rewrite: rule.Rewrite,
+					})
+					n++
+				}
+			}
+		}
+	}
+	return desired
+}
+
+// ComputePlan compares the configuration with the filters installed on the
+// source interfaces it names. Only filters owned by tcbroker are considered;
+// an installed filter is kept when it has the ID, match and actions of a
+// desired one, and removed otherwise. Filters left behind at other
+// preferences, for example by an older configuration, are removed as well.
+func ComputePlan(b Backend, cfg *config.Config) (*Plan, error) {
+	plan := &Plan{}
+
+	desiredByHook := make(map[string][]DesiredFilter)
+	seen := make(map[string]bool)
+	var ifaces []string
+	for _, d := range DesiredFilters(cfg) {
+		if !seen[d.Iface] {
+			seen[d.Iface] = true
+			ifaces = append(ifaces, d.Iface)
+		}
+		key := d.Iface + "/" + d.Hook
+		desiredByHook[key] = append(desiredByHook[key], d)
+	}
+
+	for _, iface := range ifaces {
+		hasClsact, err := b.HasClsactQdisc(iface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check qdisc on %s: %w", iface, err)
+		}
+		if !hasClsact {
+			plan.Qdiscs = append(plan.Qdiscs, iface)
+		}
+
+		for _, hook := range []string{"ingress", "egress"} {
+			var live []FilterStats
+			if hasClsact {
+				filters, err := b.ListFilterStats(iface, hook)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list filters on %s (%s): %w", iface, hook, err)
+				}
+				for _, f := range filters {
+					if f.IsOwned() {
+						live = append(live, f)
+					}
+				}
+			}
+			plan.Changes = append(plan.Changes, diffHook(iface, hook, desiredByHook[iface+"/"+hook], live)...)
+		}
+	}
+
+	return plan, nil
+}
+
+// diffHook matches desired filters against the live filters of one hook. A
+// live filter is kept when it has the preference and handle of a desired
+// filter as well as its match and actions.
+func diffHook(iface, hook string, desired []DesiredFilter, live []FilterStats) []FilterChange {
+	sort.SliceStable(live, func(i, j int) bool { return live[i].Priority < live[j].Priority })
+
+	var changes []FilterChange
+	kept := make(map[int]bool)
+	for i := range desired {
+		d := &desired[i]
+		sig := desiredSignature(d)
+		idx := slices.IndexFunc(live, func(f FilterStats) bool {
+			return f.Priority == d.ID.Pref && f.Handle == d.ID.HandleString() && liveSignature(&f) == sig
+		})
+		if idx >= 0 && !kept[idx] {
+			kept[idx] = true
+			changes = append(changes, FilterChange{Action: PlanKeep, Iface: iface, Hook: hook, Desired: d, Live: &live[idx]})
+			continue
+		}
+		changes = append(changes, FilterChange{Action: PlanAdd, Iface: iface, Hook: hook, Desired: d})
+	}
+
+	for i := range live {
+		if !kept[i] {
+			changes = append(changes, FilterChange{Action: PlanRemove, Iface: iface, Hook: hook, Live: &live[i]})
+		}
+	}
+	return changes
+}
+
+// ApplyPlan makes the host match the plan. Missing qdiscs and filters are
+// installed before stale filters are removed, so traffic that both the old
+// and the new configuration select keeps being mirrored throughout. The only
+// exception is a stale filter at the preference of a new one, which has to
+// make room for it first. The additions are transactional: if one fails,
+// everything added so far is rolled back and a *RollbackError is returned;
+// filters that made room are not restored.
+func ApplyPlan(b Backend, plan *Plan) error {
+	tx := NewTransaction(b)
+	for _, iface := range plan.Qdiscs {
+		if err := tx.EnsureClsactQdisc(iface); err != nil {
+			return tx.Rollback(fmt.Errorf("failed to add clsact qdisc to %s: %w", iface, err))
+		}
+	}
+
+	removed := make(map[*FilterChange]bool)
+	remove := func(c *FilterChange) error {
+		removed[c] = true
+		if err := b.DeleteFilter(c.Iface, c.Hook, c.Live.Priority); err != nil {
+			return fmt.Errorf("failed to remove stale filter pref %d from %s (%s): %w", c.Live.Priority, c.Iface, c.Hook, err)
+		}
+		return nil
+	}
+
+	for _, c := range plan.Changes {
+		if c.Action != PlanAdd {
+			continue
+		}
+		d := c.Desired
+		for i := range plan.Changes {
+			stale := &plan.Changes[i]
+			if stale.Action == PlanRemove && !removed[stale] && stale.Iface == d.Iface && stale.Hook == d.Hook && stale.Live.Priority == d.ID.Pref {
+				if err := remove(stale); err != nil {
+					return tx.Rollback(err)
+				}
+			}
+		}
+
+		if d.Exclude {
+			if err := tx.AddPassFilter(d.Iface, d.Hook, d.ID, d.Filter); err != nil {
+				return tx.Rollback(fmt.Errorf("failed to add exclude for rule '%s': %w", d.Rule, err))
+			}
+			continue
+		}
+		if err := tx.AddMirrorFilter(d.Iface, d.Hook, d.ID, d.Target, d.Filter, d.Rewrite); err != nil {
+			return tx.Rollback(fmt.Errorf("failed to add filter for rule '%s': %w", d.Rule, err))
+		}
+	}
+
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		if c.Action != PlanRemove || removed[c] {
+			continue
+		}
+		if err := remove(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// signatureMatchKeys are the flower keys tcbroker sets. Other keys tc reports,
+// such as not_in_hw, don't take part in the comparison.
+var signatureMatchKeys = []string{
+	"eth_type", "src_mac", "dst_mac", "vlan_id", "vlan_prio", "vlan_ethtype",
+	"ip_proto", "src_ip", "dst_ip", "ip_tos", "ip_ttl", "src_port", "dst_port",
+	"tcp_flags", "icmp_type", "icmp_code",
+}
+
+func liveSignature(f *FilterStats) string {
+	return signature(f.Matches, f.Actions)
+}
+
+func desiredSignature(d *DesiredFilter) string {
+	expected := expectedFilterStats(d.ID, d.Target, d.Filter, toFilterRewrite(d.Rewrite))
+	if d.Exclude {
+		expected = expectedPassFilterStats(d.ID, d.Filter)
+	}
+	return signature(expected.Matches, expected.Actions)
+}
+
+func signature(matches map[string]string, actions []ActionStats) string {
+	var parts []string
+	for _, key := range signatureMatchKeys {
+		if v, ok := matches[key]; ok {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	parts = append(parts, "|")
+	for _, a := range actions {
+		var part string
+		switch {
+		case a.Type == "mirred":
+			part = fmt.Sprintf("mirred(%s %s)", a.Operation, a.TargetDev)
+		case a.Type == "gact":
+			part = fmt.Sprintf("gact(%s)", a.Operation)
+		case a.Skbmod != nil || a.Pedit != nil || a.Csum != nil:
+			// Compare what the rewrite actions set, so a changed address
+			// replaces the filter
+			part = fmt.Sprintf("%s(%s)", a.Type, strings.TrimPrefix(a.Describe(), a.Type+" "))
+		default:
+			part = a.Type
+		}
+		// Filters installed before actions carried cookies are replaced
+		if a.Cookie != "" {
+			part += "#" + a.Cookie
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// FilterMatches returns the match keys and values `tc filter show` reports
+// for a filter installed from f.
+func FilterMatches(f filter.Filter, rewrite *filter.RewriteOptions) map[string]string {
+	return expectedFilterStats(FilterID{}, filter.Mirred{}, f, rewrite).Matches
+}
+
+// expectedFilterStats builds the FilterStats that `tc -s filter show` reports
+// for a filter added by BuildTCArgsWithRewrite with the given ID, with
+// addresses normalized the way tc prints them.
+func expectedFilterStats(id FilterID, target filter.Mirred, f filter.Filter, rewrite *filter.RewriteOptions) FilterStats {
+	protocol := filter.Protocol(f, rewrite)
+	fs := FilterStats{
+		Protocol:  protocol,
+		Priority:  id.Pref,
+		Handle:    "0x1",
+		MatchType: "flower",
+		Matches:   map[string]string{},
+		Actions:   []ActionStats{},
+	}
+	if protocol != filter.ProtocolAll {
+		fs.Matches["eth_type"] = ethTypeMatch(protocol)
+	}
+	if f.SrcMAC != "" {
+		fs.Matches["src_mac"] = normalizeMAC(f.SrcMAC)
+	}
+	if f.DstMAC != "" {
+		fs.Matches["dst_mac"] = normalizeMAC(f.DstMAC)
+	}
+	if f.VlanID != 0 {
+		fs.Matches["vlan_id"] = strconv.Itoa(f.VlanID)
+	}
+	if f.VlanPrio != nil {
+		fs.Matches["vlan_prio"] = strconv.Itoa(*f.VlanPrio)
+	}
+	if f.IsVLAN() {
+		if inner := filter.NetworkProtocol(f, rewrite); inner != filter.ProtocolAll {
+			fs.Matches["vlan_ethtype"] = ethTypeMatch(inner)
+		}
+	}
+	if f.IPProto != "" {
+		fs.Matches["ip_proto"] = strings.ToLower(f.IPProto)
+	}
+	if f.SrcIP != "" {
+		fs.Matches["src_ip"] = normalizePrefix(f.SrcIP)
+	}
+	if f.DstIP != "" {
+		fs.Matches["dst_ip"] = normalizePrefix(f.DstIP)
+	}
+	if len(f.SrcPort) > 0 {
+		fs.Matches["src_port"] = f.SrcPort.String()
+	}
+	if len(f.DstPort) > 0 {
+		fs.Matches["dst_port"] = f.DstPort.String()
+	}
+	// tc prints the hex keys with a hex mask lacking the 0x prefix and the
+	// ICMP keys in decimal, with the mask only if it is partial
+	if f.TCPFlags != nil {
+		fs.Matches["tcp_flags"] = fmt.Sprintf("0x%x/%x", f.TCPFlags.Value, f.TCPFlags.MaskOf(filter.MaxTCPFlags))
+	}
+	if f.IPTOS != nil {
+		fs.Matches["ip_tos"] = fmt.Sprintf("0x%x/%x", f.IPTOS.Value, f.IPTOS.MaskOf(filter.MaxU8))
+	}
+	if f.IPTTL != nil {
+		fs.Matches["ip_ttl"] = fmt.Sprintf("0x%x/%x", f.IPTTL.Value, f.IPTTL.MaskOf(filter.MaxU8))
+	}
+	if f.ICMPType != nil {
+		fs.Matches["icmp_type"] = formatMaskedU8(uint8(f.ICMPType.Value), uint8(f.ICMPType.MaskOf(filter.MaxU8)))
+	}
+	if f.ICMPCode != nil {
+		fs.Matches["icmp_code"] = formatMaskedU8(uint8(f.ICMPCode.Value), uint8(f.ICMPCode.MaskOf(filter.MaxU8)))
+	}
+
+	if rewrite != nil {
+		if rewrite.DstMAC != "" || rewrite.SrcMAC != "" {
+			skbmod := &SkbmodAction{}
+			if rewrite.DstMAC != "" {
+				skbmod.DstMAC = normalizeMAC(rewrite.DstMAC)
+			}
+			if rewrite.SrcMAC != "" {
+				skbmod.SrcMAC = normalizeMAC(rewrite.SrcMAC)
+			}
+			fs.Actions = append(fs.Actions, ActionStats{Type: "skbmod", Skbmod: skbmod})
+		}
+		if rewrite.DstIP != "" || rewrite.SrcIP != "" {
+			// The rewrite was validated with the config, so keys is empty
+			// only for addresses tcbroker can't install anyway
+			ipv6 := filter.NetworkProtocol(f, rewrite) == filter.ProtocolIPv6
+			keys, _ := rewriteKeys(rewrite, ipv6)
+			fs.Actions = append(fs.Actions,
+				ActionStats{Type: "pedit", Pedit: &PeditAction{Keys: keys}},
+				ActionStats{Type: "csum", Csum: &CsumAction{Targets: csumTargets(f.IPProto, ipv6)}})
+		}
+	}
+	for i, dev := range target.Devs {
+		action := filter.MirredMirror
+		if i == len(target.Devs)-1 {
+			action = target.GetAction()
+		}
+		fs.Actions = append(fs.Actions, ActionStats{
+			Type:      "mirred",
+			Operation: mirredOperationName(target.GetHook(), action),
+			TargetDev: dev,
+		})
+	}
+	if id.Handle != 0 {
+		fs.Handle = id.HandleString()
+	}
+	for i := range fs.Actions {
+		fs.Actions[i].Cookie = id.Cookie
+	}
+	return fs
+}
+
+// expectedPassFilterStats builds the FilterStats that `tc -s filter show`
+// reports for a filter added by BuildPassArgs.
+func expectedPassFilterStats(id FilterID, f filter.Filter) FilterStats {
+	fs := expectedFilterStats(id, filter.Mirred{}, f, nil)
+	fs.Actions = append(fs.Actions, ActionStats{Type: "gact", Operation: "pass", Cookie: id.Cookie})
+	return fs
+}
+
+// mirredOperationName returns the operation `tc filter show` prints for a
+// mirred action, e.g. "Egress Redirect".
+func mirredOperationName(hook, action string) string {
+	return strings.ToUpper(hook[:1]) + hook[1:] + " " + strings.ToUpper(action[:1]) + action[1:]
+}
+
+// normalizePrefix renders an address or CIDR the way tc prints it: host
+// prefixes as a bare address, networks with their host bits cleared.
+func normalizePrefix(s string) string {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip.String()
+		}
+		return s
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return s
+	}
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
+	}
+	return ipNet.String()
+}
+
+// normalizeMAC renders a MAC address in the lower case tc prints.
+func normalizeMAC(s string) string {
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac.String()
+	}
+	return s
+}
+
+// ethTypeMatch returns how tc prints the eth_type or vlan_ethtype key of a
+// tc protocol: the IP protocols by family and the others by name.
+func ethTypeMatch(protocol string) string {
+	switch protocol {
+	case filter.ProtocolIPv4:
+		return "ipv4"
+	case filter.ProtocolIPv6:
+		return "ipv6"
+	}
+	return protocol
+}
+
+// formatMaskedU8 renders a masked 8-bit key the way tc prints ICMP types and
+// codes: in decimal, with the mask only if it is partial.
+func formatMaskedU8(value, mask uint8) string {
+	if mask == 0xff {
+		return strconv.Itoa(int(value))
+	}
+	return fmt.Sprintf("%d/%d", value, mask)
+}
@@ -0,0 +1,338 @@
+package tc
+
+import (
+	"testing"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+func reconcileConfig() *config.Config {
+	return &config.Config{
+		Rules: []config.Rule{
+			{
+				Name:    "http-mirror",
+				SrcIntf: "eth0",
+				DstIntf: config.Interfaces{"eth1"},
+				Filters: []filter.Filter{
+					{IPProto: "tcp", DstIP: "10.0.0.1/32", DstPort: filter.Port(80)},
+					{IPProto: "tcp", SrcIP: "192.168.1.10/24", DstPort: filter.Port(443)},
+				},
+			},
+			{
+				Name:    "dns-mirror",
+				SrcIntf: "eth0",
+				DstIntf: config.Interfaces{"eth2"},
+				Rewrite: &config.RewriteOptions{DstMAC: "52:54:00:12:34:56"},
+				Filters: []filter.Filter{{IPProto: "udp", DstPort: filter.Port(53)}},
+			},
+		},
+	}
+}
+
+func applyOnce(t *testing.T, b *FakeBackend, cfg *config.Config) *Plan {
+	t.Helper()
+	plan, err := ComputePlan(b, cfg)
+	if err != nil {
+		t.Fatalf("ComputePlan failed: %v", err)
+	}
+	if err := ApplyPlan(b, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	return plan
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 3 || plan.Count(PlanRemove) != 0 {
+		t.Fatalf("Expected 3 adds and 0 removes on first apply, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	if len(plan.Qdiscs) != 1 || plan.Qdiscs[0] != "eth0" {
+		t.Errorf("Expected clsact qdisc to be added to eth0, got %v", plan.Qdiscs)
+	}
+
+	// Addresses are stored the way tc reports them, so the second run must
+	// see every filter as unchanged
+	plan = applyOnce(t, b, cfg)
+	if plan.HasChanges() {
+		t.Errorf("Expected no changes on second apply, got %d adds, %d removes, qdiscs %v",
+			plan.Count(PlanAdd), plan.Count(PlanRemove), plan.Qdiscs)
+	}
+	if plan.Count(PlanKeep) != 3 {
+		t.Errorf("Expected 3 unchanged filters, got %d", plan.Count(PlanKeep))
+	}
+	if got := len(b.Filters[FakeKey("eth0", "ingress")]); got != 3 {
+		t.Errorf("Expected 3 filters on eth0 ingress, got %d", got)
+	}
+}
+
+func TestApplyRemovesStaleAndDuplicateFilters(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	// A leftover at a preference no rule uses and a filter of another tool
+	if _, err := b.AddMirrorFilter("eth0", "ingress", FilterID{Pref: 30005, Handle: 1}, filter.Mirred{Devs: []string{"eth2"}}, filter.Filter{IPProto: "udp", DstPort: filter.Port(53)}, cfg.Rules[1].Rewrite); err != nil {
+		t.Fatalf("AddMirrorFilter failed: %v", err)
+	}
+	key := FakeKey("eth0", "ingress")
+	b.Filters[key] = append(b.Filters[key], FilterStats{Priority: 1, Matches: map[string]string{"ip_proto": "tcp"}})
+
+	// Drop the HTTPS filter and change the DNS rule's target
+	cfg.Rules[0].Filters = cfg.Rules[0].Filters[:1]
+	cfg.Rules[1].DstIntf = config.Interfaces{"eth3"}
+
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 1 {
+		t.Errorf("Expected 1 add, got %d", plan.Count(PlanAdd))
+	}
+	if plan.Count(PlanRemove) != 3 {
+		t.Errorf("Expected 3 removes, got %d", plan.Count(PlanRemove))
+	}
+	if plan.Count(PlanKeep) != 1 {
+		t.Errorf("Expected 1 unchanged filter, got %d", plan.Count(PlanKeep))
+	}
+
+	filters := b.Filters[key]
+	if len(filters) != 3 {
+		t.Fatalf("Expected 3 filters after apply, got %d", len(filters))
+	}
+	foreign := 0
+	for _, f := range filters {
+		if !f.IsOwned() {
+			foreign++
+		}
+	}
+	if foreign != 1 {
+		t.Errorf("Expected the foreign filter to be kept, got %d foreign filters", foreign)
+	}
+
+	if plan = applyOnce(t, b, cfg); plan.HasChanges() {
+		t.Error("Expected no changes after reconciling")
+	}
+}
+
+func TestApplyDirection(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	cfg.Rules[0].Direction = config.DirectionBoth
+	cfg.Rules[1].Direction = config.DirectionEgress
+
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 5 {
+		t.Errorf("Expected 5 adds, got %d", plan.Count(PlanAdd))
+	}
+	if got := len(b.Filters[FakeKey("eth0", "ingress")]); got != 2 {
+		t.Errorf("Expected 2 filters on eth0 ingress, got %d", got)
+	}
+	if got := len(b.Filters[FakeKey("eth0", "egress")]); got != 3 {
+		t.Errorf("Expected 3 filters on eth0 egress, got %d", got)
+	}
+
+	// Switching the HTTP rule back to ingress only removes its egress filters
+	cfg.Rules[0].Direction = ""
+	plan = applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 0 || plan.Count(PlanRemove) != 2 {
+		t.Errorf("Expected 0 adds and 2 removes, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	if got := len(b.Filters[FakeKey("eth0", "egress")]); got != 1 {
+		t.Errorf("Expected 1 filter on eth0 egress, got %d", got)
+	}
+}
+
+func TestApplyReplacesFilterOnActionChange(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	cfg.Rules[1].Action = config.ActionRedirect
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 1 || plan.Count(PlanRemove) != 1 {
+		t.Fatalf("Expected 1 add and 1 remove, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+
+	filters := b.Filters[FakeKey("eth0", "ingress")]
+	last := filters[len(filters)-1]
+	mirred := last.Actions[len(last.Actions)-1]
+	if mirred.Operation != "Egress Redirect" || mirred.TargetDev != "eth2" {
+		t.Errorf("Expected an egress redirect to eth2, got %s to %s", mirred.Operation, mirred.TargetDev)
+	}
+
+	if plan = applyOnce(t, b, cfg); plan.HasChanges() {
+		t.Error("Expected no changes after reconciling")
+	}
+}
+
+func TestApplyExpandsPortLists(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	cfg.Rules[0].Filters = []filter.Filter{{
+		IPProto: "tcp",
+		DstPort: filter.Ports{{Min: 80, Max: 80}, {Min: 443, Max: 443}, {Min: 8000, Max: 8100}},
+	}}
+
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 4 {
+		t.Errorf("Expected 4 adds, got %d", plan.Count(PlanAdd))
+	}
+	ports := map[string]bool{}
+	for _, f := range b.Filters[FakeKey("eth0", "ingress")] {
+		ports[f.Matches["dst_port"]] = true
+	}
+	for _, want := range []string{"80", "443", "8000-8100", "53"} {
+		if !ports[want] {
+			t.Errorf("Expected a filter for dst_port %s, got %v", want, ports)
+		}
+	}
+
+	if plan = applyOnce(t, b, cfg); plan.HasChanges() {
+		t.Error("Expected no changes after reconciling")
+	}
+}
+
+func TestApplyInstallsExclusionsFirst(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	// Excluding traffic later must move the rule's filters behind the
+	// exclusion, which can only be added after every installed filter
+	cfg.Rules[0].Exclude = []filter.Filter{{DstIP: "10.0.0.1"}}
+	plan := applyOnce(t, b, cfg)
+	// Both filters of the rule can carry traffic to 10.0.0.1
+	if plan.Count(PlanAdd) != 4 || plan.Count(PlanRemove) != 2 {
+		t.Errorf("Expected 4 adds and 2 removes, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	prefs := map[string]int{}
+	for _, f := range filters {
+		prefs[f.Actions[len(f.Actions)-1].Type+" "+f.Matches["dst_port"]] = f.Priority
+	}
+	for _, port := range []string{"80", "443"} {
+		pass, mirror := prefs["gact "+port], prefs["mirred "+port]
+		if pass == 0 || mirror == 0 || pass > mirror {
+			t.Errorf("Expected the exclusion of port %s ahead of its mirror filter, got prefs %d and %d", port, pass, mirror)
+		}
+	}
+
+	if plan = applyOnce(t, b, cfg); plan.HasChanges() {
+		t.Error("Expected no changes after reconciling")
+	}
+}
+
+func TestApplyUsesRulePriorities(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	expected := []struct {
+		pref   int
+		handle string
+		port   string
+	}{
+		{30100, "0x1", "80"},
+		{30101, "0x2", "443"},
+		{30200, "0x1", "53"},
+	}
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	if len(filters) != len(expected) {
+		t.Fatalf("Expected %d filters, got %d", len(expected), len(filters))
+	}
+	for i, want := range expected {
+		f := filters[i]
+		if f.Priority != want.pref || f.Handle != want.handle || f.Matches["dst_port"] != want.port {
+			t.Errorf("Expected dst_port %s at pref %d handle %s, got %s at pref %d handle %s",
+				want.port, want.pref, want.handle, f.Matches["dst_port"], f.Priority, f.Handle)
+		}
+	}
+
+	// Explicit priorities put the DNS rule ahead of the HTTP rule
+	cfg.Rules[0].Priority = 60
+	cfg.Rules[1].Priority = 50
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 3 || plan.Count(PlanRemove) != 3 {
+		t.Errorf("Expected 3 adds and 3 removes, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	filters, _ = b.ListFilterStats("eth0", "ingress")
+	if len(filters) != 3 || filters[0].Priority != 35000 || filters[0].Matches["dst_port"] != "53" {
+		t.Errorf("Expected the DNS filter first at pref 35000, got %+v", filters)
+	}
+
+	if plan = applyOnce(t, b, cfg); plan.HasChanges() {
+		t.Error("Expected no changes after reconciling")
+	}
+}
+
+func TestApplyTagsFiltersWithCookies(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	expected := []string{
+		FilterCookie("http-mirror", 0),
+		FilterCookie("http-mirror", 1),
+		FilterCookie("dns-mirror", 0),
+	}
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	if len(filters) != len(expected) {
+		t.Fatalf("Expected %d filters, got %d", len(expected), len(filters))
+	}
+	for i, want := range expected {
+		for _, action := range filters[i].Actions {
+			if action.Cookie != want {
+				t.Errorf("Expected %s action of filter %d to carry cookie %s, got '%s'", action.Type, i, want, action.Cookie)
+			}
+		}
+	}
+	if expected[0] == expected[1] || expected[0] == expected[2] {
+		t.Errorf("Expected distinct cookies, got %v", expected)
+	}
+
+	// Renaming a rule retags its filters
+	cfg.Rules[1].Name = "dns-tap"
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 1 || plan.Count(PlanRemove) != 1 {
+		t.Errorf("Expected 1 add and 1 remove, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	filters, _ = b.ListFilterStats("eth0", "ingress")
+	if got := filters[2].Cookie(); got != FilterCookie("dns-tap", 0) {
+		t.Errorf("Expected cookie %s after the rename, got '%s'", FilterCookie("dns-tap", 0), got)
+	}
+}
+
+func TestApplyReplacesChangedRewrite(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	cfg.Rules[1].Rewrite.DstMAC = "52:54:00:ab:cd:ef"
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 1 || plan.Count(PlanRemove) != 1 {
+		t.Errorf("Expected 1 add and 1 remove, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	if got := filters[2].Actions[0].Describe(); got != "skbmod set dmac 52:54:00:ab:cd:ef" {
+		t.Errorf("Expected the new MAC to be installed, got '%s'", got)
+	}
+}
+
+func TestApplyReplacesFilterInPlace(t *testing.T) {
+	b := NewFakeBackend()
+	cfg := reconcileConfig()
+	applyOnce(t, b, cfg)
+
+	// The new filter takes the preference of the one it replaces
+	cfg.Rules[1].Filters[0].DstPort = filter.Port(5353)
+	plan := applyOnce(t, b, cfg)
+	if plan.Count(PlanAdd) != 1 || plan.Count(PlanRemove) != 1 {
+		t.Errorf("Expected 1 add and 1 remove, got %d and %d", plan.Count(PlanAdd), plan.Count(PlanRemove))
+	}
+	filters, _ := b.ListFilterStats("eth0", "ingress")
+	if len(filters) != 3 || filters[2].Priority != 30200 || filters[2].Matches["dst_port"] != "5353" {
+		t.Errorf("Expected dst_port 5353 at pref 30200, got %+v", filters)
+	}
+}
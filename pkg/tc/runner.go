@@ -33,6 +33,26 @@ func (r *Runner) Run(args ...string) (string, string, error) {
 		return "", "", nil
 	}
 
+	return execTC(args)
+}
+
+// query executes a read-only tc command. Unlike Run it prints the command
+// only in debug mode, so a dry run shows just the commands that would change
+// the host. In dry-run mode it reads nothing, as Run does.
+func (r *Runner) query(args ...string) (string, string, error) {
+	if r.Debug {
+		fmt.Printf("tc %s\n", strings.Join(args, " "))
+	}
+
+	if r.DryRun {
+		return "", "", nil
+	}
+
+	return execTC(args)
+}
+
+// execTC runs tc with args and returns its output.
+func execTC(args []string) (string, string, error) {
 	cmd := exec.Command("tc", args...)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
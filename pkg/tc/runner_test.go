@@ -1,6 +1,8 @@
 package tc
 
 import (
+	"io"
+	"os"
 	"strings"
 	"testing"
 )
@@ -24,3 +26,38 @@ func TestRunner_Run(t *testing.T) {
 		t.Errorf("Expected stdout to contain 'tc', got: %s", stdout)
 	}
 }
+
+func TestRunnerDeleteOnMissingInterface(t *testing.T) {
+	// tc fails on an interface that does not exist, which leaves nothing to
+	// delete; the outcome must not depend on the wording of its error
+	runner := NewRunner(false, false)
+	if err := runner.DeleteClsactQdisc("tcbroker-none0"); err != nil {
+		t.Errorf("DeleteClsactQdisc() error = %v, expected none", err)
+	}
+	if err := runner.DeleteFilter("tcbroker-none0", "ingress", 101); err != nil {
+		t.Errorf("DeleteFilter() error = %v, expected none", err)
+	}
+	if err := runner.EnsureClsactQdisc("tcbroker-none0"); err == nil {
+		t.Error("Expected EnsureClsactQdisc() to fail on a missing interface")
+	}
+}
+
+func TestRunnerDryRunPrintsOnlyChanges(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	// The presence check of the transaction is a query, not a change
+	err = NewTransaction(NewRunner(false, true)).EnsureClsactQdisc("eth0")
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("EnsureClsactQdisc() error = %v", err)
+	}
+	output, _ := io.ReadAll(r)
+	if expected := "tc qdisc add dev eth0 clsact\n"; string(output) != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+}
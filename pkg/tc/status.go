@@ -2,13 +2,12 @@ package tc
 
 import (
 	"fmt"
-	"strings"
 )
 
 // ListQdiscs returns a list of qdiscs for the specified interface.
 // Command: `tc qdisc show dev <iface>`
 func (r *Runner) ListQdiscs(iface string) (string, error) {
-	stdout, stderr, err := r.Run("qdisc", "show", "dev", iface)
+	stdout, stderr, err := r.query("qdisc", "show", "dev", iface)
 	if err != nil {
 		return "", fmt.Errorf("failed to list qdiscs for %s: %w, stderr: %s", iface, err, stderr)
 	}
@@ -18,7 +17,7 @@ func (r *Runner) ListQdiscs(iface string) (string, error) {
 // ListFilters returns a list of filters for the specified interface and hook (ingress/egress).
 // Command: `tc filter show dev <iface> <hook>`
 func (r *Runner) ListFilters(iface, hook string) (string, error) {
-	stdout, stderr, err := r.Run("filter", "show", "dev", iface, hook)
+	stdout, stderr, err := r.query("filter", "show", "dev", iface, hook)
 	if err != nil {
 		return "", fmt.Errorf("failed to list filters for %s (%s): %w, stderr: %s", iface, hook, err, stderr)
 	}
@@ -28,29 +27,70 @@ func (r *Runner) ListFilters(iface, hook string) (string, error) {
 // ListFiltersWithStats returns a list of filters with statistics for the specified interface and hook.
 // Command: `tc -s filter show dev <iface> <hook>`
 func (r *Runner) ListFiltersWithStats(iface, hook string) (string, error) {
-	stdout, stderr, err := r.Run("-s", "filter", "show", "dev", iface, hook)
+	stdout, stderr, err := r.query("-s", "filter", "show", "dev", iface, hook)
 	if err != nil {
 		return "", fmt.Errorf("failed to list filters with stats for %s (%s): %w, stderr: %s", iface, hook, err, stderr)
 	}
 	return stdout, nil
 }
 
+// GetQdiscs returns the qdiscs of the specified interface, decoded from
+// `tc -j qdisc show dev <iface>`. With a tc that can't print JSON it falls
+// back to reading the text output.
+func (r *Runner) GetQdiscs(iface string) ([]Qdisc, error) {
+	stdout, _, err := r.query("-j", "qdisc", "show", "dev", iface)
+	if err == nil && isJSON(stdout) {
+		return ParseQdiscs([]byte(stdout))
+	}
+	if err == nil {
+		return parseQdiscsText(stdout), nil
+	}
+	qdiscs, err := r.ListQdiscs(iface)
+	if err != nil {
+		return nil, err
+	}
+	return parseQdiscsText(qdiscs), nil
+}
+
 // HasClsactQdisc checks if the specified interface has a clsact qdisc attached.
 func (r *Runner) HasClsactQdisc(iface string) (bool, error) {
-	qdiscs, err := r.ListQdiscs(iface)
+	qdiscs, err := r.GetQdiscs(iface)
 	if err != nil {
 		return false, err
 	}
-	return strings.Contains(qdiscs, "clsact"), nil
+	for _, q := range qdiscs {
+		if q.Kind == "clsact" {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // GetAllInterfaces returns a list of all network interfaces that have tc rules.
 // This is a simple implementation that could be enhanced later.
 // Command: `tc qdisc show`
 func (r *Runner) GetAllInterfaces() (string, error) {
-	stdout, stderr, err := r.Run("qdisc", "show")
+	stdout, stderr, err := r.query("qdisc", "show")
 	if err != nil {
 		return "", fmt.Errorf("failed to list all qdiscs: %w, stderr: %s", err, stderr)
 	}
 	return stdout, nil
 }
+
+// ListFilterStats returns the filters on the given hook of iface, decoded
+// from `tc -s -j filter show`. Old versions of tc that reject -j, or ignore
+// it for filters, are read with the text parser instead.
+func (r *Runner) ListFilterStats(iface, hook string) ([]FilterStats, error) {
+	stdout, _, err := r.query("-s", "-j", "filter", "show", "dev", iface, hook)
+	if err == nil && isJSON(stdout) {
+		return ParseFilterStatsJSON([]byte(stdout))
+	}
+	if err == nil {
+		return ParseFilterStats(stdout)
+	}
+	output, err := r.ListFiltersWithStats(iface, hook)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFilterStats(output)
+}
@@ -0,0 +1,135 @@
+package tc
+
+import (
+	"fmt"
+	"strings"
+
+	"tcbroker/pkg/config"
+	"tcbroker/pkg/filter"
+)
+
+// Transaction records every qdisc and filter it creates through a Backend so
+// they can be undone if a later step fails. Qdiscs that already existed are
+// not recorded and therefore never removed by a rollback.
+type Transaction struct {
+	backend Backend
+	undo    []undoStep
+}
+
+type undoStep struct {
+	what string // the created object, e.g. "clsact qdisc on eth0"
+	run  func() error
+}
+
+// NewTransaction starts a transaction on top of b.
+func NewTransaction(b Backend) *Transaction {
+	return &Transaction{backend: b}
+}
+
+// EnsureClsactQdisc attaches a clsact qdisc to iface unless one is already
+// present, and records it for rollback if it was created.
+func (t *Transaction) EnsureClsactQdisc(iface string) error {
+	hasClsact, err := t.backend.HasClsactQdisc(iface)
+	if err != nil {
+		return err
+	}
+	if hasClsact {
+		return nil
+	}
+	if err := t.backend.EnsureClsactQdisc(iface); err != nil {
+		return err
+	}
+	t.undo = append(t.undo, undoStep{
+		what: fmt.Sprintf("clsact qdisc on %s", iface),
+		run:  func() error { return t.backend.DeleteClsactQdisc(iface) },
+	})
+	return nil
+}
+
+// AddMirrorFilter installs a mirror filter and records every filter the
+// backend reports as installed, also when it fails halfway.
+func (t *Transaction) AddMirrorFilter(ifaceName, direction string, id FilterID, target filter.Mirred, f filter.Filter, rewrite *config.RewriteOptions) error {
+	installed, err := t.backend.AddMirrorFilter(ifaceName, direction, id, target, f, rewrite)
+	t.record(installed)
+	return err
+}
+
+// AddPassFilter installs a pass filter and records every filter the backend
+// reports as installed, also when it fails halfway.
+func (t *Transaction) AddPassFilter(ifaceName, direction string, id FilterID, f filter.Filter) error {
+	installed, err := t.backend.AddPassFilter(ifaceName, direction, id, f)
+	t.record(installed)
+	return err
+}
+
+// record adds the undo steps for installed filters.
+func (t *Transaction) record(installed []FilterRef) {
+	for _, ref := range installed {
+		t.undo = append(t.undo, undoStep{
+			what: fmt.Sprintf("filter pref %d on %s (%s)", ref.Priority, ref.Iface, ref.Hook),
+			run:  func() error { return t.backend.DeleteFilter(ref.Iface, ref.Hook, ref.Priority) },
+		})
+	}
+}
+
+// Rollback undoes the recorded changes in reverse order and wraps cause in a
+// RollbackError describing the outcome. Every step is attempted even if an
+// earlier one fails.
+func (t *Transaction) Rollback(cause error) error {
+	rbErr := &RollbackError{Err: cause}
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		step := t.undo[i]
+		if err := step.run(); err != nil {
+			rbErr.Failed = append(rbErr.Failed, fmt.Errorf("could not delete %s: %w", step.what, err))
+			continue
+		}
+		rbErr.Undone = append(rbErr.Undone, "deleted "+step.what)
+	}
+	t.undo = nil
+	return rbErr
+}
+
+// RollbackError reports a failed operation together with the result of
+// rolling back the changes made before it.
+type RollbackError struct {
+	// Err is the failure that triggered the rollback.
+	Err error
+	// Undone describes the changes that were rolled back, in rollback order.
+	Undone []string
+	// Failed holds one error per change that could not be rolled back.
+	Failed []error
+}
+
+// Succeeded reports whether every recorded change was undone.
+func (e *RollbackError) Succeeded() bool {
+	return len(e.Failed) == 0
+}
+
+func (e *RollbackError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+
+	if len(e.Undone) == 0 && len(e.Failed) == 0 {
+		b.WriteString("\nnothing to roll back")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "\nrolled back %d change(s):", len(e.Undone))
+	for _, desc := range e.Undone {
+		fmt.Fprintf(&b, "\n  - %s", desc)
+	}
+	if e.Succeeded() {
+		b.WriteString("\nrollback succeeded")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "\nrollback FAILED, %d change(s) could not be undone:", len(e.Failed))
+	for _, err := range e.Failed {
+		fmt.Fprintf(&b, "\n  - %v", err)
+	}
+	return b.String()
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}